@@ -193,14 +193,20 @@ function install_lightmonitor() {
 			echo "URL 必须以 ws:// 或 wss:// 开始，请重新输入。"
 		done
         while true; do
-            read -p "请输入本节点连接的 Token: " token
+            read -p "请输入本节点连接的 Token 或注册码: " token
             if [[ -n "$token" ]]; then
                 break
             fi
             echo "Token 不能为空，请重新输入。"
         done
-        exec_start_params=" -url $url -token $token"
-        echo "节点 Token: $token"
+        # 注册码格式为 XXXX-XXXX-XXXX-XXXX-XXXX-XXXX，首次启动时注册节点并将 Token 保存到 Client.yaml
+        if [[ "$token" =~ ^[A-Za-z2-7]{4}(-[A-Za-z2-7]{4}){5}$ ]]; then
+            exec_start_params=" -url $url -enroll $token"
+            echo "注册码: $token"
+        else
+            exec_start_params=" -url $url -token $token"
+            echo "节点 Token: $token"
+        fi
     fi
 
     # 直接生成整个service文件内容
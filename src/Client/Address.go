@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+)
+
+// 运营商级 NAT 地址段，不属于公网地址
+var cgnatNet = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// GetPublicIP 从本机网卡中查找公网 IPv4 和 IPv6 地址
+func GetPublicIP() (ipv4, ipv6 string) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return "", ""
+	}
+
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || isIgnoredInterface(iface.Name) {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || !isPublicIP(ipNet.IP) {
+				continue
+			}
+
+			if ip4 := ipNet.IP.To4(); ip4 != nil {
+				if ipv4 == "" {
+					ipv4 = ip4.String()
+				}
+			} else if ipv6 == "" {
+				ipv6 = ipNet.IP.String()
+			}
+		}
+	}
+	return ipv4, ipv6
+}
+
+// isPublicIP 判断是否为公网地址
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	if cgnatNet.Contains(ip) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,53 @@
+package main
+
+// SampleBuffer 环形缓冲区，存储离线期间的采样，写满后覆盖最旧的采样
+type SampleBuffer struct {
+	samples []Sample
+	start   int // 最旧采样的位置
+	count   int
+}
+
+// NewSampleBuffer 创建容量为 size 的缓冲区
+func NewSampleBuffer(size int) *SampleBuffer {
+	return &SampleBuffer{samples: make([]Sample, size)}
+}
+
+// Push 添加采样
+func (b *SampleBuffer) Push(s Sample) {
+	size := len(b.samples)
+	if size == 0 {
+		return
+	}
+
+	b.samples[(b.start+b.count)%size] = s
+	if b.count < size {
+		b.count++
+	} else {
+		b.start = (b.start + 1) % size // 已满，丢弃最旧的采样
+	}
+}
+
+// Peek 按时间顺序返回最旧的 n 个采样，不移除
+func (b *SampleBuffer) Peek(n int) []Sample {
+	n = min(n, b.count)
+	ret := make([]Sample, 0, n)
+	for i := 0; i < n; i++ {
+		ret = append(ret, b.samples[(b.start+i)%len(b.samples)])
+	}
+	return ret
+}
+
+// Drop 移除最旧的 n 个采样
+func (b *SampleBuffer) Drop(n int) {
+	n = min(n, b.count)
+	for i := 0; i < n; i++ {
+		b.samples[(b.start+i)%len(b.samples)] = Sample{} // 释放引用
+	}
+	b.start = (b.start + n) % len(b.samples)
+	b.count -= n
+}
+
+// Len 返回缓冲区中的采样数
+func (b *SampleBuffer) Len() int {
+	return b.count
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/shirou/gopsutil/v3/process"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CheckResult 结构体，存储单项检查的结果
+type CheckResult struct {
+	Name      string
+	Type      string
+	Target    string
+	OK        bool
+	Latency   float64 // 毫秒
+	Message   string  // 失败原因
+	TimeStamp int64
+}
+
+var (
+	checkResults = make(map[string]CheckResult) // 检查名称 -> 最近一次结果
+	checkMutex   sync.RWMutex
+)
+
+// StartChecks 为每项检查启动独立的定时任务
+func StartChecks(checks []CheckConfig) {
+	for _, c := range checks {
+		go func(c CheckConfig) {
+			ticker := time.NewTicker(time.Duration(c.Interval) * time.Second)
+			defer ticker.Stop()
+
+			for {
+				result := RunCheck(c)
+				checkMutex.Lock()
+				checkResults[c.Name] = result
+				checkMutex.Unlock()
+				<-ticker.C
+			}
+		}(c)
+	}
+}
+
+// GetCheckResults 按配置顺序返回最近一次的检查结果
+func GetCheckResults(checks []CheckConfig) []CheckResult {
+	checkMutex.RLock()
+	defer checkMutex.RUnlock()
+
+	ret := make([]CheckResult, 0, len(checks))
+	for _, c := range checks {
+		if result, ok := checkResults[c.Name]; ok {
+			ret = append(ret, result)
+		}
+	}
+	return ret
+}
+
+// RunCheck 执行单项检查
+func RunCheck(c CheckConfig) CheckResult {
+	result := CheckResult{
+		Name:      c.Name,
+		Type:      c.Type,
+		Target:    c.Target,
+		TimeStamp: time.Now().Unix(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.Timeout)*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	var err error
+	switch c.Type {
+	case "tcp":
+		err = checkTCP(ctx, c.Target)
+	case "http":
+		err = checkHTTP(ctx, c)
+	case "systemd":
+		err = checkSystemd(ctx, c.Target)
+	case "process":
+		err = checkProcess(c.Target)
+	default:
+		err = fmt.Errorf("不支持的检查类型: %s", c.Type)
+	}
+	result.Latency = Decimal(float64(time.Since(start).Microseconds()) / 1000)
+
+	if err != nil {
+		result.Message = err.Error()
+	} else {
+		result.OK = true
+	}
+	return result
+}
+
+// checkTCP 检查端口是否可以连接
+func checkTCP(ctx context.Context, address string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return fmt.Errorf("连接失败: %v", err)
+	}
+	return conn.Close()
+}
+
+// checkHTTP 检查 HTTP GET 的状态码及响应内容
+func checkHTTP(ctx context.Context, c CheckConfig) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.Target, nil)
+	if err != nil {
+		return fmt.Errorf("请求构建失败: %v", err)
+	}
+	req.Header.Set("User-Agent", fmt.Sprintf("LightMonitorClient/%.1f", version))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("请求失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != c.Status {
+		return fmt.Errorf("状态码 %d，期望 %d", resp.StatusCode, c.Status)
+	}
+
+	if c.Contains != "" {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if err != nil {
+			return fmt.Errorf("读取响应失败: %v", err)
+		}
+		if !strings.Contains(string(body), c.Contains) {
+			return fmt.Errorf("响应不包含 %q", c.Contains)
+		}
+	}
+	return nil
+}
+
+// checkSystemd 检查 systemd 服务是否处于 active 状态
+func checkSystemd(ctx context.Context, unit string) error {
+	output, _ := exec.CommandContext(ctx, "systemctl", "is-active", unit).Output()
+	state := strings.TrimSpace(string(output))
+	if state != "active" {
+		if state == "" {
+			state = "unknown"
+		}
+		return fmt.Errorf("服务状态: %s", state)
+	}
+	return nil
+}
+
+// checkProcess 检查指定名称的进程是否在运行
+func checkProcess(name string) error {
+	procs, err := process.Processes()
+	if err != nil {
+		return fmt.Errorf("获取进程列表失败: %v", err)
+	}
+	for _, p := range procs {
+		if n, err := p.Name(); err == nil && n == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("进程未运行")
+}
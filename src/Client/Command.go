@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 服务端下发的远程命令（status 6），只执行配置文件 commands 中允许的命令
+
+// 命令输出的最大长度
+const maxCommandOutput = 64 * 1024
+
+// ping、traceroute 的目标只能是主机名或 IP，不能以 - 开头，避免被当作参数
+var commandTargetPattern = regexp.MustCompile(`^[a-zA-Z0-9_.:][a-zA-Z0-9_.:-]{0,252}$`)
+
+var (
+	resendHost      atomic.Bool                    // 下次上报时重新采集并发送主机信息
+	intervalChanges = make(chan IntervalConfig, 1) // 修改采集间隔，为 0 的项不修改
+)
+
+// CommandRequest 远程命令
+type CommandRequest struct {
+	ID      string                 `json:"id"`
+	Command string                 `json:"command"`
+	Args    map[string]interface{} `json:"args"`
+	Timeout int                    `json:"timeout"` // 服务端等待结果的时间（秒）
+}
+
+// HandleCommand 执行远程命令并返回结果
+func HandleCommand(conn *websocket.Conn, config *Config, data json.RawMessage) {
+	var request CommandRequest
+	if err := json.Unmarshal(data, &request); err != nil || request.ID == "" {
+		log.Printf("远程命令格式错误\n")
+		return
+	}
+
+	status, output := "ok", ""
+	if !slices.Contains(config.Commands, request.Command) {
+		log.Printf("拒绝远程命令 %s，如需允许请在配置文件 commands 中添加\n", request.Command)
+		status, output = "denied", fmt.Sprintf("客户端未允许命令 %s", request.Command)
+	} else {
+		log.Printf("执行远程命令 %s\n", request.Command)
+		var err error
+		output, err = runCommand(request)
+		if err != nil {
+			status = "error"
+			output = fmt.Sprintf("%s\n%v", output, err)
+		}
+	}
+	if len(output) > maxCommandOutput {
+		output = output[:maxCommandOutput]
+	}
+
+	resultMessage := struct {
+		Action string      `json:"action"`
+		Data   interface{} `json:"data"`
+	}{
+		Action: "command_result",
+		Data: map[string]string{
+			"id":     request.ID,
+			"status": status,
+			"output": output,
+		},
+	}
+	if err := sendMessage(conn, resultMessage); err != nil {
+		log.Printf("发送远程命令结果失败: %v\n", err)
+		return
+	}
+
+	// 结果发送后退出，由 systemd 等服务管理器重新启动
+	if request.Command == "restart" && status == "ok" {
+		log.Printf("收到重启命令，正在退出\n")
+		time.Sleep(time.Second)
+		os.Exit(3)
+	}
+}
+
+// runCommand 执行允许的命令
+func runCommand(request CommandRequest) (string, error) {
+	// 在服务端停止等待之前结束命令
+	timeout := request.Timeout - 2
+	if timeout < 1 || timeout > 118 {
+		timeout = 28
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	switch request.Command {
+	case "host":
+		resendHost.Store(true)
+		return "将在下次上报时重新发送主机信息", nil
+	case "interval":
+		// 为 0 的项不修改
+		var interval IntervalConfig
+		for key, value := range map[string]*int{"Fast": &interval.Fast, "Slow": &interval.Slow, "Host": &interval.Host} {
+			if seconds, ok := request.Args[key].(float64); ok && seconds >= 1 && seconds <= 3600 {
+				*value = int(seconds)
+			}
+		}
+		select {
+		case intervalChanges <- interval:
+		default:
+			return "", fmt.Errorf("上一次修改尚未生效")
+		}
+		return fmt.Sprintf("采集间隔已修改（fast=%d slow=%d host=%d，0 为不变），重启后恢复配置文件中的值", interval.Fast, interval.Slow, interval.Host), nil
+	case "ping":
+		target, _ := request.Args["Target"].(string)
+		if !commandTargetPattern.MatchString(target) {
+			return "", fmt.Errorf("目标地址无效")
+		}
+		return execCommand(ctx, "ping", "-c", "4", "-W", "2", target)
+	case "traceroute":
+		target, _ := request.Args["Target"].(string)
+		if !commandTargetPattern.MatchString(target) {
+			return "", fmt.Errorf("目标地址无效")
+		}
+		return execCommand(ctx, "traceroute", "-w", "2", "-q", "1", "-m", "20", target)
+	case "df":
+		return execCommand(ctx, "df", "-h")
+	case "restart":
+		return "正在重启", nil
+	}
+	return "", fmt.Errorf("不支持的命令: %s", request.Command)
+}
+
+// execCommand 执行命令并返回标准输出和标准错误
+func execCommand(ctx context.Context, name string, args ...string) (string, error) {
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Run()
+	return output.String(), err
+}
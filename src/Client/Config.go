@@ -2,46 +2,110 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"gopkg.in/yaml.v3"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
 )
 
 type Config struct {
-	URL   string `yaml:"url"`
-	Token string `yaml:"token"`
+	URL             string          `yaml:"url"`
+	Token           string          `yaml:"token"`
+	Process         ProcessConfig   `yaml:"process"`
+	Container       ContainerConfig `yaml:"container"`
+	Checks          []CheckConfig   `yaml:"checks"`
+	Custom          []CustomConfig  `yaml:"custom"`
+	Interval        IntervalConfig  `yaml:"interval"`
+	Batch           int             `yaml:"batch"`             // 每条报告包含的采样数，1 为不批量发送
+	Buffer          int             `yaml:"buffer"`            // 离线时最多缓存的采样数，-1 为不缓存
+	Collector       string          `yaml:"collector"`         // local 或 node_exporter
+	NodeExporterURL string          `yaml:"node_exporter_url"` // collector 为 node_exporter 时抓取的地址
+	LegacyLogin     bool            `yaml:"legacy_login"`      // 服务端不支持挑战应答登录时是否直接发送 Token
+	TLS             TLSConfig       `yaml:"tls"`
+	Commands        []string        `yaml:"commands"` // 允许服务端执行的远程命令，为空时不执行任何命令
+
+	EnrollCode string `yaml:"-"` // 命令行 -enroll 指定的注册码，注册成功后清空
+	path       string // 配置文件路径，注册成功后将 Token 写入该文件
+}
+
+// TLSConfig 连接 wss:// 服务端时的 TLS 配置
+type TLSConfig struct {
+	CA                 string `yaml:"ca"`                   // 校验服务端证书的 CA，为空时使用系统证书
+	Cert               string `yaml:"cert"`                 // 客户端证书，服务端开启客户端证书校验时使用
+	Key                string `yaml:"key"`                  // 客户端证书私钥
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"` // 不校验服务端证书，仅用于测试
+}
+
+// CustomConfig 自定义采集器配置
+type CustomConfig struct {
+	Name     string   `yaml:"name"`
+	Command  string   `yaml:"command"`
+	Args     []string `yaml:"args"`
+	Format   string   `yaml:"format"`   // 输出格式：json 或 prometheus
+	Timeout  int      `yaml:"timeout"`  // 超时（秒）
+	Interval int      `yaml:"interval"` // 执行间隔（秒）
+}
+
+// IntervalConfig 采集间隔配置（秒）
+type IntervalConfig struct {
+	Fast int `yaml:"fast"` // CPU、内存、网络等
+	Slow int `yaml:"slow"` // 磁盘使用情况、连接数
+	Host int `yaml:"host"` // 主机静态信息
+}
+
+// ProcessConfig 进程上报配置
+type ProcessConfig struct {
+	TopN     int `yaml:"top_n"`    // 上报CPU和内存占用前N的进程，0为不上报
+	Interval int `yaml:"interval"` // 采样间隔（秒）
 }
 
 // LoadConfig 从配置文件加载配置
 func LoadConfig() (*Config, error) {
-	configPath := "Client.yaml"
-
 	// 定义命令行参数
 	configFile := flag.String("c", "", "配置文件路径 (默认为当前程序目录下的 Client.yaml)")
 	url := flag.String("url", "", "ws(s)://api.example.com/Monitor/Node")
 	token := flag.String("token", "", "Token")
+	legacyLogin := flag.Bool("legacy_login", false, "服务端不支持挑战应答登录时直接发送 Token")
+	tlsCA := flag.String("tls_ca", "", "校验服务端证书的 CA 文件")
+	tlsCert := flag.String("tls_cert", "", "客户端证书文件")
+	tlsKey := flag.String("tls_key", "", "客户端证书私钥文件")
+	enroll := flag.String("enroll", "", "注册码，首次启动时自动添加节点并将 Token 写入配置文件")
 	flag.Parse()
 
 	var config Config
 
-	// 判断是否同时提供了 -url 和 -token
-	if *url != "" && *token != "" {
-		//fmt.Println("使用命令行参数 URL 和 Token")
-		//fmt.Printf("URL: %s, Token: %s\n", *url, *token)
-		config.URL = *url
-		config.Token = *token
-		return &config, nil
-	}
-
 	// 如果没有提供 -c 参数，则尝试默认加载配置文件
 	if *configFile == "" {
 		// 获取当前程序所在目录
 		currentDir := getCurrentDir()
 		*configFile = filepath.Join(currentDir, "Client.yaml")
 	}
+	config.path = *configFile
+	config.EnrollCode = *enroll
+
+	// 判断是否同时提供了 -url 和 -token（或 -enroll、-tls_cert）
+	if *url != "" && (*token != "" || *enroll != "" || *tlsCert != "") {
+		//fmt.Println("使用命令行参数 URL 和 Token")
+		//fmt.Printf("URL: %s, Token: %s\n", *url, *token)
+		config.URL = *url
+		config.Token = *token
+		// 已使用注册码注册过时使用保存的 Token，重启服务不会重复注册
+		if config.Token == "" {
+			var saved Config
+			if data, err := ioutil.ReadFile(config.path); err == nil && yaml.Unmarshal(data, &saved) == nil && saved.Token != "" {
+				config.Token = saved.Token
+				config.EnrollCode = ""
+			}
+		}
+		config.LegacyLogin = *legacyLogin
+		config.TLS = TLSConfig{CA: *tlsCA, Cert: *tlsCert, Key: *tlsKey}
+		setDefaults(&config)
+		return &config, nil
+	}
 
-	data, err := ioutil.ReadFile(configPath)
+	data, err := ioutil.ReadFile(*configFile)
 	if err != nil {
 		return nil, err
 	}
@@ -50,9 +114,114 @@ func LoadConfig() (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	// 配置文件中已有 Token 时说明已经注册过，忽略注册码，重启服务不会重复注册
+	if config.Token != "" {
+		config.EnrollCode = ""
+	}
+	setDefaults(&config)
 	return &config, nil
 }
 
+// tokenLine 配置文件中顶层的 token 配置
+var tokenLine = regexp.MustCompile(`(?m)^token:.*?(\r?)$`)
+
+// SaveToken 将注册获得的 Token 写入配置文件，保留其余内容和注释
+// 配置文件不存在时（使用 -url 和 -enroll 启动）创建只包含 url 和 token 的配置文件
+func SaveToken(config *Config, token string) error {
+	line := fmt.Sprintf("token: %q", token)
+	data, err := ioutil.ReadFile(config.path)
+	switch {
+	case os.IsNotExist(err):
+		data = []byte(fmt.Sprintf("url: %q\n%s\n", config.URL, line))
+	case err != nil:
+		return err
+	case tokenLine.Match(data):
+		data = tokenLine.ReplaceAll(data, []byte(line+"$1"))
+	default:
+		data = append([]byte(line+"\n"), data...)
+	}
+	return ioutil.WriteFile(config.path, data, 0600)
+}
+
+// ContainerConfig 容器监控配置
+type ContainerConfig struct {
+	Enable       bool   `yaml:"enable"`
+	CgroupRoot   string `yaml:"cgroup_root"`   // cgroup v2 挂载点
+	DockerSocket string `yaml:"docker_socket"` // 可选，用于获取容器名称、镜像和状态
+}
+
+// CheckConfig 服务检查配置
+type CheckConfig struct {
+	Name     string `yaml:"name"`
+	Type     string `yaml:"type"`     // tcp、http、systemd 或 process
+	Target   string `yaml:"target"`   // 地址、URL、服务名或进程名
+	Status   int    `yaml:"status"`   // http 期望的状态码，默认 200
+	Contains string `yaml:"contains"` // http 期望响应包含的内容
+	Timeout  int    `yaml:"timeout"`  // 超时（秒）
+	Interval int    `yaml:"interval"` // 检查间隔（秒）
+}
+
+// setDefaults 为未配置的项设置默认值
+func setDefaults(config *Config) {
+	for i := range config.Custom {
+		c := &config.Custom[i]
+		if c.Name == "" {
+			c.Name = filepath.Base(c.Command)
+		}
+		if c.Format == "" {
+			c.Format = "json"
+		}
+		if c.Timeout <= 0 {
+			c.Timeout = 10
+		}
+		if c.Interval <= 0 {
+			c.Interval = 60
+		}
+	}
+	if config.Interval.Fast <= 0 {
+		config.Interval.Fast = 1
+	}
+	if config.Interval.Slow <= 0 {
+		config.Interval.Slow = 10
+	}
+	if config.Interval.Host <= 0 {
+		config.Interval.Host = 60
+	}
+	if config.Collector == "" {
+		config.Collector = "local"
+	}
+	if config.NodeExporterURL == "" {
+		config.NodeExporterURL = "http://127.0.0.1:9100/metrics"
+	}
+	if config.Batch <= 0 {
+		config.Batch = 1
+	}
+	if config.Buffer == 0 {
+		config.Buffer = 3600
+	}
+	if config.Process.Interval <= 0 {
+		config.Process.Interval = 10
+	}
+	if config.Container.CgroupRoot == "" {
+		config.Container.CgroupRoot = "/sys/fs/cgroup"
+	}
+	for i := range config.Checks {
+		c := &config.Checks[i]
+		if c.Name == "" {
+			c.Name = fmt.Sprintf("%s:%s", c.Type, c.Target)
+		}
+		if c.Status == 0 {
+			c.Status = 200
+		}
+		if c.Timeout <= 0 {
+			c.Timeout = 5
+		}
+		if c.Interval <= 0 {
+			c.Interval = 30
+		}
+	}
+}
+
 // 获取当前程序的路径
 func getCurrentDir() string {
 	// 获取当前程序所在的路径
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Container 结构体，存储单个容器的状态信息
+type Container struct {
+	ID          string
+	Name        string
+	Image       string
+	State       string
+	CPU         float64 // CPU使用率，100 表示占满一个核心
+	MemUsed     uint64
+	MemLimit    uint64 // 0 表示未限制
+	NetInSpeed  uint64
+	NetOutSpeed uint64
+	NetIn       uint64 // 累计接收字节数
+	NetOut      uint64 // 累计发送字节数
+}
+
+// containerSample 容器上次采样的累计值，用于计算速率
+type containerSample struct {
+	CPUUsage  uint64 // 微秒
+	NetIn     uint64
+	NetOut    uint64
+	TimeStamp time.Time
+}
+
+// dockerContainer Docker API 返回的容器信息
+type dockerContainer struct {
+	ID    string   `json:"Id"`
+	Names []string `json:"Names"`
+	Image string   `json:"Image"`
+	State string   `json:"State"`
+}
+
+// 匹配容器 cgroup 目录名，兼容 systemd 和 cgroupfs 两种驱动
+var containerCgroupPattern = regexp.MustCompile(`^(?:docker-|libpod-|cri-containerd-)?([0-9a-f]{64})(?:\.scope)?$`)
+
+var (
+	lastContainerSamples = make(map[string]containerSample)
+	dockerCache          []dockerContainer // Docker 容器列表缓存
+	dockerCacheTime      time.Time
+)
+
+// Docker 容器列表缓存时间
+const dockerCacheTTL = 10 * time.Second
+
+// GetContainers 获取所有容器的状态信息
+func GetContainers(cfg ContainerConfig) ([]Container, error) {
+	cgroups, err := findContainerCgroups(cfg.CgroupRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	// 有 Docker Socket 时以 Docker 的容器列表为准，可以获取名称、镜像和停止的容器
+	var containers []Container
+	if cfg.DockerSocket != "" {
+		list, err := listDockerContainers(cfg.DockerSocket)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range list {
+			name := d.ID[:min(12, len(d.ID))]
+			if len(d.Names) > 0 {
+				name = strings.TrimPrefix(d.Names[0], "/")
+			}
+			containers = append(containers, Container{ID: d.ID, Name: name, Image: d.Image, State: d.State})
+		}
+	} else {
+		for id := range cgroups {
+			containers = append(containers, Container{ID: id, Name: id[:12], State: "running"})
+		}
+	}
+
+	now := time.Now()
+	samples := make(map[string]containerSample, len(containers))
+	for i := range containers {
+		c := &containers[i]
+		path, ok := cgroups[c.ID]
+		if !ok {
+			continue // 容器未运行
+		}
+
+		var sample containerSample
+		sample.TimeStamp = now
+		sample.CPUUsage = readCgroupStat(filepath.Join(path, "cpu.stat"), "usage_usec")
+		c.MemUsed = readCgroupValue(filepath.Join(path, "memory.current"))
+		c.MemLimit = readCgroupValue(filepath.Join(path, "memory.max"))
+
+		// 通过容器内进程读取其网络命名空间的流量
+		if pid := readCgroupPid(path); pid > 0 {
+			sample.NetIn, sample.NetOut = readNetDev(pid)
+		}
+		c.NetIn = sample.NetIn
+		c.NetOut = sample.NetOut
+
+		if last, ok := lastContainerSamples[c.ID]; ok {
+			elapsed := now.Sub(last.TimeStamp).Seconds()
+			if elapsed > 0 {
+				if sample.CPUUsage >= last.CPUUsage {
+					c.CPU = Decimal(float64(sample.CPUUsage-last.CPUUsage) / 1e6 / elapsed * 100)
+				}
+				if sample.NetIn >= last.NetIn {
+					c.NetInSpeed = uint64(float64(sample.NetIn-last.NetIn) / elapsed)
+				}
+				if sample.NetOut >= last.NetOut {
+					c.NetOutSpeed = uint64(float64(sample.NetOut-last.NetOut) / elapsed)
+				}
+			}
+		}
+		samples[c.ID] = sample
+	}
+	lastContainerSamples = samples
+
+	return containers, nil
+}
+
+// findContainerCgroups 在 cgroup v2 目录中查找容器，返回 容器ID -> cgroup 路径
+func findContainerCgroups(root string) (map[string]string, error) {
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err != nil {
+		return nil, fmt.Errorf("未找到 cgroup v2: %v", err)
+	}
+
+	ret := make(map[string]string)
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if m := containerCgroupPattern.FindStringSubmatch(d.Name()); m != nil {
+			ret[m[1]] = path
+			return filepath.SkipDir
+		}
+		// 容器 cgroup 一般位于 system.slice 或 docker 目录下，限制搜索深度
+		if strings.Count(strings.TrimPrefix(path, root), string(os.PathSeparator)) > 3 {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return ret, err
+}
+
+// readCgroupValue 读取只包含一个数值的 cgroup 文件，"max" 或读取失败返回 0
+func readCgroupValue(path string) uint64 {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	value, _ := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	return value
+}
+
+// readCgroupStat 读取 key value 格式的 cgroup 文件中的指定项
+func readCgroupStat(path, key string) uint64 {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == key {
+			value, _ := strconv.ParseUint(fields[1], 10, 64)
+			return value
+		}
+	}
+	return 0
+}
+
+// readCgroupPid 获取 cgroup 中的第一个进程
+func readCgroupPid(path string) int {
+	data, err := os.ReadFile(filepath.Join(path, "cgroup.procs"))
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0
+	}
+	pid, _ := strconv.Atoi(fields[0])
+	return pid
+}
+
+// readNetDev 读取进程所在网络命名空间的累计收发字节数（忽略 lo）
+func readNetDev(pid int) (recv, sent uint64) {
+	file, err := os.Open(fmt.Sprintf("/proc/%d/net/dev", pid))
+	if err != nil {
+		return 0, 0
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		name, stats, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || strings.TrimSpace(name) == "lo" {
+			continue
+		}
+		fields := strings.Fields(stats)
+		if len(fields) < 9 {
+			continue
+		}
+		in, _ := strconv.ParseUint(fields[0], 10, 64)
+		out, _ := strconv.ParseUint(fields[8], 10, 64)
+		recv += in
+		sent += out
+	}
+	return recv, sent
+}
+
+// listDockerContainers 通过 Docker Socket 获取容器列表（带缓存）
+func listDockerContainers(socket string) ([]dockerContainer, error) {
+	if dockerCache != nil && time.Since(dockerCacheTime) < dockerCacheTTL {
+		return dockerCache, nil
+	}
+
+	client := http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+
+	resp, err := client.Get("http://docker/containers/json?all=1")
+	if err != nil {
+		return nil, fmt.Errorf("请求 Docker 失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("请求 Docker 失败: %s", resp.Status)
+	}
+
+	var list []dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("解析 Docker 容器列表失败: %v", err)
+	}
+
+	dockerCache = list
+	dockerCacheTime = time.Now()
+	return list, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+var (
+	customResults = make(map[string]map[string]interface{}) // 采集器名称 -> 最近一次结果
+	customMutex   sync.RWMutex
+)
+
+// StartCustom 为每个自定义采集器启动独立的定时任务
+func StartCustom(collectors []CustomConfig) {
+	for _, c := range collectors {
+		go func(c CustomConfig) {
+			ticker := time.NewTicker(time.Duration(c.Interval) * time.Second)
+			defer ticker.Stop()
+
+			for {
+				values, err := RunCustom(c)
+				customMutex.Lock()
+				if err != nil {
+					// 执行失败时删除上一次的结果，避免一直上报过期的数据
+					delete(customResults, c.Name)
+				} else {
+					customResults[c.Name] = values
+				}
+				customMutex.Unlock()
+				if err != nil {
+					log.Printf("自定义采集器 %s 执行失败: %v", c.Name, err)
+				}
+				<-ticker.C
+			}
+		}(c)
+	}
+}
+
+// GetCustomResults 返回所有自定义采集器最近一次的结果
+func GetCustomResults() map[string]map[string]interface{} {
+	customMutex.RLock()
+	defer customMutex.RUnlock()
+
+	ret := make(map[string]map[string]interface{}, len(customResults))
+	for name, values := range customResults {
+		ret[name] = values
+	}
+	return ret
+}
+
+// RunCustom 执行自定义采集器并解析其输出
+func RunCustom(c CustomConfig) (map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.Timeout)*time.Second)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, c.Command, c.Args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("执行失败: %v", err)
+	}
+
+	values := make(map[string]interface{})
+	switch c.Format {
+	case "json":
+		var data map[string]interface{}
+		if err := json.Unmarshal(output, &data); err != nil {
+			return nil, fmt.Errorf("解析 JSON 失败: %v", err)
+		}
+		flattenJSON("", data, values)
+	case "prometheus":
+		metrics, err := ParsePrometheus(bytes.NewReader(output))
+		if err != nil {
+			return nil, fmt.Errorf("解析 Prometheus 格式失败: %v", err)
+		}
+		for _, m := range metrics {
+			values[m.Key()] = m.Value
+		}
+	default:
+		return nil, fmt.Errorf("不支持的输出格式: %s", c.Format)
+	}
+	return values, nil
+}
+
+// flattenJSON 将嵌套的 JSON 对象展开为以 . 连接的键，忽略数组和 null
+func flattenJSON(prefix string, data map[string]interface{}, values map[string]interface{}) {
+	for key, value := range data {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			flattenJSON(key, v, values)
+		case float64, string, bool:
+			values[key] = v
+		}
+	}
+}
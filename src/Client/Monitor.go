@@ -8,8 +8,10 @@ import (
 	"github.com/shirou/gopsutil/v3/load"
 	"github.com/shirou/gopsutil/v3/mem"
 	"github.com/shirou/gopsutil/v3/net"
+	"github.com/shirou/gopsutil/v3/process"
 	"reflect"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -19,20 +21,34 @@ var lastHost Host
 
 // Host 结构体，存储主机基本信息
 type Host struct {
-	Platform        string
-	PlatformVersion string
-	Arch            string
-	Virtualization  string
-	BootTime        uint64
-	CPU             []string
-	MemTotal        uint64
-	SwapTotal       uint64
-	DiskTotal       uint64
+	Platform           string
+	PlatformVersion    string
+	KernelVersion      string
+	Arch               string
+	Hostname           string
+	Virtualization     string // 虚拟化类型，如 kvm、lxc、docker
+	VirtualizationRole string // guest 或 host
+	BootTime           uint64
+	CPU                []string // 所有不同的CPU型号
+	CoreCount          int      // 物理核心数
+	ThreadCount        int      // 逻辑核心（线程）数
+	MemTotal           uint64
+	SwapTotal          uint64
+	DiskTotal          uint64
+	IPv4               string // 本机网卡上的公网 IPv4
+	IPv6               string // 本机网卡上的公网 IPv6
+	Timezone           string
 }
 
 // HostState 结构体，存储主机实时状态信息
 type HostState struct {
 	CPU             float64
+	CPUCores        []float64 // 各核心使用率
+	CPUUser         float64   // 用户态占比
+	CPUSystem       float64   // 内核态占比
+	CPUIowait       float64   // IO等待占比
+	CPUSteal        float64   // 被宿主机占用（窃取）占比
+	CPUIdle         float64   // 空闲占比
 	Load1           float64
 	Load5           float64
 	Load15          float64
@@ -52,100 +68,116 @@ type HostState struct {
 	UDPConnections  int
 }
 
-// HostStateInfo 包含主机信息和状态信息
-type HostStateInfo struct {
-	Host  Host
-	State HostState
-}
-
 var (
 	NetInTransfer, NetOutTransfer    uint64
 	lastPacketsRecv, lastPacketsSent uint64
 	NetUpdateTimeStamp               uint64
+	lastCPUTimes                     []cpu.TimesStat // 上次采样的各核心CPU时间
 )
 
-// GetHostStateInfo 获取主机信息和实时状态
-func GetHostStateInfo() (*HostStateInfo, error) {
-	var ret HostStateInfo
+// Collector 采集器，按不同间隔提供主机信息和状态
+type Collector interface {
+	Host(h *Host) error         // 主机静态信息
+	Fast(s *HostState)          // CPU、内存、网络等
+	Slow(s *HostState, h *Host) // 磁盘使用情况、连接数
+}
+
+// LocalCollector 使用 gopsutil 直接采集本机数据
+type LocalCollector struct{}
+
+func (LocalCollector) Host(h *Host) error         { return GetHostInfo(h) }
+func (LocalCollector) Fast(s *HostState)          { GetFastState(s) }
+func (LocalCollector) Slow(s *HostState, h *Host) { GetSlowState(s, h) }
 
+// NewCollector 根据配置创建采集器
+func NewCollector(config *Config) Collector {
+	if config.Collector == "node_exporter" {
+		return &NodeExporterCollector{URL: config.NodeExporterURL}
+	}
+	InitCPUTimes()
+	return LocalCollector{}
+}
+
+// GetHostInfo 获取主机的静态信息（磁盘总量除外，随磁盘使用情况一起采集）
+func GetHostInfo(ret *Host) error {
 	// 获取主机信息
 	hi, err := host.Info() // 获取主机信息
 	if err != nil {
-		return nil, fmt.Errorf("获取主机信息失败: %v", err)
+		return fmt.Errorf("获取主机信息失败: %v", err)
 	}
 
 	// 获取操作系统信息
-	ret.Host.Platform = hi.Platform
-	ret.Host.PlatformVersion = hi.PlatformVersion
-	ret.Host.Arch = hi.KernelArch
-	ret.Host.BootTime = hi.BootTime
-	ret.State.Processes = int(hi.Procs)
+	ret.Platform = hi.Platform
+	ret.PlatformVersion = hi.PlatformVersion
+	ret.KernelVersion = hi.KernelVersion
+	ret.Arch = hi.KernelArch
+	ret.Hostname = hi.Hostname
+	ret.Virtualization = hi.VirtualizationSystem
+	ret.VirtualizationRole = hi.VirtualizationRole
+	ret.BootTime = hi.BootTime
 
 	// 获取CPU信息
+	ret.CPU = nil
 	ci, err := cpu.Info()
-	if err != nil {
-		//return nil, fmt.Errorf("获取CPU信息失败: %v", err)
+	if err == nil {
+		for _, c := range ci {
+			model := strings.Join(strings.Fields(c.ModelName), " ")
+			if model != "" && !slices.Contains(ret.CPU, model) {
+				ret.CPU = append(ret.CPU, model)
+			}
+		}
 	}
-	ret.Host.CPU = append(ret.Host.CPU, strings.ReplaceAll(strings.TrimSpace(fmt.Sprintf(ci[0].ModelName)), "  ", " "))
+	ret.CoreCount, _ = cpu.Counts(false)
+	ret.ThreadCount, _ = cpu.Counts(true)
+
+	// 获取公网地址及时区
+	ret.IPv4, ret.IPv6 = GetPublicIP()
+	ret.Timezone = time.Now().Format("MST -07:00")
 
 	// 获取虚拟内存信息
-	vm, err := mem.VirtualMemory()
-	//if err != nil {
-	//	return nil, fmt.Errorf("获取虚拟内存信息失败: %v", err)
-	//}
-	ret.Host.MemTotal = vm.Total
+	if vm, err := mem.VirtualMemory(); err == nil {
+		ret.MemTotal = vm.Total
+	}
 
 	// 获取交换空间信息
-	swap, err := mem.SwapMemory()
-	//if err != nil {
-	//	return nil, fmt.Errorf("获取交换空间信息失败: %v", err)
-	//}
-	ret.Host.SwapTotal = swap.Total
+	if swap, err := mem.SwapMemory(); err == nil {
+		ret.SwapTotal = swap.Total
+	}
+	return nil
+}
 
-	// 获取主机状态信息
-	cp, err := cpu.Percent(0, false) // 获取CPU使用率
-	if err != nil || len(cp) == 0 {
-		//return nil, fmt.Errorf("获取CPU使用率失败: %v", err)
+// GetFastState 采集变化较快的状态信息：CPU、负载、内存、网络、进程数
+func GetFastState(ret *HostState) {
+	if ct, err := cpu.Times(true); err == nil { // 获取各核心CPU时间
+		calcCPUUsage(ret, lastCPUTimes, ct)
+		lastCPUTimes = ct
 	}
-	ret.State.CPU = Decimal(cp[0]) // 将CPU使用率赋值给ret.State.CPU
 
-	loadStat, err := load.Avg() // 获取系统负载平均值
-	if err != nil {
-		//return nil, fmt.Errorf("获取系统负载平均值失败: %v", err)
+	if loadStat, err := load.Avg(); err == nil { // 获取系统负载平均值
+		ret.Load1 = Decimal(loadStat.Load1)   // 1分钟平均负载
+		ret.Load5 = Decimal(loadStat.Load5)   // 5分钟平均负载
+		ret.Load15 = Decimal(loadStat.Load15) // 15分钟平均负载
 	}
-	ret.State.Load1 = Decimal(loadStat.Load1)   // 1分钟平均负载
-	ret.State.Load5 = Decimal(loadStat.Load5)   // 5分钟平均负载
-	ret.State.Load15 = Decimal(loadStat.Load15) // 15分钟平均负载
 
-	vm, err = mem.VirtualMemory() // 获取虚拟内存信息
-	if err != nil {
-		//return nil, fmt.Errorf("获取虚拟内存信息失败: %v", err)
+	if vm, err := mem.VirtualMemory(); err == nil { // 获取虚拟内存信息
+		ret.MemUsed = vm.Total - vm.Available // 计算已使用内存
 	}
-	ret.State.MemUsed = vm.Total - vm.Available // 计算已使用内存
 
-	swap, err = mem.SwapMemory() // 获取交换空间信息
-	if err != nil {
-		//return nil, fmt.Errorf("获取交换空间信息失败: %v", err)
+	if swap, err := mem.SwapMemory(); err == nil { // 获取交换空间信息
+		ret.SwapUsed = swap.Used // 已使用交换空间
+	}
+
+	if procs, err := process.Pids(); err == nil { // 获取进程数
+		ret.Processes = len(procs)
 	}
-	ret.State.SwapUsed = swap.Used // 已使用交换空间
 
 	// 获取网络流量信息
 	var maxNetIn, maxNetOut uint64
 	var PacketsRecv, PacketsSent uint64
-	var tcpConnections, udpConnections int
 	nc, err := net.IOCounters(true) // 获取网络IO计数器
 	if err == nil {
 		for _, v := range nc {
-			name := strings.ToLower(v.Name) // 转为小写方便比较
-			if strings.Contains(name, "docker") ||
-				strings.Contains(name, "zerotier") ||
-				strings.Contains(name, "zt") ||
-				strings.Contains(name, "lo") ||
-				strings.Contains(name, "br") ||
-				strings.Contains(name, "vm") ||
-				strings.Contains(name, "wg") ||
-				strings.Contains(name, "warp") ||
-				strings.Contains(name, "tun") {
+			if isIgnoredInterface(v.Name) {
 				continue // 忽略网卡
 			}
 
@@ -163,20 +195,20 @@ func GetHostStateInfo() (*HostStateInfo, error) {
 		diff := now - NetUpdateTimeStamp // 计算时间差
 		if diff > 0 {
 			// 计算接收包的速率（包/秒）
-			ret.State.PacketsRecvRate = float64(PacketsRecv-lastPacketsRecv) / float64(diff)
+			ret.PacketsRecvRate = float64(PacketsRecv-lastPacketsRecv) / float64(diff)
 			// 计算发送包的速率（包/秒）
-			ret.State.PacketsSentRate = float64(PacketsSent-lastPacketsSent) / float64(diff)
+			ret.PacketsSentRate = float64(PacketsSent-lastPacketsSent) / float64(diff)
 
 			// 计算网络接收速度（字节/秒）
-			ret.State.NetInSpeed = (maxNetIn - NetInTransfer) / diff
+			ret.NetInSpeed = (maxNetIn - NetInTransfer) / diff
 			// 计算网络发送速度（字节/秒）
-			ret.State.NetOutSpeed = (maxNetOut - NetOutTransfer) / diff
+			ret.NetOutSpeed = (maxNetOut - NetOutTransfer) / diff
 
 			// 更新接收到的字节数和包数
-			ret.State.NetInTransfer = maxNetIn
-			ret.State.NetOutTransfer = maxNetOut
-			ret.State.PacketsRecv = PacketsRecv // 更新接收的包数
-			ret.State.PacketsSent = PacketsSent // 更新发送的包数
+			ret.NetInTransfer = maxNetIn
+			ret.NetOutTransfer = maxNetOut
+			ret.PacketsRecv = PacketsRecv // 更新接收的包数
+			ret.PacketsSent = PacketsSent // 更新发送的包数
 		}
 
 		// 记录上次的包数和时间戳
@@ -186,9 +218,16 @@ func GetHostStateInfo() (*HostStateInfo, error) {
 		NetOutTransfer = maxNetOut
 		NetUpdateTimeStamp = now // 更新上次更新时间戳
 	}
+}
+
+// GetSlowState 采集开销较大、变化较慢的状态信息：磁盘使用情况、连接数
+func GetSlowState(ret *HostState, h *Host) {
+	var tcpConnections, udpConnections int
 
 	// 获取硬盘信息
-	disks, err := disk.Partitions(true) // 获取所有分区
+	ret.DiskUsed = 0
+	h.DiskTotal = 0
+	disks, _ := disk.Partitions(true) // 获取所有分区
 
 	// 正则表达式，过滤掉虚拟文件系统挂载点（如 Docker 等）
 	ignorePattern := regexp.MustCompile(`/var/lib/docker|overlay|tmpfs|none|^/dev/loop|^/sys|^/proc|^/run`)
@@ -200,13 +239,16 @@ func GetHostStateInfo() (*HostStateInfo, error) {
 		}
 
 		// 获取磁盘使用情况
-		usage, _ := disk.Usage(d.Mountpoint)
-		ret.Host.DiskTotal += usage.Total
-		ret.State.DiskUsed += usage.Used
+		usage, err := disk.Usage(d.Mountpoint)
+		if err != nil {
+			continue
+		}
+		h.DiskTotal += usage.Total
+		ret.DiskUsed += usage.Used
 	}
 
 	// 获取网络连接数
-	connections, err := net.Connections("all")
+	connections, _ := net.Connections("all")
 
 	for _, conn := range connections {
 		if conn.Laddr.String() == "0.0.0.0:0" || conn.Raddr.String() == "0.0.0.0:0" {
@@ -222,11 +264,73 @@ func GetHostStateInfo() (*HostStateInfo, error) {
 			udpConnections++
 		}
 	}
-	ret.State.TCPConections = tcpConnections
-	ret.State.UDPConnections = udpConnections
+	ret.TCPConections = tcpConnections
+	ret.UDPConnections = udpConnections
+}
+
+// isIgnoredInterface 判断是否为需要忽略的虚拟网卡
+func isIgnoredInterface(name string) bool {
+	name = strings.ToLower(name) // 转为小写方便比较
+	return strings.Contains(name, "docker") ||
+		strings.Contains(name, "zerotier") ||
+		strings.Contains(name, "zt") ||
+		strings.Contains(name, "lo") ||
+		strings.Contains(name, "br") ||
+		strings.Contains(name, "vm") ||
+		strings.Contains(name, "wg") ||
+		strings.Contains(name, "warp") ||
+		strings.Contains(name, "tun")
+}
+
+// InitCPUTimes 记录初始的CPU时间，使首次计算的使用率有意义
+func InitCPUTimes() {
+	if ct, err := cpu.Times(true); err == nil {
+		lastCPUTimes = ct
+	}
+}
+
+// cpuTotal 计算CPU总时间（Guest 已包含在 User 中，不重复累加）
+func cpuTotal(t cpu.TimesStat) float64 {
+	return t.User + t.System + t.Idle + t.Nice + t.Iowait + t.Irq + t.Softirq + t.Steal
+}
+
+// calcCPUUsage 根据两次采样的CPU时间差计算总使用率、各核心使用率及时间占比
+func calcCPUUsage(state *HostState, last, current []cpu.TimesStat) {
+	if len(last) != len(current) {
+		return // 核心数变化（如热插拔）时跳过本次计算
+	}
+
+	var sum cpu.TimesStat
+	state.CPUCores = make([]float64, 0, len(current))
+	for i := range current {
+		total := cpuTotal(current[i]) - cpuTotal(last[i])
+		idle := (current[i].Idle + current[i].Iowait) - (last[i].Idle + last[i].Iowait)
+		usage := 0.0
+		if total > 0 {
+			usage = (total - idle) / total * 100
+		}
+		state.CPUCores = append(state.CPUCores, Decimal(usage))
+
+		sum.User += current[i].User - last[i].User
+		sum.Nice += current[i].Nice - last[i].Nice
+		sum.System += current[i].System - last[i].System
+		sum.Idle += current[i].Idle - last[i].Idle
+		sum.Iowait += current[i].Iowait - last[i].Iowait
+		sum.Irq += current[i].Irq - last[i].Irq
+		sum.Softirq += current[i].Softirq - last[i].Softirq
+		sum.Steal += current[i].Steal - last[i].Steal
+	}
 
-	// 返回主机信息和状态信息的结构体
-	return &ret, nil
+	total := cpuTotal(sum)
+	if total <= 0 {
+		return
+	}
+	state.CPU = Decimal((total - sum.Idle - sum.Iowait) / total * 100)
+	state.CPUUser = Decimal((sum.User + sum.Nice) / total * 100)
+	state.CPUSystem = Decimal((sum.System + sum.Irq + sum.Softirq) / total * 100)
+	state.CPUIowait = Decimal(sum.Iowait / total * 100)
+	state.CPUSteal = Decimal(sum.Steal / total * 100)
+	state.CPUIdle = Decimal(sum.Idle / total * 100)
 }
 
 // Decimal 保留两位小数
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"github.com/shirou/gopsutil/v3/cpu"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NodeExporterCollector 从本机 node_exporter 的 /metrics 采集数据，并转换为 Host/HostState
+type NodeExporterCollector struct {
+	URL string
+
+	metrics   map[string][]Metric // 最近一次抓取的指标，按名称分组
+	cpuTimes  []cpu.TimesStat
+	netIn     uint64
+	netOut    uint64
+	pktIn     uint64
+	pktOut    uint64
+	timeStamp time.Time
+}
+
+// node_exporter 中需要忽略的文件系统类型
+var ignoreFSTypePattern = regexp.MustCompile(`^(tmpfs|devtmpfs|overlay|squashfs|proc|sysfs|cgroup2?|nsfs|ramfs|autofs|fuse\..*)$`)
+
+// scrape 抓取 node_exporter 的指标
+func (c *NodeExporterCollector) scrape() error {
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(c.URL)
+	if err != nil {
+		return fmt.Errorf("抓取 node_exporter 失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("抓取 node_exporter 失败: %s", resp.Status)
+	}
+
+	list, err := ParsePrometheus(resp.Body)
+	if err != nil {
+		return fmt.Errorf("解析 node_exporter 指标失败: %v", err)
+	}
+
+	c.metrics = make(map[string][]Metric)
+	for _, m := range list {
+		c.metrics[m.Name] = append(c.metrics[m.Name], m)
+	}
+	return nil
+}
+
+// value 返回指定名称的第一条指标值
+func (c *NodeExporterCollector) value(name string) float64 {
+	if list := c.metrics[name]; len(list) > 0 {
+		return list[0].Value
+	}
+	return 0
+}
+
+// Host 获取主机静态信息
+func (c *NodeExporterCollector) Host(h *Host) error {
+	if c.metrics == nil {
+		if err := c.scrape(); err != nil {
+			return err
+		}
+	}
+
+	if list := c.metrics["node_uname_info"]; len(list) > 0 {
+		h.KernelVersion = list[0].Labels["release"]
+		h.Arch = list[0].Labels["machine"]
+		h.Hostname = list[0].Labels["nodename"]
+	}
+	if list := c.metrics["node_os_info"]; len(list) > 0 {
+		h.Platform = list[0].Labels["id"]
+		h.PlatformVersion = list[0].Labels["version_id"]
+	}
+	h.BootTime = uint64(c.value("node_boot_time_seconds"))
+
+	// CPU 型号及核心数需要 node_exporter 开启 --collector.cpu.info
+	h.CPU = nil
+	cores := make(map[string]bool)
+	for _, m := range c.metrics["node_cpu_info"] {
+		model := strings.Join(strings.Fields(m.Labels["model_name"]), " ")
+		if model != "" && !slices.Contains(h.CPU, model) {
+			h.CPU = append(h.CPU, model)
+		}
+		cores[m.Labels["package"]+"/"+m.Labels["core"]] = true
+	}
+	h.ThreadCount = len(c.cpuSeconds())
+	h.CoreCount = len(cores)
+	if h.CoreCount == 0 {
+		h.CoreCount = h.ThreadCount
+	}
+
+	h.MemTotal = uint64(c.value("node_memory_MemTotal_bytes"))
+	h.SwapTotal = uint64(c.value("node_memory_SwapTotal_bytes"))
+
+	// node_exporter 不提供公网地址，与本机网卡检测方式一致
+	h.IPv4, h.IPv6 = GetPublicIP()
+	if list := c.metrics["node_time_zone_offset_seconds"]; len(list) > 0 {
+		offset := int(list[0].Value)
+		sign := "+"
+		if offset < 0 {
+			sign, offset = "-", -offset
+		}
+		h.Timezone = fmt.Sprintf("%s %s%02d:%02d", list[0].Labels["time_zone"], sign, offset/3600, offset%3600/60)
+	}
+	return nil
+}
+
+// cpuSeconds 将 node_cpu_seconds_total 转换为各核心的CPU时间
+func (c *NodeExporterCollector) cpuSeconds() []cpu.TimesStat {
+	byCPU := make(map[int]*cpu.TimesStat)
+	for _, m := range c.metrics["node_cpu_seconds_total"] {
+		index, err := strconv.Atoi(m.Labels["cpu"])
+		if err != nil {
+			continue
+		}
+		t, ok := byCPU[index]
+		if !ok {
+			t = &cpu.TimesStat{CPU: "cpu" + m.Labels["cpu"]}
+			byCPU[index] = t
+		}
+		switch m.Labels["mode"] {
+		case "user":
+			t.User = m.Value
+		case "nice":
+			t.Nice = m.Value
+		case "system":
+			t.System = m.Value
+		case "idle":
+			t.Idle = m.Value
+		case "iowait":
+			t.Iowait = m.Value
+		case "irq":
+			t.Irq = m.Value
+		case "softirq":
+			t.Softirq = m.Value
+		case "steal":
+			t.Steal = m.Value
+		}
+	}
+
+	indexes := make([]int, 0, len(byCPU))
+	for index := range byCPU {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	ret := make([]cpu.TimesStat, 0, len(indexes))
+	for _, index := range indexes {
+		ret = append(ret, *byCPU[index])
+	}
+	return ret
+}
+
+// Fast 抓取一次指标并计算 CPU、内存、网络等状态
+func (c *NodeExporterCollector) Fast(s *HostState) {
+	if err := c.scrape(); err != nil {
+		return
+	}
+
+	now := time.Now()
+	times := c.cpuSeconds()
+	if c.cpuTimes != nil {
+		calcCPUUsage(s, c.cpuTimes, times)
+	}
+	c.cpuTimes = times
+
+	s.Load1 = Decimal(c.value("node_load1"))
+	s.Load5 = Decimal(c.value("node_load5"))
+	s.Load15 = Decimal(c.value("node_load15"))
+	s.MemUsed = uint64(c.value("node_memory_MemTotal_bytes") - c.value("node_memory_MemAvailable_bytes"))
+	s.SwapUsed = uint64(c.value("node_memory_SwapTotal_bytes") - c.value("node_memory_SwapFree_bytes"))
+	s.Processes = int(c.value("node_processes_pids")) // 需要开启 --collector.processes
+
+	// 与本机采集一致，取流量最大的网卡
+	var netIn, netOut, pktIn, pktOut uint64
+	for _, m := range c.metrics["node_network_receive_bytes_total"] {
+		if !isIgnoredInterface(m.Labels["device"]) && uint64(m.Value) > netIn {
+			netIn = uint64(m.Value)
+			pktIn = uint64(c.deviceValue("node_network_receive_packets_total", m.Labels["device"]))
+		}
+	}
+	for _, m := range c.metrics["node_network_transmit_bytes_total"] {
+		if !isIgnoredInterface(m.Labels["device"]) && uint64(m.Value) > netOut {
+			netOut = uint64(m.Value)
+			pktOut = uint64(c.deviceValue("node_network_transmit_packets_total", m.Labels["device"]))
+		}
+	}
+
+	elapsed := now.Sub(c.timeStamp).Seconds()
+	if !c.timeStamp.IsZero() && elapsed > 0 {
+		if netIn >= c.netIn && netOut >= c.netOut {
+			s.NetInSpeed = uint64(float64(netIn-c.netIn) / elapsed)
+			s.NetOutSpeed = uint64(float64(netOut-c.netOut) / elapsed)
+		}
+		if pktIn >= c.pktIn && pktOut >= c.pktOut {
+			s.PacketsRecvRate = Decimal(float64(pktIn-c.pktIn) / elapsed)
+			s.PacketsSentRate = Decimal(float64(pktOut-c.pktOut) / elapsed)
+		}
+	}
+	s.NetInTransfer = netIn
+	s.NetOutTransfer = netOut
+	s.PacketsRecv = pktIn
+	s.PacketsSent = pktOut
+
+	c.netIn, c.netOut, c.pktIn, c.pktOut = netIn, netOut, pktIn, pktOut
+	c.timeStamp = now
+}
+
+// deviceValue 返回指定网卡的指标值
+func (c *NodeExporterCollector) deviceValue(name, device string) float64 {
+	for _, m := range c.metrics[name] {
+		if m.Labels["device"] == device {
+			return m.Value
+		}
+	}
+	return 0
+}
+
+// Slow 使用最近一次抓取的指标计算磁盘使用情况和连接数
+func (c *NodeExporterCollector) Slow(s *HostState, h *Host) {
+	if c.metrics == nil {
+		return
+	}
+
+	// 正则表达式，过滤掉虚拟文件系统挂载点（与本机采集一致）
+	ignorePattern := regexp.MustCompile(`/var/lib/docker|overlay|tmpfs|none|^/dev/loop|^/sys|^/proc|^/run`)
+
+	s.DiskUsed = 0
+	h.DiskTotal = 0
+	devices := make(map[string]bool) // 同一设备可能挂载多次，只统计一次
+	for _, m := range c.metrics["node_filesystem_size_bytes"] {
+		mountpoint, device := m.Labels["mountpoint"], m.Labels["device"]
+		if ignorePattern.MatchString(mountpoint) || ignoreFSTypePattern.MatchString(m.Labels["fstype"]) || devices[device] {
+			continue
+		}
+		devices[device] = true
+
+		var free float64
+		for _, f := range c.metrics["node_filesystem_free_bytes"] {
+			if f.Labels["mountpoint"] == mountpoint {
+				free = f.Value
+				break
+			}
+		}
+		h.DiskTotal += uint64(m.Value)
+		s.DiskUsed += uint64(m.Value - free)
+	}
+
+	s.TCPConections = int(c.value("node_netstat_Tcp_CurrEstab"))
+	s.UDPConnections = int(c.value("node_sockstat_UDP_inuse") + c.value("node_sockstat_UDP6_inuse"))
+}
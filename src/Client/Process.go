@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"github.com/shirou/gopsutil/v3/process"
+	"log"
+	"sort"
+	"time"
+	"unicode/utf8"
+)
+
+// 命令行最大长度，超出部分截断
+const maxCmdlineLength = 128
+
+// Process 结构体，存储单个进程信息
+type Process struct {
+	PID     int32
+	Name    string
+	User    string
+	Cmdline string
+	CPU     float64 // 采样周期内的CPU使用率
+	RSS     uint64  // 常驻内存
+}
+
+// TopProcesses 结构体，存储CPU和内存占用最高的进程
+type TopProcesses struct {
+	CPU    []Process
+	Memory []Process
+}
+
+var (
+	lastProcTimes     = make(map[int32]float64) // 上次采样时各进程的CPU时间
+	lastProcTimeStamp time.Time                 // 上次采样时间
+)
+
+// GetTopProcesses 获取CPU和内存占用前 n 的进程
+func GetTopProcesses(n int) (*TopProcesses, error) {
+	procs, err := process.Processes()
+	if err != nil {
+		return nil, fmt.Errorf("获取进程列表失败: %v", err)
+	}
+
+	now := time.Now()
+	elapsed := now.Sub(lastProcTimeStamp).Seconds()
+	currentTimes := make(map[int32]float64, len(procs))
+
+	var list []Process
+	for _, p := range procs {
+		times, err := p.Times()
+		if err != nil {
+			continue // 进程已退出或无权限
+		}
+		total := times.User + times.System
+		currentTimes[p.Pid] = total
+
+		info := Process{PID: p.Pid}
+
+		// 根据两次采样的CPU时间差计算使用率，首次出现的进程记为0
+		if last, ok := lastProcTimes[p.Pid]; ok && elapsed > 0 && total >= last {
+			info.CPU = Decimal((total - last) / elapsed * 100)
+		}
+
+		if mi, err := p.MemoryInfo(); err == nil {
+			info.RSS = mi.RSS
+		}
+		info.Name, _ = p.Name()
+		info.User, _ = p.Username()
+		cmdline, _ := p.Cmdline()
+		info.Cmdline = truncateString(cmdline, maxCmdlineLength)
+
+		list = append(list, info)
+	}
+
+	lastProcTimes = currentTimes
+	lastProcTimeStamp = now
+
+	var ret TopProcesses
+
+	sort.Slice(list, func(i, j int) bool { return list[i].CPU > list[j].CPU })
+	ret.CPU = append(ret.CPU, list[:min(n, len(list))]...)
+
+	sort.Slice(list, func(i, j int) bool { return list[i].RSS > list[j].RSS })
+	ret.Memory = append(ret.Memory, list[:min(n, len(list))]...)
+
+	return &ret, nil
+}
+
+// truncateString 按字符截断字符串，避免截断多字节字符
+func truncateString(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:max]) + "..."
+}
+
+// ProcessReport 按配置的间隔上报进程信息
+func ProcessReport(cfg ProcessConfig) {
+	if cfg.TopN <= 0 {
+		return
+	}
+
+	// 预先采样一次，保证首次上报的CPU使用率有意义
+	if _, err := GetTopProcesses(cfg.TopN); err != nil {
+		log.Printf("获取进程信息失败: %v", err)
+	}
+
+	ticker := time.NewTicker(time.Duration(cfg.Interval) * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// 检查登录状态
+		conn := wsConn
+		if !isLogin || conn == nil {
+			continue
+		}
+
+		top, err := GetTopProcesses(cfg.TopN)
+		if err != nil {
+			continue
+		}
+
+		processMessage := struct {
+			Action string        `json:"action"`
+			Data   *TopProcesses `json:"data"`
+		}{
+			Action: "process",
+			Data:   top,
+		}
+
+		if err := sendMessage(conn, processMessage); err != nil {
+			isLogin = false
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Metric Prometheus 文本格式中的一条数据
+type Metric struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+}
+
+// Key 返回指标名称和按名称排序后的标签，如 http_requests{code="200",method="get"}
+func (m Metric) Key() string {
+	if len(m.Labels) == 0 {
+		return m.Name
+	}
+
+	names := make([]string, 0, len(m.Labels))
+	for name := range m.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, m.Labels[name]))
+	}
+	return m.Name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// ParsePrometheus 解析 Prometheus 文本格式（忽略注释、时间戳和非数值）
+func ParsePrometheus(r io.Reader) ([]Metric, error) {
+	var ret []Metric
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		m, err := parsePrometheusLine(line)
+		if err != nil {
+			return nil, err
+		}
+		if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+			continue
+		}
+		ret = append(ret, m)
+	}
+	return ret, scanner.Err()
+}
+
+// parsePrometheusLine 解析单行数据：name{label="value",...} value [timestamp]
+func parsePrometheusLine(line string) (Metric, error) {
+	m := Metric{Labels: map[string]string{}}
+
+	end := strings.IndexAny(line, "{ \t")
+	if end < 0 {
+		return m, fmt.Errorf("格式错误: %s", line)
+	}
+	m.Name = line[:end]
+	rest := line[end:]
+
+	if strings.HasPrefix(rest, "{") {
+		var err error
+		rest, err = parsePrometheusLabels(rest[1:], m.Labels)
+		if err != nil {
+			return m, fmt.Errorf("%v: %s", err, line)
+		}
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return m, fmt.Errorf("缺少数值: %s", line)
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return m, fmt.Errorf("数值错误: %s", line)
+	}
+	m.Value = value
+	return m, nil
+}
+
+// parsePrometheusLabels 解析标签直到 }，返回剩余部分
+func parsePrometheusLabels(s string, labels map[string]string) (string, error) {
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if strings.HasPrefix(s, "}") {
+			return s[1:], nil
+		}
+
+		eq := strings.Index(s, "=")
+		if eq < 0 {
+			return "", fmt.Errorf("标签格式错误")
+		}
+		name := strings.TrimSpace(s[:eq])
+		s = strings.TrimLeft(s[eq+1:], " \t")
+		if !strings.HasPrefix(s, `"`) {
+			return "", fmt.Errorf("标签值缺少引号")
+		}
+
+		// 查找未转义的结束引号
+		var value strings.Builder
+		i := 1
+		for ; i < len(s); i++ {
+			c := s[i]
+			if c == '\\' && i+1 < len(s) {
+				i++
+				switch s[i] {
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					value.WriteByte(s[i])
+				}
+				continue
+			}
+			if c == '"' {
+				break
+			}
+			value.WriteByte(c)
+		}
+		if i >= len(s) {
+			return "", fmt.Errorf("标签值缺少结束引号")
+		}
+		labels[name] = value.String()
+		s = s[i+1:]
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// LoadTLSConfig 根据配置生成连接服务端使用的 TLS 配置，未配置时使用系统默认
+func LoadTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	if cfg.CA == "" && cfg.Cert == "" && cfg.Key == "" && !cfg.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	// 使用内部 CA 签发的服务端证书
+	if cfg.CA != "" {
+		data, err := os.ReadFile(cfg.CA)
+		if err != nil {
+			return nil, fmt.Errorf("读取 CA 失败: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("解析 CA 失败: %s", cfg.CA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	// 客户端证书，CN 或 DNS 名称需与服务端中的节点名称一致
+	if cfg.Cert != "" || cfg.Key != "" {
+		if cfg.Cert == "" || cfg.Key == "" {
+			return nil, fmt.Errorf("tls.cert 和 tls.key 需要同时配置")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+		if err != nil {
+			return nil, fmt.Errorf("加载客户端证书失败: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -3,6 +3,10 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/gorilla/websocket"
@@ -10,12 +14,14 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"sync"
 	"time"
 )
 
 // 登录状态
 var isLogin = false
 var wsConn *websocket.Conn
+var wsMutex sync.Mutex // 写锁，WebSocket 不支持并发写入
 
 // LoginMessage 登录消息结构
 type LoginMessage struct {
@@ -24,12 +30,27 @@ type LoginMessage struct {
 	Version float64 `json:"version"` // 客户端版本
 }
 
+// AuthMessage 挑战应答登录消息结构，使用由 Token 派生的密钥计算 MAC，不发送 Token
+type AuthMessage struct {
+	Action  string  `json:"action"`
+	CNonce  string  `json:"cnonce"` // 客户端随机数，用于验证服务端
+	MAC     string  `json:"mac"`
+	Version float64 `json:"version"`
+}
+
+// CertMessage 只使用客户端证书登录的消息结构
+type CertMessage struct {
+	Action  string  `json:"action"`
+	Version float64 `json:"version"`
+}
+
 // ResponseMessage 响应消息结构
 type ResponseMessage struct {
 	Status  int             `json:"status"`
 	Message string          `json:"message"`
 	Data    json.RawMessage `json:"data"`
 	Version float64         `json:"version"`
+	Nonce   string          `json:"nonce"` // 欢迎消息中的服务端随机数
 }
 
 var reportData struct {
@@ -37,11 +58,26 @@ var reportData struct {
 	State HostState `json:"State"` // 使用指针类型
 }
 
+// authMAC 计算 HMAC-SHA256 并以十六进制返回，与服务端的计算方式一致
+func authMAC(key, message string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(message))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
 // ConnectToServer 连接到 WebSocket 服务端
-func ConnectToServer(url string, token string) error {
+func ConnectToServer(config *Config) error {
 	attempt := 0 // 重连次数
 	ua := fmt.Sprintf("LightMonitorClient/%s", fmt.Sprintf("%.1f", version))
 
+	tlsConfig, err := LoadTLSConfig(config.TLS)
+	if err != nil {
+		log.Printf("TLS 配置错误: %v\n", err)
+		return err
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = tlsConfig
+
 	for {
 		attempt++
 
@@ -71,7 +107,7 @@ func ConnectToServer(url string, token string) error {
 		header.Set("User-Agent", ua)
 
 		// 尝试建立 WebSocket 连接
-		conn, _, err := websocket.DefaultDialer.Dial(url, header)
+		conn, _, err := dialer.Dial(config.URL, header)
 		if err != nil {
 			continue
 		}
@@ -82,7 +118,9 @@ func ConnectToServer(url string, token string) error {
 		isLogin = false
 
 		// 开始处理 WebSocket 消息
-		if err, code := handleConnection(conn, token); err != nil {
+		err, code := handleConnection(conn, config)
+		isLogin = false
+		if err != nil {
 			if code == 2 {
 				os.Exit(1)
 			}
@@ -93,46 +131,103 @@ func ConnectToServer(url string, token string) error {
 }
 
 // handleConnection 处理 WebSocket 消息
-func handleConnection(conn *websocket.Conn, token string) (error, int) {
+func handleConnection(conn *websocket.Conn, config *Config) (error, int) {
 	defer conn.Close()
 
 	code := -1
 
 	// 接收欢迎消息
+	var nonce string
 	if err := receiveMessage(conn, func(response ResponseMessage) error {
 		if response.Status == 0 {
 			log.Printf("%s 服务正常 v%s\n", response.Message, fmt.Sprintf("%.1f", response.Version))
 		}
+		nonce = response.Nonce
 		return nil
 	}); err != nil {
 		return err, -1
 	}
 
-	// 发送登录信息
-	loginMsg := LoginMessage{
-		Action:  "login",
-		Token:   token,
-		Version: version,
+	// 使用注册码注册，获得 Token 后在本连接继续登录
+	if config.EnrollCode != "" {
+		if nonce == "" {
+			log.Printf("服务端不支持注册码注册\n")
+			return fmt.Errorf("服务端不支持注册码注册"), 2
+		}
+		if err := enrollNode(conn, config); err != nil {
+			log.Printf("%v\n", err)
+			return err, 2
+		}
 	}
-	if err := sendMessage(conn, loginMsg); err != nil {
-		return err, -1
+
+	// 发送登录信息，服务端支持时使用挑战应答登录，未配置 Token 时只使用客户端证书登录
+	var expectedProof string
+	if config.Token == "" && config.TLS.Cert != "" {
+		if err := sendMessage(conn, CertMessage{Action: "cert", Version: version}); err != nil {
+			return err, -1
+		}
+	} else if nonce != "" {
+		raw := make([]byte, 16)
+		if _, err := rand.Read(raw); err != nil {
+			return err, -1
+		}
+		cnonce := hex.EncodeToString(raw)
+		authKey := authMAC(config.Token, "LightMonitor-auth")
+		authMsg := AuthMessage{
+			Action:  "auth",
+			CNonce:  cnonce,
+			MAC:     authMAC(authKey, nonce+":"+cnonce),
+			Version: version,
+		}
+		if err := sendMessage(conn, authMsg); err != nil {
+			return err, -1
+		}
+		expectedProof = authMAC(authKey, cnonce+":"+nonce)
+	} else if config.LegacyLogin {
+		loginMsg := LoginMessage{
+			Action:  "login",
+			Token:   config.Token,
+			Version: version,
+		}
+		if err := sendMessage(conn, loginMsg); err != nil {
+			return err, -1
+		}
+	} else {
+		log.Printf("服务端不支持挑战应答登录，如需连接旧版服务端请开启 legacy_login\n")
+		return fmt.Errorf("服务端不支持挑战应答登录"), 2
 	}
 
 	// 接收登录响应
-	if err := receiveMessage(conn, func(response ResponseMessage) error {
+	handleLogin := func(response ResponseMessage) error {
+		// 服务端没有该节点的认证信息（升级前添加的节点），不自动改用旧版登录：
+		// 该响应可能由中间人伪造，用于诱使客户端发送 Token
+		if response.Status == 5 {
+			code = 2
+			return fmt.Errorf("%s", response.Message)
+		}
+
 		// 解析 data
 		var data struct {
 			Name   string `json:"name"`
 			Region string `json:"region"`
 			City   string `json:"city"`
+			Proof  string `json:"proof"`
 		}
 		if err := json.Unmarshal(response.Data, &data); err != nil {
 			return fmt.Errorf("登录超时")
 		}
+
+		// 验证服务端同样持有该节点的密钥
+		if expectedProof != "" && !hmac.Equal([]byte(data.Proof), []byte(expectedProof)) {
+			return fmt.Errorf("服务端认证失败")
+		}
+
 		log.Printf("登录成功！名称: %s, 地区: %s, 城市: %s\n", data.Name, data.Region, data.City)
 		isLogin = true
 		return nil
-	}); err != nil {
+	}
+	if err := receiveMessage(conn, handleLogin); err != nil {
+		log.Printf("%v\n", err)
 		return err, code
 	}
 
@@ -140,6 +235,10 @@ func handleConnection(conn *websocket.Conn, token string) (error, int) {
 	//log.Println("等待服务端消息...")
 	for {
 		if err := receiveMessage(conn, func(response ResponseMessage) error {
+			// 远程命令，可能耗时较长，不阻塞接收
+			if response.Status == 6 {
+				go HandleCommand(conn, config, response.Data)
+			}
 			return nil
 		}); err != nil {
 			//log.Printf("连接断开\n")
@@ -150,6 +249,62 @@ func handleConnection(conn *websocket.Conn, token string) (error, int) {
 	return nil, -1
 }
 
+// EnrollMessage 注册码注册消息结构
+type EnrollMessage struct {
+	Action   string  `json:"action"`
+	Code     string  `json:"code"`
+	Hostname string  `json:"hostname"`       // 作为节点名称
+	Host     *Host   `json:"host,omitempty"` // 检测到的主机信息，作为节点的初始信息
+	Version  float64 `json:"version"`
+}
+
+// enrollNode 使用注册码注册节点，并将获得的 Token 写入配置文件
+func enrollNode(conn *websocket.Conn, config *Config) error {
+	hostname, _ := os.Hostname()
+	enrollMsg := EnrollMessage{
+		Action:   "enroll",
+		Code:     config.EnrollCode,
+		Hostname: hostname,
+		Version:  version,
+	}
+	var host Host
+	if err := GetHostInfo(&host); err != nil {
+		log.Printf("%v，注册时只发送主机名\n", err)
+	} else {
+		enrollMsg.Host = &host
+	}
+	if err := sendMessage(conn, enrollMsg); err != nil {
+		return err
+	}
+
+	var data struct {
+		Name  string `json:"name"`
+		Token string `json:"token"`
+	}
+	if err := receiveMessage(conn, func(response ResponseMessage) error {
+		if response.Status != 7 {
+			return fmt.Errorf("注册失败: %s", response.Message)
+		}
+		return json.Unmarshal(response.Data, &data)
+	}); err != nil {
+		return err
+	}
+	if data.Token == "" {
+		return fmt.Errorf("注册失败: 服务端未返回 Token")
+	}
+
+	config.Token = data.Token
+	config.EnrollCode = ""
+	log.Printf("注册成功！名称: %s\n", data.Name)
+	if err := SaveToken(config, data.Token); err != nil {
+		// Token 仅返回一次，保存失败时输出以便手动配置
+		log.Printf("保存 Token 到 %s 失败: %v，请手动配置 token: %s\n", config.path, err, data.Token)
+		return nil
+	}
+	log.Printf("Token 已保存到 %s\n", config.path)
+	return nil
+}
+
 // receiveMessage 接收并处理消息
 func receiveMessage(conn *websocket.Conn, handler func(response ResponseMessage) error) error {
 	_, message, err := conn.ReadMessage()
@@ -186,6 +341,8 @@ func sendMessage(conn *websocket.Conn, data interface{}) error {
 	if err != nil {
 		//return fmt.Errorf("序列化消息失败: %v", err)
 	}
+	wsMutex.Lock()
+	defer wsMutex.Unlock()
 	return conn.WriteMessage(websocket.TextMessage, message)
 }
 
@@ -204,53 +361,156 @@ func parseMessage(data []byte, v interface{}) error {
 	return json.Unmarshal(data, v)
 }
 
-// NodeReport 定时发送报告
-func NodeReport() {
-	ticker := time.NewTicker(1 * time.Second) // 每秒发送一次
+// Sample 单次采样的报告数据
+type Sample struct {
+	TimeStamp  int64
+	Host       *Host `json:",omitempty"` // 仅在 Host 发生变化时发送
+	State      HostState
+	Checks     []CheckResult                     `json:",omitempty"`
+	Containers []Container                       `json:",omitempty"`
+	Custom     map[string]map[string]interface{} `json:",omitempty"`
+}
+
+// NodeReport 按配置的间隔采集数据并发送报告
+func NodeReport(config *Config) {
+	collector := NewCollector(config)
+
+	var currentHost Host    // 当前主机信息
+	var slowState HostState // 最近一次采集的慢速指标
+	var lastHostTime, lastSlowTime time.Time
+	var batch []Sample                               // 等待批量发送的采样
+	buffer := NewSampleBuffer(max(config.Buffer, 0)) // 离线期间的采样
+	online := false
+
+	ticker := time.NewTicker(time.Duration(config.Interval.Fast) * time.Second)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		// 检查登录状态
-		if !isLogin {
-			time.Sleep(time.Second) // 等待 1 秒再检查
+	for {
+		select {
+		case interval := <-intervalChanges:
+			// 远程命令修改采集间隔
+			if interval.Fast > 0 {
+				config.Interval.Fast = interval.Fast
+				ticker.Reset(time.Duration(interval.Fast) * time.Second)
+			}
+			if interval.Slow > 0 {
+				config.Interval.Slow = interval.Slow
+			}
+			if interval.Host > 0 {
+				config.Interval.Host = interval.Host
+			}
 			continue
+		case <-ticker.C:
+		}
+
+		// 远程命令要求重新发送主机信息
+		if resendHost.Swap(false) {
+			lastHost = Host{}
+			lastHostTime = time.Time{}
 		}
 
-		// 获取当前 WebSocket 连接
+		// 检查登录状态并获取当前 WebSocket 连接
 		conn := wsConn
-		if conn == nil {
-			time.Sleep(time.Second) // 等待 1 秒再检查
+		loggedIn := isLogin && conn != nil
+		if !loggedIn && config.Buffer <= 0 {
+			online = false
 			continue
 		}
 
-		// 获取最新的 Host 和 State 信息
-		hostStateInfo, err := GetHostStateInfo()
-		if err != nil {
-			//log.Printf("获取主机状态信息失败: %v", err)
-			continue
+		// 重新登录后重新发送 Host，离线期间的 Host 只会随补发数据进入历史记录
+		if loggedIn && !online {
+			lastHost = Host{}
 		}
+		online = loggedIn
 
-		// 当前主机信息
-		currentHost := hostStateInfo.Host
+		now := time.Now()
 
-		// 当前主机状态信息
-		state := hostStateInfo.State
+		// 按各自的间隔更新主机信息和慢速指标
+		if now.Sub(lastHostTime) >= time.Duration(config.Interval.Host)*time.Second {
+			diskTotal := currentHost.DiskTotal
+			if err := collector.Host(&currentHost); err != nil {
+				//log.Printf("获取主机信息失败: %v", err)
+				continue
+			}
+			currentHost.DiskTotal = diskTotal
+			lastHostTime = now
+		}
+		if now.Sub(lastSlowTime) >= time.Duration(config.Interval.Slow)*time.Second {
+			collector.Slow(&slowState, &currentHost)
+			lastSlowTime = now
+		}
+
+		// 采集快速指标，并合并最近一次的慢速指标
+		var state HostState
+		collector.Fast(&state)
+		state.DiskUsed = slowState.DiskUsed
+		state.TCPConections = slowState.TCPConections
+		state.UDPConnections = slowState.UDPConnections
 
-		// 判断 Host 是否发生变化
-		shouldSendHost := false
+		sample := Sample{
+			TimeStamp: now.Unix(),
+			State:     state, // 始终包括 State
+		}
+
+		// 如果 Host 发生变化，添加 Host 字段
 		if !compareHosts(lastHost, currentHost) {
-			shouldSendHost = true
+			host := currentHost
+			sample.Host = &host
 			lastHost = currentHost // 更新 lastHost
 		}
 
-		// 构建报告数据
-		reportData := map[string]interface{}{
-			"State": state, // 始终包括 State
+		// 离线时将采样存入缓冲区，登录后补发
+		if !loggedIn {
+			for _, s := range batch {
+				buffer.Push(s)
+			}
+			batch = nil
+			buffer.Push(sample)
+			continue
 		}
 
-		// 如果 Host 发生变化，添加 Host 字段
-		if shouldSendHost {
-			reportData["Host"] = currentHost
+		if buffer.Len() > 0 {
+			if err := sendBackfill(conn, buffer); err != nil {
+				isLogin = false
+				buffer.Push(sample)
+				continue
+			}
+		}
+
+		batch = append(batch, sample)
+		if len(batch) < config.Batch {
+			continue
+		}
+
+		// 检查结果、容器信息和自定义指标只随最后一个采样发送
+		last := &batch[len(batch)-1]
+
+		// 配置了服务检查时，添加 Checks 字段
+		if len(config.Checks) > 0 {
+			last.Checks = GetCheckResults(config.Checks)
+		}
+
+		// 配置了自定义采集器时，添加 Custom 字段
+		if len(config.Custom) > 0 {
+			last.Custom = GetCustomResults()
+		}
+
+		// 开启容器监控时，添加 Containers 字段
+		if config.Container.Enable {
+			containers, err := GetContainers(config.Container)
+			if err == nil {
+				last.Containers = containers
+			}
+		}
+
+		// 不批量发送时保持单条报告的格式
+		samples := batch
+		batch = nil
+		var reportData interface{} = samples[0]
+		if config.Batch > 1 {
+			reportData = map[string]interface{}{
+				"Batch": samples,
+			}
 		}
 
 		// 序列化为 JSON
@@ -262,9 +522,40 @@ func NodeReport() {
 			Data:   reportData,
 		}
 
-		// 发送报告
+		// 发送报告，失败时将采样存入缓冲区
 		if err := sendMessage(conn, reportMessage); err != nil {
 			isLogin = false
+			for _, s := range samples {
+				buffer.Push(s)
+			}
 		}
 	}
 }
+
+// 每条补发消息包含的最大采样数
+const backfillChunkSize = 300
+
+// sendBackfill 按时间顺序补发缓冲区中的采样
+func sendBackfill(conn *websocket.Conn, buffer *SampleBuffer) error {
+	total := buffer.Len()
+	for buffer.Len() > 0 {
+		samples := buffer.Peek(backfillChunkSize)
+		backfillMessage := struct {
+			Action string      `json:"action"`
+			Data   interface{} `json:"data"`
+		}{
+			Action: "backfill",
+			Data: map[string]interface{}{
+				"Batch": samples,
+			},
+		}
+
+		if err := sendMessage(conn, backfillMessage); err != nil {
+			return err
+		}
+		buffer.Drop(len(samples))
+	}
+
+	log.Printf("已补发离线期间的 %d 条数据\n", total)
+	return nil
+}
@@ -18,16 +18,24 @@ func main() {
 	if err != nil {
 		log.Printf("    -c      指定配置文件路径\n\n")
 		log.Printf("    -url    指定API URL路径|ws(s)://api.example.com/Monitor/Node\n")
-		log.Printf("    -token  指定节点Token\n\n")
-		log.Printf("    当url和token同时存在时，忽略配置文件")
+		log.Printf("    -token  指定节点Token\n")
+		log.Printf("    -enroll 使用注册码注册节点，Token 将写入配置文件\n")
+		log.Printf("    -legacy_login  允许向旧版服务端直接发送Token登录\n")
+		log.Printf("    -tls_ca        指定校验服务端证书的CA文件\n")
+		log.Printf("    -tls_cert      指定客户端证书文件\n")
+		log.Printf("    -tls_key       指定客户端证书私钥文件\n\n")
+		log.Printf("    当url和token（或enroll、tls_cert）同时存在时，忽略配置文件")
 		return
 	}
 
-	go NodeReport()
+	StartChecks(config.Checks)
+	StartCustom(config.Custom)
+	go NodeReport(config)
+	go ProcessReport(config.Process)
 
 	// 尝试连接 WebSocket 并登录
 	log.Printf("正在连接到 %s\n", config.URL)
-	if err := ConnectToServer(config.URL, config.Token); err != nil {
+	if err := ConnectToServer(config); err != nil {
 		os.Exit(1)
 	}
 
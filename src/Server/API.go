@@ -0,0 +1,552 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// REST 管理接口，路径为 config.APIURI 下的：
+//   GET    /nodes              节点列表，可使用 ?selector= 按标签及分组筛选
+//   POST   /nodes              添加节点
+//   GET    /nodes/{id}         节点信息
+//   PATCH  /nodes/{id}         修改节点
+//   DELETE /nodes/{id}         删除节点
+//   GET    /nodes/{id}/history 节点历史数据
+//   GET    /openapi.json       接口的 OpenAPI 文档，不需要认证
+// 使用 Authorization: Bearer <会话或 token> 认证，错误以 APIError 的 JSON 返回
+// 修改接口时需要同步更新 openapi.json 及 lmclient
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+// APIError 接口返回的错误
+type APIError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"Code"`            // 错误类型，如 invalid、not_found、conflict
+	Message string `json:"Message"`         // 错误说明
+	Field   string `json:"Field,omitempty"` // 校验失败的字段
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+func invalidField(field, message string) *APIError {
+	return &APIError{Status: http.StatusBadRequest, Code: "invalid", Message: message, Field: field}
+}
+
+var errNodeNotFound = &APIError{Status: http.StatusNotFound, Code: "not_found", Message: "未找到节点"}
+
+// NodeInfo 节点的基本信息，不包含 Token
+type NodeInfo struct {
+	ID         int
+	Name       string
+	Region     string
+	City       string
+	IP         string
+	AllowedIPs []string
+	Labels     map[string]string // 自定义标签
+	Groups     []string          // 所属分组
+	TimeStamp  int64             // 最近一次上报的时间
+}
+
+// 与 scanNodeInfo 对应的列
+const nodeInfoColumns = "ID, Name, Region, City, IP, AllowedIPs, Labels, NodeGroups, Timestamp"
+
+// scanNodeInfo 读取 nodeInfoColumns 查询的一行
+func scanNodeInfo(row interface{ Scan(...interface{}) error }) (NodeInfo, error) {
+	var node NodeInfo
+	var region, city, ip, allowedIPs, labels, groups *string
+	var timestamp *int64
+	if err := row.Scan(&node.ID, &node.Name, &region, &city, &ip, &allowedIPs, &labels, &groups, &timestamp); err != nil {
+		return node, err
+	}
+
+	node.Region, node.City, node.IP = stringValue(region), stringValue(city), stringValue(ip)
+	node.AllowedIPs = []string{}
+	if stringValue(allowedIPs) != "" {
+		json.Unmarshal([]byte(*allowedIPs), &node.AllowedIPs)
+	}
+	node.Labels, node.Groups = decodeLabels(labels), decodeGroups(groups)
+	if timestamp != nil {
+		node.TimeStamp = *timestamp
+	}
+	return node, nil
+}
+
+// NodeCreateRequest 添加节点的请求
+type NodeCreateRequest struct {
+	Name       string
+	Token      string
+	Region     string
+	City       string
+	AllowedIPs []string
+	Labels     map[string]string
+	Groups     []string
+}
+
+// NodeUpdateRequest 修改节点的请求，为 null 的字段不修改，AllowedIPs 为空数组时清除限制
+// Labels 和 Groups 整体替换
+type NodeUpdateRequest struct {
+	Name       *string
+	Region     *string
+	City       *string
+	AllowedIPs *[]string
+	Labels     *map[string]string
+	Groups     *[]string
+}
+
+// Validate 校验添加节点的请求
+func (req *NodeCreateRequest) Validate() error {
+	if err := validateText("Name", req.Name, 64, true); err != nil {
+		return err
+	}
+	if err := validateText("Token", req.Token, 256, true); err != nil {
+		return err
+	}
+	if err := validateText("Region", req.Region, 64, false); err != nil {
+		return err
+	}
+	if err := validateText("City", req.City, 64, false); err != nil {
+		return err
+	}
+	return ValidateLabels(req.Labels)
+}
+
+// Validate 校验修改节点的请求
+func (req *NodeUpdateRequest) Validate() error {
+	if req.Name == nil && req.Region == nil && req.City == nil && req.AllowedIPs == nil && req.Labels == nil && req.Groups == nil {
+		return invalidField("", "没有需要更新的字段")
+	}
+	if req.Name != nil {
+		if err := validateText("Name", *req.Name, 64, true); err != nil {
+			return err
+		}
+	}
+	if req.Region != nil {
+		if err := validateText("Region", *req.Region, 64, false); err != nil {
+			return err
+		}
+	}
+	if req.City != nil {
+		if err := validateText("City", *req.City, 64, false); err != nil {
+			return err
+		}
+	}
+	if req.Labels != nil {
+		return ValidateLabels(*req.Labels)
+	}
+	return nil
+}
+
+// validateText 校验字符串字段的长度，required 时不能为空
+func validateText(field, value string, maxLen int, required bool) error {
+	if required && strings.TrimSpace(value) == "" {
+		return invalidField(field, fmt.Sprintf("%s 不能为空", field))
+	}
+	if utf8.RuneCountInString(value) > maxLen {
+		return invalidField(field, fmt.Sprintf("%s 不能超过 %d 个字符", field, maxLen))
+	}
+	return nil
+}
+
+// allowedIPsValue 校验允许的来源地址并转换为保存到数据库的值
+func allowedIPsValue(allowed []string) (string, error) {
+	value, err := ParseAllowedIPs(allowed)
+	if err != nil {
+		return "", invalidField("AllowedIPs", err.Error())
+	}
+	return value, nil
+}
+
+// nodeNameExists 判断是否有其他节点使用该名称
+func nodeNameExists(name string, excludeID int) (bool, error) {
+	var count int
+	dbMutex.RLock()
+	err := db.QueryRow("SELECT COUNT(*) FROM Node WHERE Name = ? AND ID != ?", name, excludeID).Scan(&count)
+	dbMutex.RUnlock()
+	return count > 0, err
+}
+
+// GetNode 获取节点信息，不存在时返回 errNodeNotFound
+func GetNode(id int) (NodeInfo, error) {
+	dbMutex.RLock()
+	node, err := scanNodeInfo(db.QueryRow("SELECT "+nodeInfoColumns+" FROM Node WHERE ID = ?", id))
+	dbMutex.RUnlock()
+	if errors.Is(err, sql.ErrNoRows) {
+		return node, errNodeNotFound
+	}
+	if err != nil {
+		return node, fmt.Errorf("读取节点失败: %w", err)
+	}
+	return node, nil
+}
+
+// CreateNode 校验并添加节点
+func CreateNode(req NodeCreateRequest) (NodeInfo, error) {
+	if err := req.Validate(); err != nil {
+		return NodeInfo{}, err
+	}
+	allowedIPs, err := allowedIPsValue(req.AllowedIPs)
+	if err != nil {
+		return NodeInfo{}, err
+	}
+	groups, err := NormalizeGroups(req.Groups)
+	if err != nil {
+		return NodeInfo{}, err
+	}
+
+	exists, err := nodeNameExists(req.Name, 0)
+	if err != nil {
+		return NodeInfo{}, fmt.Errorf("检查节点失败: %w", err)
+	}
+	if exists {
+		return NodeInfo{}, &APIError{Status: http.StatusConflict, Code: "conflict", Message: "节点已存在，请不要使用相同的节点名称", Field: "Name"}
+	}
+	existID, _, err := FindNodeByToken(req.Token)
+	if err != nil {
+		return NodeInfo{}, fmt.Errorf("检查 Token 失败: %w", err)
+	}
+	if existID > 0 {
+		return NodeInfo{}, &APIError{Status: http.StatusConflict, Code: "conflict", Message: "Token已存在，请不要使用相同的Token", Field: "Token"}
+	}
+
+	extra := map[string]interface{}{
+		"AllowedIPs": allowedIPs,
+		"Labels":     encodeLabels(req.Labels),
+		"NodeGroups": encodeGroups(groups),
+	}
+	if err := AddNode(req.Name, req.Token, req.Region, req.City, extra); err != nil {
+		return NodeInfo{}, err
+	}
+	id, err := GetIDByName(req.Name)
+	if err != nil {
+		return NodeInfo{}, err
+	}
+	return GetNode(id)
+}
+
+// PatchNode 校验并修改节点
+func PatchNode(id int, req NodeUpdateRequest) (NodeInfo, error) {
+	if err := req.Validate(); err != nil {
+		return NodeInfo{}, err
+	}
+	if _, err := GetNode(id); err != nil {
+		return NodeInfo{}, err
+	}
+
+	updateFields := make(map[string]interface{})
+	if req.Name != nil {
+		exists, err := nodeNameExists(*req.Name, id)
+		if err != nil {
+			return NodeInfo{}, fmt.Errorf("检查节点失败: %w", err)
+		}
+		if exists {
+			return NodeInfo{}, &APIError{Status: http.StatusConflict, Code: "conflict", Message: "已有节点使用该名称", Field: "Name"}
+		}
+		updateFields["Name"] = *req.Name
+	}
+	if req.Region != nil {
+		updateFields["Region"] = *req.Region
+	}
+	if req.City != nil {
+		updateFields["City"] = *req.City
+	}
+	if req.AllowedIPs != nil {
+		allowedIPs, err := allowedIPsValue(*req.AllowedIPs)
+		if err != nil {
+			return NodeInfo{}, err
+		}
+		updateFields["AllowedIPs"] = allowedIPs
+	}
+	if req.Labels != nil {
+		updateFields["Labels"] = encodeLabels(*req.Labels)
+	}
+	if req.Groups != nil {
+		groups, err := NormalizeGroups(*req.Groups)
+		if err != nil {
+			return NodeInfo{}, err
+		}
+		updateFields["NodeGroups"] = encodeGroups(groups)
+	}
+
+	if err := UpdateNode(id, updateFields); err != nil {
+		return NodeInfo{}, err
+	}
+	return GetNode(id)
+}
+
+// RemoveNode 删除节点并断开其连接
+func RemoveNode(id int) error {
+	if _, err := GetNode(id); err != nil {
+		return err
+	}
+	if err := DeleteNode(id); err != nil {
+		return err
+	}
+	KickClient(id)
+	ClearChecks(id)
+	return nil
+}
+
+// HistoryPoint 一条历史数据
+type HistoryPoint struct {
+	TimeStamp int64
+	State     json.RawMessage
+}
+
+// NodeHistory 获取节点在时间范围内的历史数据，按时间正序
+func NodeHistory(id int, since, until int64, limit int) ([]HistoryPoint, error) {
+	if _, err := GetNode(id); err != nil {
+		return nil, err
+	}
+
+	rows, err := SQLRead(`SELECT TimeStamp, State FROM History WHERE NodeID = ? AND TimeStamp >= ? AND TimeStamp <= ?
+		ORDER BY TimeStamp LIMIT ?`, id, since, until, limit)
+	if err != nil {
+		return nil, fmt.Errorf("查询历史数据失败: %w", err)
+	}
+	points := []HistoryPoint{}
+	for rows.Next() {
+		var point HistoryPoint
+		var state *string
+		if err := rows.Scan(&point.TimeStamp, &state); err != nil {
+			continue
+		}
+		point.State = json.RawMessage("null")
+		if stringValue(state) != "" {
+			point.State = json.RawMessage(*state)
+		}
+		points = append(points, point)
+	}
+	rows.Close()
+	dbMutex.RUnlock()
+	return points, nil
+}
+
+// writeJSON 以 JSON 返回
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeAPIError 以 JSON 返回错误，非 APIError 时作为内部错误返回
+func writeAPIError(w http.ResponseWriter, err error) {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		log.Printf("接口内部错误: %v\n", err)
+		apiErr = &APIError{Status: http.StatusInternalServerError, Code: "internal", Message: "内部错误"}
+	}
+	writeJSON(w, apiErr.Status, apiErr)
+}
+
+// decodeBody 解析请求体，不允许未知字段
+func decodeBody(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return &APIError{Status: http.StatusBadRequest, Code: "invalid_body", Message: fmt.Sprintf("请求解析失败: %v", err)}
+	}
+	return nil
+}
+
+// API 处理 config.APIURI 下的请求
+func API(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	_, ip, _, ua, _ := ClientInfo(r)
+
+	// 解析路径：nodes、nodes/{id}、nodes/{id}/history
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(config.APIURI, "/")), "/"), "/")
+	if len(parts) == 1 && parts[0] == "openapi.json" && r.Method == http.MethodGet {
+		// 文档中的路径前缀与配置一致
+		prefix, _ := json.Marshal(strings.TrimSuffix(config.APIURI, "/"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(bytes.Replace(openAPISpec, []byte(`"url": "/api"`), append([]byte(`"url": `), prefix...), 1))
+		return
+	}
+	if parts[0] != "nodes" || len(parts) > 3 || (len(parts) == 3 && parts[2] != "history") {
+		writeAPIError(w, &APIError{Status: http.StatusNotFound, Code: "not_found", Message: "接口不存在"})
+		return
+	}
+	id := 0
+	if len(parts) > 1 {
+		var err error
+		id, err = strconv.Atoi(parts[1])
+		if err != nil || id <= 0 {
+			writeAPIError(w, invalidField("ID", "节点ID不正确"))
+			return
+		}
+	}
+
+	// 各路径支持的方法及对应的控制台操作，用于权限检查和审计
+	var action string
+	switch {
+	case r.Method == http.MethodGet:
+		action = "List"
+	case len(parts) == 1 && r.Method == http.MethodPost:
+		action = "Add"
+	case len(parts) == 2 && r.Method == http.MethodPatch:
+		action = "Update"
+	case len(parts) == 2 && r.Method == http.MethodDelete:
+		action = "Delete"
+	default:
+		writeAPIError(w, &APIError{Status: http.StatusMethodNotAllowed, Code: "method_not_allowed", Message: "请求方法不正确"})
+		return
+	}
+
+	// 只有认证失败计入频率限制，认证成功的请求不受限制
+	if ok, wait := CheckLimit(ip, "接口"); !ok {
+		if wait == 0 {
+			writeAPIError(w, &APIError{Status: http.StatusForbidden, Code: "forbidden", Message: "禁止访问"})
+			return
+		}
+		seconds := int(wait.Seconds()) + 1
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		writeAPIError(w, &APIError{Status: http.StatusTooManyRequests, Code: "rate_limited", Message: fmt.Sprintf("认证失败次数过多，请 %d 秒后重试", seconds)})
+		return
+	}
+
+	user, err := Authenticate(r, "")
+	if err != nil {
+		log.Printf("%s 接口认证失败: %v | %s\n", ip, err, ua)
+		RecordFailure(ip, "接口")
+		writeAPIError(w, &APIError{Status: http.StatusUnauthorized, Code: "unauthorized", Message: fmt.Sprintf("认证失败: %v", err)})
+		return
+	}
+	RecordSuccess(ip)
+
+	if !user.Can(action) {
+		log.Printf("%s 用户 %s（%s）无权执行 %s | %s\n", ip, user.Name, user.Role, action, ua)
+		writeAPIError(w, &APIError{Status: http.StatusForbidden, Code: "forbidden", Message: "权限不足"})
+		return
+	}
+
+	switch {
+	case action == "List" && len(parts) == 1:
+		selector, err := ParseSelector(r.URL.Query().Get("selector"))
+		if err != nil {
+			writeAPIError(w, invalidField("selector", err.Error()))
+			return
+		}
+		nodes, err := ListNodes()
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, FilterNodes(nodes, selector))
+
+	case action == "List" && len(parts) == 2:
+		node, err := GetNode(id)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, node)
+
+	case action == "List":
+		query := r.URL.Query()
+		until := time.Now().Unix()
+		since := until - 3600
+		limit := 1000
+		if v, err := strconv.ParseInt(query.Get("since"), 10, 64); err == nil {
+			since = v
+		}
+		if v, err := strconv.ParseInt(query.Get("until"), 10, 64); err == nil {
+			until = v
+		}
+		if v, err := strconv.Atoi(query.Get("limit")); err == nil && v > 0 && v <= 10000 {
+			limit = v
+		}
+		if since > until {
+			writeAPIError(w, invalidField("since", "since 不能大于 until"))
+			return
+		}
+		points, err := NodeHistory(id, since, until, limit)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, points)
+
+	case action == "Add":
+		var req NodeCreateRequest
+		if err := decodeBody(r, &req); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		w, finish := startAudit(w, user, ip, ua, action, req.Name, req.Name)
+		defer finish()
+		node, err := CreateNode(req)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		log.Printf("%s %s 节点添加成功，名称:%s，地区:%s，城市:%s | %s\n", ip, user.Name, node.Name, node.Region, node.City, ua)
+		writeJSON(w, http.StatusCreated, node)
+
+	case action == "Update":
+		var req NodeUpdateRequest
+		if err := decodeBody(r, &req); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		name := GetNameByID(id)
+		newName := name
+		if req.Name != nil {
+			newName = *req.Name
+		}
+		w, finish := startAudit(w, user, ip, ua, action, name, newName)
+		defer finish()
+		node, err := PatchNode(id, req)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		log.Printf("%s %s 节点 %s 更新成功 | %s\n", ip, user.Name, name, ua)
+		writeJSON(w, http.StatusOK, node)
+
+	case action == "Delete":
+		name := GetNameByID(id)
+		w, finish := startAudit(w, user, ip, ua, action, name, name)
+		defer finish()
+		if err := RemoveNode(id); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		log.Printf("%s %s 节点 %s 删除成功 | %s\n", ip, user.Name, name, ua)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// FilterNodes 返回满足选择器的节点
+func FilterNodes(nodes []NodeInfo, selector Selector) []NodeInfo {
+	if len(selector) == 0 {
+		return nodes
+	}
+	matched := []NodeInfo{}
+	for _, node := range nodes {
+		if selector.Match(node) {
+			matched = append(matched, node)
+		}
+	}
+	return matched
+}
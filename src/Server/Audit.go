@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// 需要记录审计日志的控制台操作
+var auditActions = map[string]bool{
+	"Add":          true,
+	"Delete":       true,
+	"Update":       true,
+	"Rotate":       true,
+	"Export":       true,
+	"Import":       true,
+	"EnrollCreate": true,
+	"EnrollDelete": true,
+	"Command":      true,
+	"UserAdd":      true,
+	"UserDelete":   true,
+	"UserPassword": true,
+	"Password":     true,
+}
+
+// auditWriter 记录响应的状态码，失败时记录错误信息，作为审计日志中的操作结果
+// 成功的响应可能包含新 Token，不记录内容
+type auditWriter struct {
+	http.ResponseWriter
+	status  int
+	message strings.Builder
+	after   map[string]interface{} // 批量操作的结果，由处理函数通过 setAuditResult 设置
+}
+
+// setAuditResult 记录导入、导出等批量操作的结果，代替操作后的值
+func setAuditResult(w http.ResponseWriter, after map[string]interface{}) {
+	if aw, ok := w.(*auditWriter); ok {
+		aw.after = after
+	}
+}
+
+func (w *auditWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditWriter) Write(b []byte) (int, error) {
+	if w.status >= 400 && w.message.Len() < 256 {
+		w.message.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// startAudit 包装 ResponseWriter 并记录操作前的值，请求处理完成后调用返回的函数记录审计日志
+// target 为操作对象的名称，afterTarget 为操作成功后的名称（重命名时不同）
+func startAudit(w http.ResponseWriter, user ConsoleUser, ip, ua, action, target, afterTarget string) (http.ResponseWriter, func()) {
+	before := auditSnapshot(action, target)
+	aw := &auditWriter{ResponseWriter: w, status: http.StatusOK}
+	return aw, func() {
+		if aw.status >= 400 {
+			afterTarget = target
+		}
+		after := aw.after
+		if after == nil {
+			after = auditSnapshot(action, afterTarget)
+		}
+		AddAudit(user, ip, ua, action, target, before, after, aw.status, aw.message.String())
+	}
+}
+
+// 创建表 Audit
+func createAuditTable() error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS Audit (
+		ID INTEGER PRIMARY KEY AUTOINCREMENT,
+		TimeStamp INTEGER NOT NULL,
+		UserID INTEGER,
+		UserName TEXT,
+		IP TEXT,
+		UA TEXT,
+		Action TEXT NOT NULL,
+		Target TEXT,
+		Before TEXT,
+		After TEXT,
+		Status INTEGER,
+		Message TEXT
+	);
+	CREATE INDEX IF NOT EXISTS idx_audit_time ON Audit (TimeStamp);
+	`
+	return SQLWrite(createTableSQL)
+}
+
+// auditTarget 返回操作对象的名称，Update 时分别返回修改前后的名称
+func auditTarget(user ConsoleUser, action string, requestData map[string]interface{}) (string, string) {
+	switch action {
+	case "Update":
+		origin, _ := requestData["OriginName"].(string)
+		name, _ := requestData["Name"].(string)
+		if name == "" {
+			name = origin
+		}
+		return origin, name
+	case "UserAdd", "UserDelete", "UserPassword":
+		name, _ := requestData["Username"].(string)
+		return name, name
+	case "Password":
+		return user.Name, user.Name
+	case "Command":
+		// 远程命令以节点名称和命令作为操作对象
+		name, _ := requestData["Name"].(string)
+		command, _ := requestData["Command"].(string)
+		args, _ := requestData["Args"].(map[string]interface{})
+		target := name + ": " + commandSummary(command, args)
+		return target, target
+	case "Export":
+		// 包含认证信息的导出可用于登录节点，单独标明
+		if credentials, _ := requestData["Credentials"].(bool); credentials {
+			return "全部节点（含认证信息）", ""
+		}
+		return "全部节点", ""
+	case "Import":
+		if dryRun, _ := requestData["DryRun"].(bool); dryRun {
+			return "导入节点（试运行）", ""
+		}
+		return "导入节点", ""
+	case "EnrollDelete":
+		id, _ := requestData["ID"].(float64)
+		target := fmt.Sprintf("注册码 %d", int(id))
+		return target, target
+	default:
+		name, _ := requestData["Name"].(string)
+		return name, name
+	}
+}
+
+// auditSnapshot 获取操作对象当前的值，不包含 Token 及密码，不存在时返回 nil
+func auditSnapshot(action, name string) map[string]interface{} {
+	if name == "" || strings.HasPrefix(action, "Enroll") || action == "Command" || action == "Export" || action == "Import" {
+		return nil
+	}
+
+	if strings.HasPrefix(action, "User") || action == "Password" {
+		var id int
+		var role string
+		dbMutex.RLock()
+		err := db.QueryRow("SELECT ID, Role FROM User WHERE Name = ?", name).Scan(&id, &role)
+		dbMutex.RUnlock()
+		if err != nil {
+			return nil
+		}
+		return map[string]interface{}{"ID": id, "Username": name, "Role": role}
+	}
+
+	var id int
+	var region, city, allowedIPs, labels, groups *string
+	var oldExpire *int64
+	dbMutex.RLock()
+	err := db.QueryRow("SELECT ID, Region, City, AllowedIPs, Labels, NodeGroups, OldTokenExpire FROM Node WHERE Name = ?", name).
+		Scan(&id, &region, &city, &allowedIPs, &labels, &groups, &oldExpire)
+	dbMutex.RUnlock()
+	if err != nil {
+		return nil
+	}
+	allowed := []string{}
+	if stringValue(allowedIPs) != "" {
+		json.Unmarshal([]byte(*allowedIPs), &allowed)
+	}
+	snapshot := map[string]interface{}{
+		"ID":         id,
+		"Name":       name,
+		"Region":     stringValue(region),
+		"City":       stringValue(city),
+		"AllowedIPs": allowed,
+		"Labels":     decodeLabels(labels),
+		"Groups":     decodeGroups(groups),
+	}
+	// 轮换 Token 后旧 Token 的失效时间
+	if oldExpire != nil {
+		snapshot["OldTokenExpire"] = *oldExpire
+	}
+	return snapshot
+}
+
+// AddAudit 记录一次控制台操作
+func AddAudit(user ConsoleUser, ip, ua, action, target string, before, after map[string]interface{}, status int, message string) {
+	beforeJSON, afterJSON := "", ""
+	if before != nil {
+		data, _ := json.Marshal(before)
+		beforeJSON = string(data)
+	}
+	if after != nil {
+		data, _ := json.Marshal(after)
+		afterJSON = string(data)
+	}
+
+	err := SQLWrite(`INSERT INTO Audit (TimeStamp, UserID, UserName, IP, UA, Action, Target, Before, After, Status, Message)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		time.Now().Unix(), user.ID, user.Name, ip, ua, action, target, beforeJSON, afterJSON, status, strings.TrimSpace(message))
+	if err != nil {
+		log.Printf("记录审计日志失败: %v\n", err)
+	}
+}
+
+// ListAudit 控制台查询审计日志，按时间倒序
+// 可按 User、Operation（操作名称）、Target、IP 精确过滤，Since、Until 为时间范围，Result 为 success 或 failure
+func ListAudit(w http.ResponseWriter, requestData map[string]interface{}) {
+	limit, offset := 100, 0
+	if v, ok := requestData["Limit"].(float64); ok && v > 0 && v <= 1000 {
+		limit = int(v)
+	}
+	if v, ok := requestData["Offset"].(float64); ok && v > 0 {
+		offset = int(v)
+	}
+
+	var conditions []string
+	var args []interface{}
+	for field, column := range map[string]string{"User": "UserName", "Operation": "Action", "Target": "Target", "IP": "IP"} {
+		if v, ok := requestData[field].(string); ok && v != "" {
+			conditions = append(conditions, column+" = ?")
+			args = append(args, v)
+		}
+	}
+	if v, ok := requestData["Since"].(float64); ok && v > 0 {
+		conditions = append(conditions, "TimeStamp >= ?")
+		args = append(args, int64(v))
+	}
+	if v, ok := requestData["Until"].(float64); ok && v > 0 {
+		conditions = append(conditions, "TimeStamp <= ?")
+		args = append(args, int64(v))
+	}
+	switch requestData["Result"] {
+	case "success":
+		conditions = append(conditions, "Status < 400")
+	case "failure":
+		conditions = append(conditions, "Status >= 400")
+	}
+
+	query := "SELECT TimeStamp, UserID, UserName, IP, UA, Action, Target, Before, After, Status, Message FROM Audit"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY ID DESC LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+
+	rows, err := SQLRead(query, args...)
+	if err != nil {
+		http.Error(w, "内部错误：数据库查询失败", http.StatusInternalServerError)
+		return
+	}
+	records := []map[string]interface{}{}
+	for rows.Next() {
+		var timestamp int64
+		var userID, status *int64
+		var userName, ip, ua, action, target, before, after, message *string
+		if err := rows.Scan(&timestamp, &userID, &userName, &ip, &ua, &action, &target, &before, &after, &status, &message); err != nil {
+			continue
+		}
+		record := map[string]interface{}{
+			"TimeStamp": timestamp,
+			"UserName":  stringValue(userName),
+			"IP":        stringValue(ip),
+			"UA":        stringValue(ua),
+			"Action":    stringValue(action),
+			"Target":    stringValue(target),
+			"Before":    json.RawMessage("null"),
+			"After":     json.RawMessage("null"),
+			"Message":   stringValue(message),
+		}
+		if userID != nil {
+			record["UserID"] = *userID
+		}
+		if status != nil {
+			record["Status"] = *status
+		}
+		if stringValue(before) != "" {
+			record["Before"] = json.RawMessage(*before)
+		}
+		if stringValue(after) != "" {
+			record["After"] = json.RawMessage(*after)
+		}
+		records = append(records, record)
+	}
+	rows.Close()
+	dbMutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(records)
+}
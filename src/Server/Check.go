@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	checkStatus      = make(map[int]map[string]bool) // 节点ID -> 检查名称 -> 上次是否通过
+	checkStatusMutex sync.Mutex
+	alertRules       []alertRule // 配置的告警规则，为空时所有检查均告警
+	alertClient      = &http.Client{Timeout: 10 * time.Second}
+)
+
+// alertRule 解析后的告警规则
+type alertRule struct {
+	name     string
+	selector Selector
+	checks   []string
+}
+
+// InitAlertRules 解析配置中的告警规则
+func InitAlertRules() error {
+	alertRules = nil
+	for i, rule := range config.AlertRules {
+		selector, err := ParseSelector(rule.Selector)
+		if err != nil {
+			return fmt.Errorf("告警规则 %s: %v", rule.Name, err)
+		}
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("rule%d", i+1)
+		}
+		alertRules = append(alertRules, alertRule{name: name, selector: selector, checks: rule.Checks})
+	}
+	return nil
+}
+
+// matchAlertRules 返回与节点及检查匹配的告警规则名称
+func matchAlertRules(node NodeInfo, check string) []string {
+	var names []string
+	for _, rule := range alertRules {
+		if (len(rule.checks) == 0 || slices.Contains(rule.checks, check)) && rule.selector.Match(node) {
+			names = append(names, rule.name)
+		}
+	}
+	return names
+}
+
+// checkChange 状态发生变化的检查
+type checkChange struct {
+	name    string
+	passed  bool
+	message string
+}
+
+// ProcessChecks 对比节点上报的检查结果，在状态变化时发出告警
+func ProcessChecks(nodeID int, checks []interface{}) {
+	var changes []checkChange
+
+	checkStatusMutex.Lock()
+	last, exists := checkStatus[nodeID]
+	if !exists {
+		last = make(map[string]bool)
+		checkStatus[nodeID] = last
+	}
+	for _, raw := range checks {
+		check, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _ := check["Name"].(string)
+		passed, _ := check["OK"].(bool)
+		message, _ := check["Message"].(string)
+
+		previous, seen := last[name]
+		last[name] = passed
+
+		// 首次上报时只对失败的检查告警
+		if seen && previous == passed || !seen && passed {
+			continue
+		}
+		changes = append(changes, checkChange{name: name, passed: passed, message: message})
+	}
+	checkStatusMutex.Unlock()
+
+	if len(changes) == 0 {
+		return
+	}
+
+	// 读取数据库不占用 checkStatusMutex，避免阻塞其他节点的检查
+	node, err := GetNode(nodeID)
+	if err != nil {
+		log.Printf("读取节点 %d 失败: %v\n", nodeID, err)
+		return
+	}
+	for _, change := range changes {
+		// 配置了告警规则时，只有匹配规则的检查才告警
+		var rules []string
+		if len(alertRules) > 0 {
+			rules = matchAlertRules(node, change.name)
+			if len(rules) == 0 {
+				continue
+			}
+		}
+		SendAlert(node, change, rules)
+	}
+}
+
+// SendAlert 记录告警事件，配置了 alert_webhook 时同时推送
+func SendAlert(node NodeInfo, change checkChange, rules []string) {
+	prefix := ""
+	if len(rules) > 0 {
+		prefix = "[" + strings.Join(rules, ",") + "] "
+	}
+	eventType, message := "alert", fmt.Sprintf("%s节点 %s 检查 %s 失败: %s", prefix, node.Name, change.name, change.message)
+	if change.passed {
+		eventType, message = "recover", fmt.Sprintf("%s节点 %s 检查 %s 已恢复", prefix, node.Name, change.name)
+	}
+	AddEvent(eventType, node.IP, message)
+
+	if config.AlertWebhook == "" {
+		return
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"Type":      eventType,
+		"Node":      node.Name,
+		"Region":    node.Region,
+		"City":      node.City,
+		"Labels":    node.Labels,
+		"Groups":    node.Groups,
+		"Check":     change.name,
+		"OK":        change.passed,
+		"Message":   change.message,
+		"Rules":     rules,
+		"TimeStamp": time.Now().Unix(),
+	})
+	if err != nil {
+		return
+	}
+	go func() {
+		resp, err := alertClient.Post(config.AlertWebhook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("推送告警失败: %v\n", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("推送告警失败: HTTP %d\n", resp.StatusCode)
+		}
+	}()
+}
+
+// ClearChecks 节点删除时清除其检查状态
+func ClearChecks(nodeID int) {
+	checkStatusMutex.Lock()
+	delete(checkStatus, nodeID)
+	checkStatusMutex.Unlock()
+}
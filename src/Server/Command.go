@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 远程命令：控制台通过节点的 WebSocket 连接向客户端发送命令（status 6），客户端执行后以 command_result 返回结果
+// 客户端只执行配置文件 commands 中允许的命令，其余命令返回 denied
+
+// 支持的命令
+var remoteCommands = map[string]string{
+	"host":       "重新发送主机信息",
+	"interval":   "修改采集间隔（重启后恢复配置文件中的值）",
+	"ping":       "ping 指定地址",
+	"traceroute": "traceroute 指定地址",
+	"df":         "查看磁盘使用情况",
+	"restart":    "重启客户端",
+}
+
+const (
+	defaultCommandTimeout = 30  // 等待命令结果的默认时间（秒）
+	maxCommandTimeout     = 120 // 等待命令结果的最长时间（秒）
+	maxCommandOutput      = 64 * 1024
+)
+
+// ping、traceroute 的目标只能是主机名或 IP，不能以 - 开头，避免被当作参数
+var commandTargetPattern = regexp.MustCompile(`^[a-zA-Z0-9_.:][a-zA-Z0-9_.:-]{0,252}$`)
+
+// CommandResult 客户端返回的命令结果
+type CommandResult struct {
+	ID     string `json:"id"`
+	Status string `json:"status"` // ok、error（命令执行失败）或 denied（客户端不允许该命令）
+	Output string `json:"output"`
+}
+
+// pendingCommand 等待结果的命令
+type pendingCommand struct {
+	nodeID int
+	result chan CommandResult
+}
+
+var pendingCommands = make(map[string]pendingCommand)
+var commandMutex sync.Mutex
+
+// ValidateCommand 校验命令及参数
+func ValidateCommand(command string, args map[string]interface{}) error {
+	if _, ok := remoteCommands[command]; !ok {
+		names := make([]string, 0, len(remoteCommands))
+		for name := range remoteCommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return invalidField("Command", fmt.Sprintf("不支持的命令 %q，可选 %s", command, strings.Join(names, "、")))
+	}
+
+	switch command {
+	case "ping", "traceroute":
+		target, _ := args["Target"].(string)
+		if !commandTargetPattern.MatchString(target) {
+			return invalidField("Target", "Target 必须为主机名或 IP")
+		}
+	case "interval":
+		count := 0
+		for _, key := range []string{"Fast", "Slow", "Host"} {
+			value, exists := args[key]
+			if !exists {
+				continue
+			}
+			seconds, ok := value.(float64)
+			if !ok || seconds < 1 || seconds > 3600 || seconds != float64(int(seconds)) {
+				return invalidField(key, fmt.Sprintf("%s 必须为 1 到 3600 之间的整数（秒）", key))
+			}
+			count++
+		}
+		if count == 0 {
+			return invalidField("", "至少需要 Fast、Slow、Host 中的一个")
+		}
+	}
+	return nil
+}
+
+// commandSummary 命令的简要说明，用于日志和审计
+func commandSummary(command string, args map[string]interface{}) string {
+	switch command {
+	case "ping", "traceroute":
+		return fmt.Sprintf("%s %v", command, args["Target"])
+	case "interval":
+		var parts []string
+		for _, key := range []string{"Fast", "Slow", "Host"} {
+			if value, ok := args[key]; ok {
+				parts = append(parts, fmt.Sprintf("%s=%v", strings.ToLower(key), value))
+			}
+		}
+		return command + " " + strings.Join(parts, " ")
+	}
+	return command
+}
+
+// SendCommand 向在线的节点发送命令并等待结果，timeout 为等待的秒数
+func SendCommand(nodeID int, command string, args map[string]interface{}, timeout int) (CommandResult, error) {
+	if err := ValidateCommand(command, args); err != nil {
+		return CommandResult{}, err
+	}
+	if timeout <= 0 {
+		timeout = defaultCommandTimeout
+	}
+	if timeout > maxCommandTimeout {
+		return CommandResult{}, invalidField("Timeout", fmt.Sprintf("Timeout 不能超过 %d 秒", maxCommandTimeout))
+	}
+
+	// 节点的连接，Client 表保留已断开的连接记录，只能从当前连接中查找
+	clientKey := NodeClientKey(nodeID)
+	if clientKey == "" {
+		return CommandResult{}, &APIError{Status: http.StatusConflict, Code: "conflict", Message: "节点不在线"}
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return CommandResult{}, err
+	}
+	pending := pendingCommand{nodeID: nodeID, result: make(chan CommandResult, 1)}
+	commandMutex.Lock()
+	pendingCommands[id] = pending
+	commandMutex.Unlock()
+	defer func() {
+		commandMutex.Lock()
+		delete(pendingCommands, id)
+		commandMutex.Unlock()
+	}()
+
+	message, err := json.Marshal(map[string]interface{}{
+		"status": 6,
+		"data": map[string]interface{}{
+			"id":      id,
+			"command": command,
+			"args":    args,
+			"timeout": timeout,
+		},
+	})
+	if err != nil {
+		return CommandResult{}, err
+	}
+	if err := SendToClient(clientKey, string(message)); err != nil {
+		// 连接刚断开时 Client 表中可能仍有记录
+		log.Printf("向节点 %d 发送命令失败: %v\n", nodeID, err)
+		return CommandResult{}, &APIError{Status: http.StatusConflict, Code: "conflict", Message: "节点不在线"}
+	}
+
+	select {
+	case result := <-pending.result:
+		return result, nil
+	case <-time.After(time.Duration(timeout) * time.Second):
+		return CommandResult{}, &APIError{Status: http.StatusGatewayTimeout, Code: "timeout", Message: "等待命令结果超时，客户端可能不支持远程命令"}
+	}
+}
+
+// DeliverCommandResult 处理节点返回的命令结果，只接受发给该节点的命令
+func DeliverCommandResult(nodeID int, data map[string]interface{}) {
+	var result CommandResult
+	result.ID, _ = data["id"].(string)
+	result.Status, _ = data["status"].(string)
+	result.Output, _ = data["output"].(string)
+	if len(result.Output) > maxCommandOutput {
+		result.Output = result.Output[:maxCommandOutput]
+	}
+
+	commandMutex.Lock()
+	pending, ok := pendingCommands[result.ID]
+	commandMutex.Unlock()
+	if !ok || pending.nodeID != nodeID {
+		log.Printf("节点 %d 返回了未知的命令结果: %s\n", nodeID, result.ID)
+		return
+	}
+	select {
+	case pending.result <- result:
+	default:
+	}
+}
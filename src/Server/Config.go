@@ -6,16 +6,76 @@ import (
 	"gopkg.in/yaml.v3"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 // Config 结构体定义
 type Config struct {
-	Listen     string         `yaml:"listen"`
-	Token      string         `yaml:"token"`
-	NodeURI    string         `yaml:"node_uri"`
-	BroadURI   string         `yaml:"broad_uri"`
-	ConsoleURI string         `yaml:"console_uri"`
-	Database   DatabaseConfig `yaml:"database"`
+	Listen         string         `yaml:"listen"`
+	Token          string         `yaml:"token"`
+	NodeURI        string         `yaml:"node_uri"`
+	BroadURI       string         `yaml:"broad_uri"`
+	ConsoleURI     string         `yaml:"console_uri"`
+	LoginURI       string         `yaml:"login_uri"`
+	APIURI         string         `yaml:"api_uri"` // REST 管理接口的路径前缀
+	DetailURI      string         `yaml:"detail_uri"`
+	MetricsURI     string         `yaml:"metrics_uri"`
+	MetricsToken   string         `yaml:"metrics_token"`   // 非空时访问指标需要携带 Authorization: Bearer <MetricsToken>
+	SessionTTL     int            `yaml:"session_ttl"`     // 控制台会话有效期（小时）
+	LegacyLogin    bool           `yaml:"legacy_login"`    // 是否允许客户端直接发送 Token 登录
+	AuthKeyFile    string         `yaml:"auth_key_file"`   // 加密节点认证密钥的主密钥文件，不存在时自动生成
+	TrustedProxies []string       `yaml:"trusted_proxies"` // 可信代理的 IP 或 CIDR
+	ProxyProtocol  bool           `yaml:"proxy_protocol"`  // 来自可信代理的连接使用 PROXY 协议 v1/v2
+	TLSCert        string         `yaml:"tls_cert"`        // 证书文件，与 tls_key 同时配置时启用 HTTPS/WSS
+	TLSKey         string         `yaml:"tls_key"`
+	TLSClientCA    string         `yaml:"tls_client_ca"`   // 签发节点客户端证书的 CA
+	TLSClientAuth  string         `yaml:"tls_client_auth"` // optional 或 require，require 时节点必须提供客户端证书
+	TLSCertLogin   bool           `yaml:"tls_cert_login"`  // 允许节点只使用客户端证书登录，不需要 Token
+	Database       DatabaseConfig `yaml:"database"`
+	History        HistoryConfig  `yaml:"history"`
+	Forward        ForwardConfig  `yaml:"forward"`
+	Security       SecurityConfig `yaml:"security"`
+	AlertRules     []AlertRule    `yaml:"alert_rules"`
+	AlertWebhook   string         `yaml:"alert_webhook"` // 告警及恢复时以 POST JSON 推送到该地址，为空时只记录事件
+}
+
+// AlertRule 告警规则，节点满足选择器且检查名称匹配时告警
+type AlertRule struct {
+	Name     string   `yaml:"name"`
+	Selector string   `yaml:"selector"` // 节点选择器，如 group=web,env=prod，为空时匹配所有节点
+	Checks   []string `yaml:"checks"`   // 检查名称，为空时匹配所有检查
+}
+
+// SecurityConfig 认证尝试的频率限制及锁定配置，作用于节点登录、控制台及控制台登录
+type SecurityConfig struct {
+	Rate        int      `yaml:"rate"`         // 每个 IP 每分钟最多的认证失败次数，认证成功的请求不计入
+	MaxFailures int      `yaml:"max_failures"` // 统计窗口内失败达到该次数时锁定
+	Window      int      `yaml:"window"`       // 失败次数的统计窗口（秒）
+	Lockout     int      `yaml:"lockout"`      // 首次锁定时长（秒），之后每次翻倍
+	MaxLockout  int      `yaml:"max_lockout"`  // 最长锁定时长（秒）
+	BanList     []string `yaml:"ban_list"`     // 禁止访问的 IP 或 CIDR
+}
+
+// ForwardConfig 转发到外部时序数据库的配置
+type ForwardConfig struct {
+	Type      string            `yaml:"type"` // influxdb 或 remote_write，为空时不转发
+	URL       string            `yaml:"url"`
+	Username  string            `yaml:"username"`
+	Password  string            `yaml:"password"`
+	Headers   map[string]string `yaml:"headers"`    // 附加请求头，如 Authorization
+	QueueSize int               `yaml:"queue_size"` // 队列长度，已满时丢弃新数据
+	BatchSize int               `yaml:"batch_size"` // 每次请求最多包含的采样数
+	Retries   int               `yaml:"retries"`    // 失败重试次数
+	Timeout   int               `yaml:"timeout"`    // 请求超时（秒）
+}
+
+// HistoryConfig 历史数据配置
+type HistoryConfig struct {
+	Interval   int `yaml:"interval"`    // 每个节点保存历史数据的最小间隔（秒）
+	Days       int `yaml:"days"`        // 保留天数
+	EventDays  int `yaml:"event_days"`  // 安全事件保留天数
+	AuditDays  int `yaml:"audit_days"`  // 审计日志保留天数
+	EnrollDays int `yaml:"enroll_days"` // 已使用或已过期的注册码保留天数
 }
 
 type DatabaseConfig struct {
@@ -40,6 +100,18 @@ func LoadConfig() error {
 	nodeUri := flag.String("node_uri", "/Monitor/Node", "节点 URI")
 	broadUri := flag.String("broad_uri", "/Monitor/Status", "广播 URI")
 	consoleUri := flag.String("console_uri", "/Monitor/Console", "控制台 URI")
+	loginUri := flag.String("login_uri", "/Monitor/Login", "控制台登录 URI")
+	apiUri := flag.String("api_uri", "/api", "REST 管理接口 URI")
+	detailUri := flag.String("detail_uri", "/Monitor/Detail", "节点详情 URI")
+	metricsUri := flag.String("metrics_uri", "/metrics", "Prometheus 指标 URI")
+	tlsCert := flag.String("tls_cert", "", "TLS 证书文件")
+	tlsKey := flag.String("tls_key", "", "TLS 私钥文件")
+	tlsClientCA := flag.String("tls_client_ca", "", "节点客户端证书的 CA 文件")
+	tlsCertLogin := flag.Bool("tls_cert_login", false, "允许节点只使用客户端证书登录")
+	trustedProxies := flag.String("trusted_proxies", "", "可信代理的 IP 或 CIDR，多个以逗号分隔")
+	proxyProtocol := flag.Bool("proxy_protocol", false, "来自可信代理的连接使用 PROXY 协议")
+	legacyLogin := flag.Bool("legacy_login", false, "允许旧版客户端直接发送 Token 登录")
+	authKeyFile := flag.String("auth_key_file", "LightMonitor.key", "加密节点认证密钥的主密钥文件")
 	dbType := flag.String("type", "sqlite", "数据库类型")
 	sqlitePath := flag.String("sqlite_path", "LightMonitor.db", "数据库文件路径")
 	host := flag.String("host", "127.0.0.1", "数据库主机")
@@ -70,6 +142,33 @@ func LoadConfig() error {
 		config.ConsoleURI = *consoleUri
 	}
 
+	if *loginUri != "" {
+		config.LoginURI = *loginUri
+	}
+
+	if *apiUri != "" {
+		config.APIURI = *apiUri
+	}
+
+	if *detailUri != "" {
+		config.DetailURI = *detailUri
+	}
+
+	if *metricsUri != "" {
+		config.MetricsURI = *metricsUri
+	}
+
+	config.LegacyLogin = *legacyLogin
+	config.AuthKeyFile = *authKeyFile
+	if *trustedProxies != "" {
+		config.TrustedProxies = strings.Split(*trustedProxies, ",")
+	}
+	config.ProxyProtocol = *proxyProtocol
+	config.TLSCert = *tlsCert
+	config.TLSKey = *tlsKey
+	config.TLSClientCA = *tlsClientCA
+	config.TLSCertLogin = *tlsCertLogin
+
 	// 数据库配置
 	config.Database = DatabaseConfig{
 		Type:     *dbType,
@@ -82,6 +181,7 @@ func LoadConfig() error {
 	}
 
 	if config.Token != "" {
+		setDefaults()
 		return nil
 	}
 
@@ -94,6 +194,7 @@ func LoadConfig() error {
 	if err := loadConfigFromFile(*configFile); err != nil {
 		return err
 	}
+	setDefaults()
 
 	// 检查数据库配置是否正确
 	if err := validateDatabaseConfig(); err != nil {
@@ -116,6 +217,61 @@ func loadConfigFromFile(filePath string) error {
 	return nil
 }
 
+// setDefaults 为未配置的项设置默认值
+func setDefaults() {
+	if config.Security.Rate <= 0 {
+		config.Security.Rate = 30
+	}
+	if config.Security.MaxFailures <= 0 {
+		config.Security.MaxFailures = 5
+	}
+	if config.Security.Window <= 0 {
+		config.Security.Window = 300
+	}
+	if config.Security.Lockout <= 0 {
+		config.Security.Lockout = 60
+	}
+	if config.Security.MaxLockout <= 0 {
+		config.Security.MaxLockout = 3600
+	}
+	if config.AuthKeyFile == "" {
+		config.AuthKeyFile = "LightMonitor.key"
+	}
+	if config.TLSClientAuth == "" {
+		config.TLSClientAuth = "optional"
+	}
+	if config.SessionTTL <= 0 {
+		config.SessionTTL = 24
+	}
+	if config.History.Interval <= 0 {
+		config.History.Interval = 60
+	}
+	if config.History.Days <= 0 {
+		config.History.Days = 7
+	}
+	if config.History.EventDays <= 0 {
+		config.History.EventDays = 90
+	}
+	if config.History.AuditDays <= 0 {
+		config.History.AuditDays = 365
+	}
+	if config.History.EnrollDays <= 0 {
+		config.History.EnrollDays = 30
+	}
+	if config.Forward.QueueSize <= 0 {
+		config.Forward.QueueSize = 10000
+	}
+	if config.Forward.BatchSize <= 0 {
+		config.Forward.BatchSize = 500
+	}
+	if config.Forward.Retries < 0 {
+		config.Forward.Retries = 0
+	}
+	if config.Forward.Timeout <= 0 {
+		config.Forward.Timeout = 10
+	}
+}
+
 // validateDatabaseConfig 校验数据库配置是否正确
 func validateDatabaseConfig() error {
 	if config.Database.Type == "" {
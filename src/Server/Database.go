@@ -8,6 +8,7 @@ import (
 	_ "modernc.org/sqlite" // SQLite 驱动
 	"strings"
 	"sync"
+	"time"
 )
 
 // 数据库全局变量
@@ -19,7 +20,9 @@ func SQLWrite(query string, args ...interface{}) error {
 	dbMutex.Lock()
 	defer dbMutex.Unlock()
 
+	start := time.Now()
 	_, err := db.Exec(query, args...)
+	ObserveDBWrite(time.Since(start))
 	if err != nil {
 		return fmt.Errorf("数据库写入失败: %w", err)
 	}
@@ -33,6 +36,8 @@ func SQLRead(query string, args ...interface{}) (*sql.Rows, error) {
 	// 执行SQL读取操作
 	rows, err := db.Query(query, args...)
 	if err != nil {
+		// 查询失败时释放读锁，调用方只需在成功时释放
+		dbMutex.RUnlock()
 		return nil, fmt.Errorf("数据库读取失败: %w", err)
 	}
 	return rows, nil
@@ -51,21 +56,52 @@ func InitDatabase(cfg DatabaseConfig) error {
 	if err != nil {
 		return fmt.Errorf("初始化 Node 表失败: %v", err)
 	}
+	err = migrateNodeTable()
+	if err != nil {
+		return fmt.Errorf("升级 Node 表失败: %v", err)
+	}
+	err = migrateNodeTokens()
+	if err != nil {
+		return fmt.Errorf("转换节点 Token 失败: %v", err)
+	}
 	err = createClientTable()
 	if err != nil {
 		return fmt.Errorf("初始化 Client 表失败: %v", err)
 	}
-
-	// 启动时清空 Client 表
-	_, err = db.Exec("DELETE FROM Client")
+	err = createHistoryTable()
 	if err != nil {
-		return fmt.Errorf("清空 Client 表失败: %v", err)
+		return fmt.Errorf("初始化 History 表失败: %v", err)
+	}
+	err = createUserTable()
+	if err != nil {
+		return fmt.Errorf("初始化 User 表失败: %v", err)
+	}
+	err = createEventTable()
+	if err != nil {
+		return fmt.Errorf("初始化 Event 表失败: %v", err)
+	}
+	err = createAuditTable()
+	if err != nil {
+		return fmt.Errorf("初始化 Audit 表失败: %v", err)
+	}
+	err = createEnrollTable()
+	if err != nil {
+		return fmt.Errorf("初始化 Enroll 表失败: %v", err)
 	}
 
 	//log.Println("数据库连接成功")
 	return nil
 }
 
+// ClearClients 启动服务时清空 Client 表，命令行工具不调用，避免影响正在运行的服务
+func ClearClients() error {
+	_, err := db.Exec("DELETE FROM Client")
+	if err != nil {
+		return fmt.Errorf("清空 Client 表失败: %v", err)
+	}
+	return nil
+}
+
 // 创建表 Node
 func createNodeTable() error {
 	createTableSQL := `
@@ -73,11 +109,26 @@ func createNodeTable() error {
 		ID INTEGER PRIMARY KEY AUTOINCREMENT,
 		Name TEXT NOT NULL,
 		Token TEXT NOT NULL,
+		TokenSalt TEXT,
+		OldToken TEXT,
+		OldTokenSalt TEXT,
+		OldTokenExpire INTEGER,
+		TokenID TEXT,
+		AuthKey TEXT,
+		OldTokenID TEXT,
+		OldAuthKey TEXT,
+		AllowedIPs TEXT,
+		Labels TEXT,
+		NodeGroups TEXT,
 		Region TEXT,
 		City TEXT,
 		IP TEXT,
 		Data TEXT,
 		Status TEXT,
+		Process TEXT,
+		Containers TEXT,
+		Checks TEXT,
+		Custom TEXT,
 		Timestamp INTEGER DEFAULT (strftime('%s', 'now'))
 	);
 	`
@@ -89,58 +140,165 @@ func createNodeTable() error {
 	return err
 }
 
-// AddNode 添加新节点
-func AddNode(name, token, region, city string) error {
+// migrateNodeTable 为旧版本数据库补充新增的列
+func migrateNodeTable() error {
+	columns := []struct {
+		name       string
+		definition string
+	}{
+		{"Process", "TEXT"},
+		{"Containers", "TEXT"},
+		{"Checks", "TEXT"},
+		{"Custom", "TEXT"},
+		{"TokenSalt", "TEXT"},
+		{"OldToken", "TEXT"},
+		{"OldTokenSalt", "TEXT"},
+		{"OldTokenExpire", "INTEGER"},
+		{"TokenID", "TEXT"},
+		{"AuthKey", "TEXT"},
+		{"OldTokenID", "TEXT"},
+		{"OldAuthKey", "TEXT"},
+		{"AllowedIPs", "TEXT"},
+		{"Labels", "TEXT"},
+		{"NodeGroups", "TEXT"},
+	}
+
+	for _, c := range columns {
+		if err := addColumn("Node", c.name, c.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumn 列不存在时为表添加列
+func addColumn(table, column, definition string) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("读取表结构失败: %w", err)
+	}
+
+	exists := false
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue *string
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			rows.Close()
+			return fmt.Errorf("读取表结构失败: %w", err)
+		}
+		if strings.EqualFold(name, column) {
+			exists = true
+		}
+	}
+	rows.Close()
+
+	if exists {
+		return nil
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("添加列 %s.%s 失败: %w", table, column, err)
+	}
+	return nil
+}
+
+// AddNode 添加新节点，extra 为 AllowedIPs、Labels、NodeGroups 等可选的列
+func AddNode(name, token, region, city string, extra map[string]interface{}) error {
+	fields, err := nodeCredentials(token)
+	if err != nil {
+		return err
+	}
+	for key, value := range extra {
+		fields[key] = value
+	}
+	insertSQL, args, err := nodeInsert(name, region, city, fields)
+	if err != nil {
+		return err
+	}
+	err = SQLWrite(insertSQL, args...)
+	if err != nil {
+		return fmt.Errorf("插入数据失败: %w", err)
+	}
+	return nil
+}
+
+// nodeInsert 生成添加节点的语句，Data 和 Status 使用空白的初始值
+// extra 需包含 Token、TokenSalt 等认证信息列，见 nodeCredentials
+func nodeInsert(name, region, city string, extra map[string]interface{}) (string, []interface{}, error) {
 	data := struct {
-		Arch            string   `json:"Arch"`
-		BootTime        int64    `json:"BootTime"`
-		CPU             []string `json:"CPU"`
-		DiskTotal       int64    `json:"DiskTotal"`
-		MemTotal        int64    `json:"MemTotal"`
-		Platform        string   `json:"Platform"`
-		PlatformVersion string   `json:"PlatformVersion"`
-		SwapTotal       int64    `json:"SwapTotal"`
-		Virtualization  string   `json:"Virtualization"`
+		Arch               string   `json:"Arch"`
+		BootTime           int64    `json:"BootTime"`
+		CPU                []string `json:"CPU"`
+		CoreCount          int64    `json:"CoreCount"`
+		ThreadCount        int64    `json:"ThreadCount"`
+		DiskTotal          int64    `json:"DiskTotal"`
+		Hostname           string   `json:"Hostname"`
+		IPv4               string   `json:"IPv4"`
+		IPv6               string   `json:"IPv6"`
+		KernelVersion      string   `json:"KernelVersion"`
+		MemTotal           int64    `json:"MemTotal"`
+		Platform           string   `json:"Platform"`
+		PlatformVersion    string   `json:"PlatformVersion"`
+		SwapTotal          int64    `json:"SwapTotal"`
+		Timezone           string   `json:"Timezone"`
+		Virtualization     string   `json:"Virtualization"`
+		VirtualizationRole string   `json:"VirtualizationRole"`
 	}{
 		CPU: []string{},
 	}
 
 	status := struct {
-		CPU             float64 `json:"CPU"`
-		DiskUsed        int64   `json:"DiskUsed"`
-		Load1           float64 `json:"Load1"`
-		Load15          float64 `json:"Load15"`
-		Load5           float64 `json:"Load5"`
-		MemUsed         int64   `json:"MemUsed"`
-		NetInSpeed      int64   `json:"NetInSpeed"`
-		NetInTransfer   int64   `json:"NetInTransfer"`
-		NetOutSpeed     int64   `json:"NetOutSpeed"`
-		NetOutTransfer  int64   `json:"NetOutTransfer"`
-		PacketsRecv     int64   `json:"PacketsRecv"`
-		PacketsRecvRate int64   `json:"PacketsRecvRate"`
-		PacketsSent     int64   `json:"PacketsSent"`
-		PacketsSentRate int64   `json:"PacketsSentRate"`
-		Processes       int64   `json:"Processes"`
-		SwapUsed        int64   `json:"SwapUsed"`
-		TCPConections   int64   `json:"TCPConections"`
-		UDPConnections  int64   `json:"UDPConnections"`
-	}{}
+		CPU             float64   `json:"CPU"`
+		CPUCores        []float64 `json:"CPUCores"`
+		CPUUser         float64   `json:"CPUUser"`
+		CPUSystem       float64   `json:"CPUSystem"`
+		CPUIowait       float64   `json:"CPUIowait"`
+		CPUSteal        float64   `json:"CPUSteal"`
+		CPUIdle         float64   `json:"CPUIdle"`
+		DiskUsed        int64     `json:"DiskUsed"`
+		Load1           float64   `json:"Load1"`
+		Load15          float64   `json:"Load15"`
+		Load5           float64   `json:"Load5"`
+		MemUsed         int64     `json:"MemUsed"`
+		NetInSpeed      int64     `json:"NetInSpeed"`
+		NetInTransfer   int64     `json:"NetInTransfer"`
+		NetOutSpeed     int64     `json:"NetOutSpeed"`
+		NetOutTransfer  int64     `json:"NetOutTransfer"`
+		PacketsRecv     int64     `json:"PacketsRecv"`
+		PacketsRecvRate int64     `json:"PacketsRecvRate"`
+		PacketsSent     int64     `json:"PacketsSent"`
+		PacketsSentRate int64     `json:"PacketsSentRate"`
+		Processes       int64     `json:"Processes"`
+		SwapUsed        int64     `json:"SwapUsed"`
+		TCPConections   int64     `json:"TCPConections"`
+		UDPConnections  int64     `json:"UDPConnections"`
+	}{
+		CPUCores: []float64{},
+	}
 
 	dataJSON, err := json.Marshal(data)
 	if err != nil {
-		return fmt.Errorf("序列化数据字段失败: %w", err)
+		return "", nil, fmt.Errorf("序列化数据字段失败: %w", err)
 	}
 	statusJSON, err := json.Marshal(status)
 	if err != nil {
-		return fmt.Errorf("序列化状态字段失败: %w", err)
+		return "", nil, fmt.Errorf("序列化状态字段失败: %w", err)
 	}
 
-	insertSQL := `INSERT INTO Node (Name, Token, Region, City, IP, Data, Status, Timestamp) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
-	err = SQLWrite(insertSQL, name, token, region, city, "", string(dataJSON), string(statusJSON), 0)
-	if err != nil {
-		return fmt.Errorf("插入数据失败: %w", err)
+	columns := "Name, Region, City, IP, Data, Status, Timestamp"
+	args := []interface{}{name, region, city, "", string(dataJSON), string(statusJSON), 0}
+	for key, value := range extra {
+		columns += ", " + key
+		args = append(args, value)
 	}
-	return nil
+
+	insertSQL := fmt.Sprintf("INSERT INTO Node (%s) VALUES (?%s)", columns, strings.Repeat(", ?", len(args)-1))
+	return insertSQL, args, nil
 }
 
 // UpdateNode 更新节点信息
@@ -169,6 +327,26 @@ func UpdateNode(id int, updates map[string]interface{}) error {
 	return nil
 }
 
+// ListNodes 获取所有节点的基本信息（不包含 Token）
+func ListNodes() ([]NodeInfo, error) {
+	rows, err := SQLRead("SELECT " + nodeInfoColumns + " FROM Node ORDER BY ID")
+	if err != nil {
+		return nil, err
+	}
+	defer dbMutex.RUnlock()
+	defer rows.Close()
+
+	nodes := []NodeInfo{}
+	for rows.Next() {
+		node, err := scanNodeInfo(rows)
+		if err != nil {
+			return nil, fmt.Errorf("读取节点失败: %w", err)
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
 // 创建表 Client
 func createClientTable() error {
 	dbMutex.Lock()
@@ -196,8 +374,68 @@ func WhoAreYou(key string) string {
 	return "前端"
 }
 
-// GetData 获取节点数据
+// GetData 获取节点数据，支持单条报告和批量报告
 func GetData(clientID int, data map[string]interface{}) error {
+	samples, err := parseSamples(data)
+	if err != nil {
+		return err
+	}
+
+	for _, sample := range samples {
+		if err := SaveHistory(clientID, sample, false); err != nil {
+			log.Printf("保存历史数据失败: %v\n", err)
+		}
+	}
+
+	return updateNodeData(clientID, mergeSamples(samples))
+}
+
+// parseSamples 解析报告中的采样，批量报告的采样位于 Batch 字段中
+func parseSamples(data map[string]interface{}) ([]map[string]interface{}, error) {
+	batchRaw, exists := data["Batch"]
+	if !exists {
+		return []map[string]interface{}{data}, nil
+	}
+
+	batch, ok := batchRaw.([]interface{})
+	if !ok || len(batch) == 0 {
+		return nil, fmt.Errorf("Batch 字段格式错误")
+	}
+
+	samples := make([]map[string]interface{}, 0, len(batch))
+	for _, raw := range batch {
+		sample, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Batch 中的采样格式错误")
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+// mergeSamples 以最后一个采样为准，补充此前采样中出现过的可选字段
+func mergeSamples(samples []map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{})
+	for key, value := range samples[len(samples)-1] {
+		merged[key] = value
+	}
+
+	for _, key := range []string{"Host", "Checks", "Containers", "Custom"} {
+		if _, exists := merged[key]; exists {
+			continue
+		}
+		for i := len(samples) - 2; i >= 0; i-- {
+			if value, exists := samples[i][key]; exists {
+				merged[key] = value
+				break
+			}
+		}
+	}
+	return merged
+}
+
+// updateNodeData 更新节点的实时数据
+func updateNodeData(clientID int, data map[string]interface{}) error {
 	var host, state string
 
 	// 提取并判断 Host 和 State，并确保它们是可以插入数据库的类型（字符串格式）
@@ -233,6 +471,40 @@ func GetData(clientID int, data map[string]interface{}) error {
 		return fmt.Errorf("State 字段缺失")
 	}
 
+	// 服务检查结果为可选字段，未配置检查的节点不会上报
+	var checks string
+	if checksRaw, exists := data["Checks"]; exists {
+		if checksList, ok := checksRaw.([]interface{}); ok {
+			checksBytes, err := json.Marshal(checksList)
+			if err == nil {
+				checks = string(checksBytes)
+			}
+			ProcessChecks(clientID, checksList)
+		}
+	}
+
+	// 容器信息为可选字段，未开启容器监控的节点不会上报
+	var containers string
+	if containersRaw, exists := data["Containers"]; exists {
+		if containersList, ok := containersRaw.([]interface{}); ok {
+			containersBytes, err := json.Marshal(containersList)
+			if err == nil {
+				containers = string(containersBytes)
+			}
+		}
+	}
+
+	// 自定义指标为可选字段，未配置自定义采集器的节点不会上报
+	var custom string
+	if customRaw, exists := data["Custom"]; exists {
+		if customMap, ok := customRaw.(map[string]interface{}); ok {
+			customBytes, err := json.Marshal(customMap)
+			if err == nil {
+				custom = string(customBytes)
+			}
+		}
+	}
+
 	// 更新数据库中的 Node 表，更新 Data、State 和 Timestamp
 	dbMutex.Lock()
 	updateSQL := `UPDATE Node 
@@ -241,9 +513,23 @@ func GetData(clientID int, data map[string]interface{}) error {
                            ELSE Data 
                          END, 
                   Status = ?, 
+                  Containers = CASE 
+                           WHEN ? THEN ? 
+                           ELSE Containers 
+                         END, 
+                  Checks = CASE 
+                           WHEN ? THEN ? 
+                           ELSE Checks 
+                         END, 
+                  Custom = CASE 
+                           WHEN ? THEN ? 
+                           ELSE Custom 
+                         END, 
                   Timestamp = strftime('%s', 'now') 
               WHERE ID = ?`
-	_, err := db.Exec(updateSQL, host != "", host, state, clientID)
+	start := time.Now()
+	_, err := db.Exec(updateSQL, host != "", host, state, containers != "", containers, checks != "", checks, custom != "", custom, clientID)
+	ObserveDBWrite(time.Since(start))
 	dbMutex.Unlock()
 	if err != nil {
 		//return fmt.Errorf("更新数据库失败: %w", err)
@@ -251,3 +537,17 @@ func GetData(clientID int, data map[string]interface{}) error {
 
 	return nil
 }
+
+// SaveProcess 保存节点上报的进程信息
+func SaveProcess(clientID int, data map[string]interface{}) error {
+	processBytes, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("Process 字段转换为 JSON 失败: %w", err)
+	}
+
+	err = SQLWrite("UPDATE Node SET Process = ? WHERE ID = ?", string(processBytes), clientID)
+	if err != nil {
+		return fmt.Errorf("更新进程信息失败: %w", err)
+	}
+	return nil
+}
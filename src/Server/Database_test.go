@@ -0,0 +1,19 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// newTestDatabase 在临时目录中创建数据库及主密钥，测试结束后关闭
+func newTestDatabase(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := LoadAuthSecret(filepath.Join(dir, "test.key")); err != nil {
+		t.Fatalf("LoadAuthSecret: %v", err)
+	}
+	if err := InitDatabase(DatabaseConfig{Type: "sqlite", FilePath: filepath.Join(dir, "test.db")}); err != nil {
+		t.Fatalf("InitDatabase: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+}
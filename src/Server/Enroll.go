@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// 注册码：管理员在控制台生成一次性的注册码，客户端使用 -enroll <注册码> 启动时自动添加节点并获取 Token
+// 注册码只保存哈希，在有效期内只能使用一次
+
+const (
+	defaultEnrollTTL = 3600      // 注册码默认有效期（秒）
+	maxEnrollTTL     = 7 * 86400 // 注册码最长有效期（秒）
+)
+
+var errEnrollInvalid = fmt.Errorf("注册码无效、已使用或已过期")
+
+const maxEnrollHost = 64 * 1024 // 注册时上报的主机信息的最大长度
+
+// 创建表 Enroll
+func createEnrollTable() error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS Enroll (
+		ID INTEGER PRIMARY KEY AUTOINCREMENT,
+		CodeHash TEXT NOT NULL UNIQUE,
+		Prefix TEXT,
+		CreatedAt INTEGER NOT NULL,
+		CreatedBy TEXT,
+		ExpireAt INTEGER NOT NULL,
+		UsedAt INTEGER,
+		UsedIP TEXT,
+		NodeName TEXT,
+		Region TEXT,
+		City TEXT,
+		Labels TEXT,
+		NodeGroups TEXT
+	);
+	`
+	return SQLWrite(createTableSQL)
+}
+
+// normalizeEnrollCode 忽略大小写、空白及分隔符
+func normalizeEnrollCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code)
+}
+
+// hashEnrollCode 注册码为高熵随机数，直接保存 sha256 即可按哈希查找
+func hashEnrollCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeEnrollCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateEnrollCode 生成注册码，节点注册时使用其中的地区、城市、标签和分组
+// ttl 为有效期（秒），返回注册码及失效时间
+func CreateEnrollCode(createdBy string, ttl int64, region, city string, labels map[string]string, groups []string) (string, int64, error) {
+	if ttl <= 0 {
+		ttl = defaultEnrollTTL
+	}
+	if ttl > maxEnrollTTL {
+		return "", 0, invalidField("TTL", fmt.Sprintf("有效期不能超过 %d 秒", maxEnrollTTL))
+	}
+	if err := validateText("Region", region, 64, false); err != nil {
+		return "", 0, err
+	}
+	if err := validateText("City", city, 64, false); err != nil {
+		return "", 0, err
+	}
+	if err := ValidateLabels(labels); err != nil {
+		return "", 0, err
+	}
+	groups, err := NormalizeGroups(groups)
+	if err != nil {
+		return "", 0, err
+	}
+
+	// 15 字节随机数，base32 编码后为 24 个字符，按 4 个一组以 - 分隔
+	raw := make([]byte, 15)
+	if _, err := rand.Read(raw); err != nil {
+		return "", 0, fmt.Errorf("生成注册码失败: %w", err)
+	}
+	encoded := base32.StdEncoding.EncodeToString(raw)
+	var parts []string
+	for i := 0; i < len(encoded); i += 4 {
+		parts = append(parts, encoded[i:i+4])
+	}
+	code := strings.Join(parts, "-")
+
+	now := time.Now().Unix()
+	expireAt := now + ttl
+	err = SQLWrite(`INSERT INTO Enroll (CodeHash, Prefix, CreatedAt, CreatedBy, ExpireAt, Region, City, Labels, NodeGroups)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		hashEnrollCode(code), parts[0], now, createdBy, expireAt, region, city, encodeLabels(labels), encodeGroups(groups))
+	if err != nil {
+		return "", 0, err
+	}
+	return code, expireAt, nil
+}
+
+// ListEnrollCodes 控制台查询注册码，不包含注册码本身，Prefix 为注册码的前 4 个字符
+func ListEnrollCodes(w http.ResponseWriter) {
+	rows, err := SQLRead(`SELECT ID, Prefix, CreatedAt, CreatedBy, ExpireAt, UsedAt, UsedIP, NodeName, Region, City, Labels, NodeGroups
+		FROM Enroll ORDER BY ID DESC LIMIT 1000`)
+	if err != nil {
+		http.Error(w, "内部错误：数据库查询失败", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().Unix()
+	codes := []map[string]interface{}{}
+	for rows.Next() {
+		var id int
+		var createdAt, expireAt int64
+		var usedAt *int64
+		var prefix, createdBy, usedIP, nodeName, region, city, labels, groups *string
+		if err := rows.Scan(&id, &prefix, &createdAt, &createdBy, &expireAt, &usedAt, &usedIP, &nodeName, &region, &city, &labels, &groups); err != nil {
+			continue
+		}
+		status := "active"
+		if usedAt != nil {
+			status = "used"
+		} else if expireAt < now {
+			status = "expired"
+		}
+		code := map[string]interface{}{
+			"ID":        id,
+			"Prefix":    stringValue(prefix),
+			"Status":    status,
+			"CreatedAt": createdAt,
+			"CreatedBy": stringValue(createdBy),
+			"ExpireAt":  expireAt,
+			"Region":    stringValue(region),
+			"City":      stringValue(city),
+			"Labels":    decodeLabels(labels),
+			"Groups":    decodeGroups(groups),
+		}
+		if usedAt != nil {
+			code["UsedAt"], code["UsedIP"], code["NodeName"] = *usedAt, stringValue(usedIP), stringValue(nodeName)
+		}
+		codes = append(codes, code)
+	}
+	rows.Close()
+	dbMutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(codes)
+}
+
+// DeleteEnrollCode 删除注册码，未使用的注册码随即失效
+func DeleteEnrollCode(id int) error {
+	dbMutex.Lock()
+	result, err := db.Exec("DELETE FROM Enroll WHERE ID = ?", id)
+	dbMutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("删除注册码失败: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return &APIError{Status: http.StatusNotFound, Code: "not_found", Message: "未找到注册码"}
+	}
+	return nil
+}
+
+// EnrollNode 使用注册码添加节点，以主机名作为节点名称（重名时添加序号），返回节点信息及新生成的 Token
+// host 为客户端检测到的主机信息，作为节点的初始 Data 保存，节点上线前即可在详情中查看
+func EnrollNode(code, hostname, ip string, host map[string]interface{}) (NodeInfo, string, error) {
+	hash := hashEnrollCode(code)
+	now := time.Now().Unix()
+
+	// 先标记为已使用，保证同一注册码并发使用时只有一个成功
+	dbMutex.Lock()
+	result, err := db.Exec("UPDATE Enroll SET UsedAt = ?, UsedIP = ? WHERE CodeHash = ? AND UsedAt IS NULL AND ExpireAt >= ?", now, ip, hash, now)
+	dbMutex.Unlock()
+	if err != nil {
+		return NodeInfo{}, "", fmt.Errorf("使用注册码失败: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return NodeInfo{}, "", errEnrollInvalid
+	}
+
+	node, token, err := enrollCreateNode(hash, hostname)
+	if err != nil {
+		// 添加失败时恢复注册码，允许重试
+		if err := SQLWrite("UPDATE Enroll SET UsedAt = NULL, UsedIP = NULL WHERE CodeHash = ?", hash); err != nil {
+			log.Printf("恢复注册码失败: %v\n", err)
+		}
+		return NodeInfo{}, "", err
+	}
+	if err := SQLWrite("UPDATE Enroll SET NodeName = ? WHERE CodeHash = ?", node.Name, hash); err != nil {
+		log.Printf("记录注册码使用情况失败: %v\n", err)
+	}
+	if hostJSON, err := json.Marshal(host); err == nil && len(host) > 0 && len(hostJSON) <= maxEnrollHost {
+		if err := SQLWrite("UPDATE Node SET Data = ? WHERE ID = ?", string(hostJSON), node.ID); err != nil {
+			log.Printf("保存节点 %s 的主机信息失败: %v\n", node.Name, err)
+		}
+	}
+	return node, token, nil
+}
+
+// enrollCreateNode 按注册码中的信息添加节点
+func enrollCreateNode(hash, hostname string) (NodeInfo, string, error) {
+	var prefix, region, city, labels, groups *string
+	dbMutex.RLock()
+	err := db.QueryRow("SELECT Prefix, Region, City, Labels, NodeGroups FROM Enroll WHERE CodeHash = ?", hash).
+		Scan(&prefix, &region, &city, &labels, &groups)
+	dbMutex.RUnlock()
+	if err != nil {
+		return NodeInfo{}, "", fmt.Errorf("读取注册码失败: %w", err)
+	}
+
+	name := strings.TrimSpace(hostname)
+	if name == "" {
+		name = "node-" + strings.ToLower(stringValue(prefix))
+	}
+	for utf8.RuneCountInString(name) > 56 {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	base := name
+	for i := 2; ; i++ {
+		exists, err := nodeNameExists(name, 0)
+		if err != nil {
+			return NodeInfo{}, "", fmt.Errorf("检查节点失败: %w", err)
+		}
+		if !exists {
+			break
+		}
+		name = fmt.Sprintf("%s-%d", base, i)
+	}
+
+	token, err := randomHex(24)
+	if err != nil {
+		return NodeInfo{}, "", err
+	}
+	node, err := CreateNode(NodeCreateRequest{
+		Name:   name,
+		Token:  token,
+		Region: stringValue(region),
+		City:   stringValue(city),
+		Labels: decodeLabels(labels),
+		Groups: decodeGroups(groups),
+	})
+	if err != nil {
+		return NodeInfo{}, "", err
+	}
+	return node, token, nil
+}
+
+// Enroll 处理客户端的注册请求，注册码无效时按登录失败计入频率限制
+func Enroll(conn *websocket.Conn, received map[string]interface{}, NodeIP, clientEncoding string) error {
+	code, _ := received["code"].(string)
+	hostname, _ := received["hostname"].(string)
+	host, _ := received["host"].(map[string]interface{})
+	if hostname == "" && host != nil {
+		hostname, _ = host["Hostname"].(string)
+	}
+	if code == "" {
+		return SendWS(conn, []byte(`{"status":3,"message":"注册码不能为空"}`), clientEncoding)
+	}
+
+	node, token, err := EnrollNode(code, hostname, NodeIP, host)
+	if err != nil {
+		RecordFailure(NodeIP, "节点登录")
+		if err == errEnrollInvalid {
+			log.Printf("%s 注册码无效", NodeIP)
+			return SendWS(conn, []byte(`{"status":2,"message":"注册码无效、已使用或已过期"}`), clientEncoding)
+		}
+		message, _ := json.Marshal(map[string]interface{}{"status": 3, "message": fmt.Sprintf("注册失败: %v", err)})
+		if err := SendWS(conn, message, clientEncoding); err != nil {
+			return err
+		}
+		return err
+	}
+	RecordSuccess(NodeIP)
+	AddEvent("enroll", NodeIP, fmt.Sprintf("节点 %s 使用注册码注册成功", node.Name))
+
+	// 注册结果使用单独的状态码，与欢迎消息区分
+	message, err := json.Marshal(map[string]interface{}{
+		"status":  7,
+		"message": "注册成功",
+		"data": map[string]interface{}{
+			"name":   node.Name,
+			"region": node.Region,
+			"city":   node.City,
+			"token":  token,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return SendWS(conn, message, clientEncoding)
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// forwardItem 等待转发的单个采样
+type forwardItem struct {
+	NodeID    int
+	TimeStamp int64
+	State     map[string]interface{}
+}
+
+// forwardLabels 转发时附加的节点标签
+type forwardLabels struct {
+	Name   string
+	Region string
+	City   string
+	Host   map[string]interface{}
+}
+
+var (
+	forwardQueue   chan forwardItem
+	forwardDropped atomic.Uint64 // 队列已满被丢弃的采样数
+
+	// 节点标签的缓存，只在 forwardWorker 中使用
+	forwardLabelCache map[int]forwardLabels
+	forwardLabelTime  time.Time
+)
+
+const (
+	forwardLabelTTL   = 60 * time.Second // 节点标签缓存的有效期
+	forwardLabelRetry = 5 * time.Second  // 批次中有未缓存的节点（新添加）时，重新读取的最小间隔
+)
+
+// StartForward 按配置启动转发协程，未配置时不转发
+func StartForward() {
+	if config.Forward.Type == "" {
+		return
+	}
+
+	forwardQueue = make(chan forwardItem, config.Forward.QueueSize)
+	go forwardWorker()
+	log.Printf("转发已开启: %s %s\n", config.Forward.Type, config.Forward.URL)
+}
+
+// Forward 将报告中的采样加入转发队列，队列已满时丢弃
+func Forward(nodeID int, data map[string]interface{}) {
+	if forwardQueue == nil {
+		return
+	}
+
+	samples, err := parseSamples(data)
+	if err != nil {
+		return
+	}
+
+	for _, sample := range samples {
+		state, ok := sample["State"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		item := forwardItem{NodeID: nodeID, TimeStamp: time.Now().Unix(), State: state}
+		if ts, ok := sample["TimeStamp"].(float64); ok && ts > 0 {
+			item.TimeStamp = int64(ts)
+		}
+
+		select {
+		case forwardQueue <- item:
+		default:
+			if forwardDropped.Add(1)%1000 == 1 {
+				log.Printf("转发队列已满，已丢弃 %d 条数据\n", forwardDropped.Load())
+			}
+		}
+	}
+}
+
+// forwardWorker 批量取出队列中的采样并发送
+func forwardWorker() {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	var batch []forwardItem
+	for {
+		select {
+		case item := <-forwardQueue:
+			batch = append(batch, item)
+			if len(batch) < config.Forward.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		sendForward(batch)
+		batch = nil
+	}
+}
+
+// sendForward 编码并发送一批采样，失败时按指数退避重试
+func sendForward(batch []forwardItem) {
+	labels, err := cachedForwardLabels(batch)
+	if err != nil {
+		log.Printf("转发读取节点信息失败: %v\n", err)
+		return
+	}
+
+	var body []byte
+	header := http.Header{}
+	switch config.Forward.Type {
+	case "influxdb":
+		body = encodeInfluxLines(batch, labels)
+		header.Set("Content-Type", "text/plain; charset=utf-8")
+	case "remote_write":
+		body = snappyEncode(encodeWriteRequest(batch, labels))
+		header.Set("Content-Type", "application/x-protobuf")
+		header.Set("Content-Encoding", "snappy")
+		header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	default:
+		log.Printf("不支持的转发类型: %s\n", config.Forward.Type)
+		return
+	}
+	for key, value := range config.Forward.Headers {
+		header.Set(key, value)
+	}
+
+	client := http.Client{Timeout: time.Duration(config.Forward.Timeout) * time.Second}
+	wait := time.Second
+	for attempt := 0; ; attempt++ {
+		err = postForward(&client, body, header)
+		if err == nil {
+			return
+		}
+		if attempt >= config.Forward.Retries {
+			log.Printf("转发 %d 条数据失败，已放弃: %v\n", len(batch), err)
+			return
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// postForward 发送一次请求，2xx 视为成功
+func postForward(client *http.Client, body []byte, header http.Header) error {
+	req, err := http.NewRequest(http.MethodPost, config.Forward.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header = header.Clone()
+	if config.Forward.Username != "" {
+		req.SetBasicAuth(config.Forward.Username, config.Forward.Password)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("响应状态 %s", resp.Status)
+	}
+	return nil
+}
+
+// cachedForwardLabels 返回缓存的节点标签，过期或批次中有未缓存的节点时重新读取
+func cachedForwardLabels(batch []forwardItem) (map[int]forwardLabels, error) {
+	age := time.Since(forwardLabelTime)
+	stale := forwardLabelCache == nil || age > forwardLabelTTL
+	if !stale && age > forwardLabelRetry {
+		for _, item := range batch {
+			if _, ok := forwardLabelCache[item.NodeID]; !ok {
+				stale = true
+				break
+			}
+		}
+	}
+	if !stale {
+		return forwardLabelCache, nil
+	}
+
+	labels, err := readForwardLabels()
+	if err != nil {
+		return nil, err
+	}
+	forwardLabelCache, forwardLabelTime = labels, time.Now()
+	return labels, nil
+}
+
+// readForwardLabels 读取所有节点的名称、地区、城市及主机信息
+func readForwardLabels() (map[int]forwardLabels, error) {
+	rows, err := SQLRead("SELECT ID, Name, Region, City, Data FROM Node")
+	if err != nil {
+		return nil, err
+	}
+	defer dbMutex.RUnlock()
+	defer rows.Close()
+
+	ret := make(map[int]forwardLabels)
+	for rows.Next() {
+		var id int
+		var name string
+		var region, city, hostData *string
+		if err := rows.Scan(&id, &name, &region, &city, &hostData); err != nil {
+			continue
+		}
+		l := forwardLabels{Name: name, Region: stringValue(region), City: stringValue(city)}
+		if hostData != nil {
+			json.Unmarshal([]byte(*hostData), &l.Host)
+		}
+		ret[id] = l
+	}
+	return ret, nil
+}
+
+// encodeInfluxLines 编码为 InfluxDB 行协议，每个采样一行，时间精度为纳秒
+// 字段名来自客户端上报，与标签值一样转义，包含换行或反斜杠的字段名不发送
+func encodeInfluxLines(batch []forwardItem, labels map[int]forwardLabels) []byte {
+	tagEscaper := strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+	var buf bytes.Buffer
+	for _, item := range batch {
+		l, ok := labels[item.NodeID]
+		if !ok {
+			continue // 节点已删除
+		}
+
+		keys := make([]string, 0, len(item.State))
+		for key, value := range item.State {
+			if key == "" || strings.ContainsAny(key, "\\\r\n") {
+				continue
+			}
+			if _, ok := value.(float64); ok {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		sort.Strings(keys)
+
+		fmt.Fprintf(&buf, "lightmonitor,name=%s", tagEscaper.Replace(l.Name))
+		if l.Region != "" {
+			fmt.Fprintf(&buf, ",region=%s", tagEscaper.Replace(l.Region))
+		}
+		if l.City != "" {
+			fmt.Fprintf(&buf, ",city=%s", tagEscaper.Replace(l.City))
+		}
+		for i, key := range keys {
+			sep := ","
+			if i == 0 {
+				sep = " "
+			}
+			fmt.Fprintf(&buf, "%s%s=%s", sep, tagEscaper.Replace(key), formatFloat(item.State[key].(float64)))
+		}
+		fmt.Fprintf(&buf, " %d\n", item.TimeStamp*int64(time.Second))
+	}
+	return buf.Bytes()
+}
+
+// encodeWriteRequest 编码为 Prometheus remote write 的 WriteRequest（protobuf）
+// 指标名称与 /metrics 导出的节点指标一致
+func encodeWriteRequest(batch []forwardItem, labels map[int]forwardLabels) []byte {
+	var req []byte
+	for _, item := range batch {
+		l, ok := labels[item.NodeID]
+		if !ok {
+			continue
+		}
+
+		for _, metric := range nodeMetrics {
+			source := item.State
+			if metric.Source == "Host" {
+				source = l.Host
+			}
+			value, ok := source[metric.Key].(float64)
+			if !ok {
+				continue
+			}
+
+			// TimeSeries: labels = 1, samples = 2
+			var series []byte
+			// 标签需按名称排序，空值的标签不发送
+			for _, label := range [][2]string{{"__name__", metric.Name}, {"city", l.City}, {"name", l.Name}, {"region", l.Region}} {
+				if label[1] == "" {
+					continue
+				}
+				var lb []byte
+				lb = appendProtoString(lb, 1, label[0])
+				lb = appendProtoString(lb, 2, label[1])
+				series = appendProtoBytes(series, 1, lb)
+			}
+			// Sample: value = 1 (double), timestamp = 2 (int64 毫秒)
+			var sample []byte
+			sample = binary.AppendUvarint(sample, 1<<3|1)
+			sample = binary.LittleEndian.AppendUint64(sample, math.Float64bits(value))
+			sample = binary.AppendUvarint(sample, 2<<3|0)
+			sample = binary.AppendUvarint(sample, uint64(item.TimeStamp*1000))
+			series = appendProtoBytes(series, 2, sample)
+
+			// WriteRequest: timeseries = 1
+			req = appendProtoBytes(req, 1, series)
+		}
+	}
+	return req
+}
+
+// appendProtoBytes 追加 length-delimited 字段
+func appendProtoBytes(b []byte, field int, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// appendProtoString 追加字符串字段
+func appendProtoString(b []byte, field int, s string) []byte {
+	return appendProtoBytes(b, field, []byte(s))
+}
+
+// snappyEncode 以 snappy 块格式编码，仅使用字面量（不压缩），所有解码器均可识别
+func snappyEncode(data []byte) []byte {
+	out := binary.AppendUvarint(nil, uint64(len(data)))
+	for len(data) > 0 {
+		n := min(len(data), 65536)
+		// 标签 61：字面量长度-1 以 2 字节小端存储
+		out = append(out, 61<<2, byte((n-1)&0xff), byte((n-1)>>8))
+		out = append(out, data[:n]...)
+		data = data[n:]
+	}
+	return out
+}
@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestEncodeInfluxLines(t *testing.T) {
+	labels := map[int]forwardLabels{1: {Name: "web 1", Region: "cn,east"}}
+	batch := []forwardItem{
+		{NodeID: 1, TimeStamp: 100, State: map[string]interface{}{
+			"CPU":          12.5,
+			"Load 1,x=1":   2.0,   // 客户端上报的字段名需要转义
+			"bad\nfield=1": 3.0,   // 包含换行的字段名不发送
+			"Hostname":     "web", // 非数值的字段不发送
+		}},
+		{NodeID: 2, TimeStamp: 100, State: map[string]interface{}{"CPU": 1.0}}, // 节点已删除
+	}
+
+	got := string(encodeInfluxLines(batch, labels))
+	want := `lightmonitor,name=web\ 1,region=cn\,east CPU=12.5,Load\ 1\,x\=1=2 100000000000` + "\n"
+	if got != want {
+		t.Errorf("行协议为\n%q\n应为\n%q", got, want)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	lastHistoryTime  = make(map[int]int64) // 节点ID -> 最近一条历史数据的时间戳
+	historyTimeMutex sync.Mutex
+)
+
+// 创建表 History
+func createHistoryTable() error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS History (
+		ID INTEGER PRIMARY KEY AUTOINCREMENT,
+		NodeID INTEGER NOT NULL,
+		TimeStamp INTEGER NOT NULL,
+		State TEXT
+	);
+	CREATE INDEX IF NOT EXISTS idx_history_node_time ON History (NodeID, TimeStamp);
+	`
+	return SQLWrite(createTableSQL)
+}
+
+// SaveHistory 按配置的间隔保存采样的状态，backfill 为 true 时不受实时数据的间隔限制
+// 采样时间不能晚于服务端时间，实时数据的采样时间也不能早于上一条，避免客户端时间错误时绕过间隔或写入未来的数据
+func SaveHistory(nodeID int, sample map[string]interface{}, backfill bool) error {
+	now := time.Now().Unix()
+	timestamp := now
+	if ts, ok := sample["TimeStamp"].(float64); ok && ts > 0 && int64(ts) < now {
+		timestamp = int64(ts)
+	}
+
+	if !backfill {
+		historyTimeMutex.Lock()
+		last := lastHistoryTime[nodeID]
+		if timestamp < last {
+			timestamp = last
+		}
+		if timestamp-last < int64(config.History.Interval) {
+			historyTimeMutex.Unlock()
+			return nil
+		}
+		lastHistoryTime[nodeID] = timestamp
+		historyTimeMutex.Unlock()
+	}
+
+	stateMap, ok := sample["State"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("State 字段缺失")
+	}
+	stateBytes, err := json.Marshal(stateMap)
+	if err != nil {
+		return fmt.Errorf("State 字段转换为 JSON 失败: %w", err)
+	}
+
+	return SQLWrite("INSERT INTO History (NodeID, TimeStamp, State) VALUES (?, ?, ?)", nodeID, timestamp, string(stateBytes))
+}
+
+// SaveBackfill 保存节点离线期间缓存的采样，只写入历史数据，不更新实时状态
+func SaveBackfill(nodeID int, data map[string]interface{}) error {
+	samples, err := parseSamples(data)
+	if err != nil {
+		return err
+	}
+
+	// 补发的采样按历史数据间隔抽样保存，从节点最近一条历史数据开始计算间隔，避免重连后重复保存
+	var lastSaved *int64
+	dbMutex.RLock()
+	err = db.QueryRow("SELECT MAX(TimeStamp) FROM History WHERE NodeID = ?", nodeID).Scan(&lastSaved)
+	dbMutex.RUnlock()
+	if err != nil {
+		return fmt.Errorf("读取历史数据失败: %w", err)
+	}
+	var last float64
+	if lastSaved != nil {
+		last = float64(*lastSaved)
+	}
+	saved := 0
+	for _, sample := range samples {
+		ts, _ := sample["TimeStamp"].(float64)
+		if ts <= 0 || ts-last < float64(config.History.Interval) {
+			continue
+		}
+		if err := SaveHistory(nodeID, sample, true); err != nil {
+			return err
+		}
+		last = ts
+		saved++
+	}
+
+	log.Printf("节点 %s 补发 %d 条数据，保存 %d 条\n", GetNameByID(nodeID), len(samples), saved)
+	return nil
+}
+
+// CleanHistory 定期删除过期的历史数据、安全事件、审计日志及注册码
+func CleanHistory() {
+	for {
+		cleanExpired("历史数据", "DELETE FROM History WHERE TimeStamp < ?", config.History.Days)
+		cleanExpired("安全事件", "DELETE FROM Event WHERE TimeStamp < ?", config.History.EventDays)
+		cleanExpired("审计日志", "DELETE FROM Audit WHERE TimeStamp < ?", config.History.AuditDays)
+		cleanExpired("注册码", "DELETE FROM Enroll WHERE COALESCE(UsedAt, ExpireAt) < ?", config.History.EnrollDays)
+		time.Sleep(1 * time.Hour)
+	}
+}
+
+// cleanExpired 删除超过保留天数的记录，query 的参数为过期时间，name 用于日志
+func cleanExpired(name, query string, days int) {
+	expire := time.Now().AddDate(0, 0, -days).Unix()
+	if err := SQLWrite(query, expire); err != nil {
+		log.Printf("清理%s失败: %v\n", name, err)
+	}
+}
@@ -0,0 +1,637 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// NodeRecord 导入导出的节点
+// 服务端只保存 Token 的哈希，导出时不包含 Token；导入新节点时需提供 Token，
+// 或提供导出认证信息时得到的 TokenHash、TokenSalt 和 AuthKey，节点无需更换 Token 即可迁移到新的服务端
+type NodeRecord struct {
+	Name       string            `yaml:"name" json:"Name"`
+	Token      string            `yaml:"token,omitempty" json:"Token,omitempty"`
+	TokenHash  string            `yaml:"token_hash,omitempty" json:"TokenHash,omitempty"`
+	TokenSalt  string            `yaml:"token_salt,omitempty" json:"TokenSalt,omitempty"`
+	AuthKey    string            `yaml:"auth_key,omitempty" json:"AuthKey,omitempty"` // 解密后的 AuthKey，导入时使用本服务端的主密钥加密
+	Region     string            `yaml:"region" json:"Region"`
+	City       string            `yaml:"city" json:"City"`
+	AllowedIPs []string          `yaml:"allowed_ips,omitempty" json:"AllowedIPs,omitempty"`
+	Labels     map[string]string `yaml:"labels,omitempty" json:"Labels,omitempty"`
+	Groups     []string          `yaml:"groups,omitempty" json:"Groups,omitempty"`
+}
+
+// ImportOptions 导入选项
+type ImportOptions struct {
+	DryRun     bool   // 只检查，不写入
+	OnConflict string // 名称已存在时：error（默认，整体失败）、skip（跳过）、update（覆盖地区、城市、标签等，提供 Token 时同时更换）
+}
+
+// ImportConflict 导入时的冲突或校验错误
+type ImportConflict struct {
+	Index   int // 在文件中的序号，从 1 开始
+	Name    string
+	Field   string
+	Message string
+}
+
+// ImportResult 导入结果
+type ImportResult struct {
+	DryRun    bool
+	Created   []string
+	Updated   []string
+	Skipped   []string
+	Conflicts []ImportConflict
+}
+
+var errImportConflict = &APIError{Status: http.StatusConflict, Code: "conflict", Message: "导入的节点存在冲突，未做任何修改"}
+
+// CSV 的列，列表以分号分隔，标签为 key=value;key2=value2
+var csvColumns = []string{"name", "token", "region", "city", "allowed_ips", "labels", "groups", "token_hash", "token_salt", "auth_key"}
+
+// ExportNodes 导出所有节点，credentials 为 true 时包含 Token 的哈希及 AuthKey
+// 包含认证信息的文件可以直接登录节点，需要妥善保管
+func ExportNodes(credentials bool) ([]NodeRecord, error) {
+	nodes, err := ListNodes()
+	if err != nil {
+		return nil, err
+	}
+	records := make([]NodeRecord, 0, len(nodes))
+	for _, node := range nodes {
+		records = append(records, NodeRecord{
+			Name:       node.Name,
+			Region:     node.Region,
+			City:       node.City,
+			AllowedIPs: node.AllowedIPs,
+			Labels:     node.Labels,
+			Groups:     node.Groups,
+		})
+	}
+	if !credentials {
+		return records, nil
+	}
+
+	rows, err := SQLRead("SELECT Name, Token, TokenSalt, AuthKey FROM Node")
+	if err != nil {
+		return nil, err
+	}
+	defer dbMutex.RUnlock()
+	defer rows.Close()
+
+	saved := make(map[string]NodeRecord)
+	for rows.Next() {
+		var name, hash string
+		var salt, authKey *string
+		if err := rows.Scan(&name, &hash, &salt, &authKey); err != nil {
+			return nil, fmt.Errorf("读取节点 Token 失败: %w", err)
+		}
+		// 主密钥更换后无法解密的 AuthKey 不导出，节点在新服务端使用旧版登录一次后重新保存
+		key, _ := openAuthKey(stringValue(authKey))
+		saved[name] = NodeRecord{TokenHash: hash, TokenSalt: stringValue(salt), AuthKey: key}
+	}
+	for i, record := range records {
+		if credential, ok := saved[record.Name]; ok {
+			records[i].TokenHash, records[i].TokenSalt, records[i].AuthKey = credential.TokenHash, credential.TokenSalt, credential.AuthKey
+		}
+	}
+	return records, nil
+}
+
+// FormatNodeRecords 将节点转换为 yaml、json 或 csv
+func FormatNodeRecords(format string, records []NodeRecord) ([]byte, error) {
+	switch format {
+	case "yaml", "yml":
+		return yaml.Marshal(records)
+	case "json":
+		return json.MarshalIndent(records, "", "  ")
+	case "csv":
+		var buffer bytes.Buffer
+		writer := csv.NewWriter(&buffer)
+		writer.Write(csvColumns)
+		for _, record := range records {
+			labels := make([]string, 0, len(record.Labels))
+			for key, value := range record.Labels {
+				labels = append(labels, key+"="+value)
+			}
+			sort.Strings(labels)
+			writer.Write([]string{
+				record.Name,
+				record.Token,
+				record.Region,
+				record.City,
+				strings.Join(record.AllowedIPs, ";"),
+				strings.Join(labels, ";"),
+				strings.Join(record.Groups, ";"),
+				record.TokenHash,
+				record.TokenSalt,
+				record.AuthKey,
+			})
+		}
+		writer.Flush()
+		return buffer.Bytes(), writer.Error()
+	}
+	return nil, fmt.Errorf("不支持的格式: %s，可选 yaml、json、csv", format)
+}
+
+// ParseNodeRecords 解析 yaml、json 或 csv 格式的节点
+func ParseNodeRecords(format string, data []byte) ([]NodeRecord, error) {
+	var records []NodeRecord
+	switch format {
+	case "yaml", "yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&records); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("解析 YAML 失败: %v", err)
+		}
+	case "json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&records); err != nil {
+			return nil, fmt.Errorf("解析 JSON 失败: %v", err)
+		}
+	case "csv":
+		return parseCSVRecords(data)
+	default:
+		return nil, fmt.Errorf("不支持的格式: %s，可选 yaml、json、csv", format)
+	}
+	return records, nil
+}
+
+// parseCSVRecords 解析 CSV，第一行为列名
+func parseCSVRecords(data []byte) ([]NodeRecord, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.TrimLeadingSpace = true
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("解析 CSV 失败: %v", err)
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	columns := make(map[string]int)
+	for i, column := range rows[0] {
+		column = strings.ToLower(strings.TrimSpace(column))
+		if !slices.Contains(csvColumns, column) {
+			return nil, fmt.Errorf("CSV 中有未知的列: %s", column)
+		}
+		columns[column] = i
+	}
+	if _, ok := columns["name"]; !ok {
+		return nil, fmt.Errorf("CSV 缺少 name 列")
+	}
+
+	split := func(value string) []string {
+		var list []string
+		for _, item := range strings.Split(value, ";") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		return list
+	}
+
+	records := make([]NodeRecord, 0, len(rows)-1)
+	for line, row := range rows[1:] {
+		get := func(column string) string {
+			if i, ok := columns[column]; ok && i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+		record := NodeRecord{
+			Name:       get("name"),
+			Token:      get("token"),
+			Region:     get("region"),
+			City:       get("city"),
+			AllowedIPs: split(get("allowed_ips")),
+			Groups:     split(get("groups")),
+			TokenHash:  get("token_hash"),
+			TokenSalt:  get("token_salt"),
+			AuthKey:    get("auth_key"),
+		}
+		for _, pair := range split(get("labels")) {
+			key, value, ok := strings.Cut(pair, "=")
+			if !ok {
+				return nil, fmt.Errorf("CSV 第 %d 行的标签格式错误: %s", line+2, pair)
+			}
+			if record.Labels == nil {
+				record.Labels = make(map[string]string)
+			}
+			record.Labels[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// validateRecord 与添加节点相同的校验，Token 是否必填在检查冲突时判断（更新已有节点时可以不提供）
+func validateRecord(record NodeRecord) error {
+	if err := validateText("Name", record.Name, 64, true); err != nil {
+		return err
+	}
+	if err := validateText("Token", record.Token, 256, false); err != nil {
+		return err
+	}
+	if err := validateText("Region", record.Region, 64, false); err != nil {
+		return err
+	}
+	if err := validateText("City", record.City, 64, false); err != nil {
+		return err
+	}
+	if err := validateCredentials(record); err != nil {
+		return err
+	}
+	return ValidateLabels(record.Labels)
+}
+
+// validateCredentials 校验导出的认证信息，TokenHash 与 Token 只能提供一个
+func validateCredentials(record NodeRecord) error {
+	if record.TokenHash == "" {
+		if record.TokenSalt != "" || record.AuthKey != "" {
+			return invalidField("TokenHash", "提供 TokenSalt 或 AuthKey 时 TokenHash 不能为空")
+		}
+		return nil
+	}
+	if record.Token != "" {
+		return invalidField("Token", "Token 与 TokenHash 不能同时提供")
+	}
+	if _, ok := nodeTokenIterations(record.TokenHash); !ok {
+		return invalidField("TokenHash", "TokenHash 格式错误，应为 pbkdf2-sha256$迭代次数$哈希")
+	}
+	if err := validateText("TokenSalt", record.TokenSalt, 64, true); err != nil {
+		return err
+	}
+	if record.AuthKey != "" {
+		if key, err := hex.DecodeString(record.AuthKey); err != nil || len(key) != sha256.Size {
+			return invalidField("AuthKey", "AuthKey 格式错误，应为 64 位十六进制")
+		}
+	}
+	return nil
+}
+
+// importPlan 校验后准备写入的一个节点
+type importPlan struct {
+	index      int // 在文件中的序号，从 0 开始
+	record     NodeRecord
+	id         int // 更新已有节点时的节点ID，为 0 时添加
+	allowedIPs string
+	groups     []string
+
+	owner       int                    // 获取写锁之前查找到的使用相同 Token 的节点
+	credentials map[string]interface{} // 获取写锁之前生成的认证信息列，见 importCredentials
+}
+
+// ImportNodes 导入节点，存在冲突时不做任何修改并返回 errImportConflict
+// 名称和 Token 的冲突检查与添加节点相同，文件内部的重复同样视为冲突；检查和写入在同一个事务中进行
+func ImportNodes(records []NodeRecord, options ImportOptions) (ImportResult, error) {
+	result := ImportResult{DryRun: options.DryRun, Created: []string{}, Updated: []string{}, Skipped: []string{}, Conflicts: []ImportConflict{}}
+	switch options.OnConflict {
+	case "":
+		options.OnConflict = "error"
+	case "error", "skip", "update":
+	default:
+		return result, invalidField("OnConflict", "OnConflict 只能为 error、skip 或 update")
+	}
+
+	conflict := func(index int, name, field, message string) {
+		result.Conflicts = append(result.Conflicts, ImportConflict{Index: index + 1, Name: name, Field: field, Message: message})
+	}
+
+	// 先完成不需要读取数据库的校验
+	var checked []importPlan
+	names := make(map[string]int)  // 文件中的名称 -> 序号
+	tokens := make(map[string]int) // 文件中的 Token 或 TokenHash -> 序号
+	for i, record := range records {
+		if err := validateRecord(record); err != nil {
+			var apiErr *APIError
+			errors.As(err, &apiErr)
+			conflict(i, record.Name, apiErr.Field, apiErr.Message)
+			continue
+		}
+		allowedIPs, err := allowedIPsValue(record.AllowedIPs)
+		if err != nil {
+			conflict(i, record.Name, "AllowedIPs", err.Error())
+			continue
+		}
+		groups, err := NormalizeGroups(record.Groups)
+		if err != nil {
+			conflict(i, record.Name, "Groups", err.Error())
+			continue
+		}
+
+		if j, ok := names[record.Name]; ok {
+			conflict(i, record.Name, "Name", fmt.Sprintf("与第 %d 个节点的名称重复", j+1))
+			continue
+		}
+		names[record.Name] = i
+		if token := record.Token + record.TokenHash; token != "" {
+			if j, ok := tokens[token]; ok {
+				conflict(i, record.Name, "Token", fmt.Sprintf("与第 %d 个节点的 Token 重复", j+1))
+				continue
+			}
+			tokens[token] = i
+		}
+		checked = append(checked, importPlan{index: i, record: record, allowedIPs: allowedIPs, groups: groups})
+	}
+
+	// PBKDF2 计算量较大，在获取写锁之前查找 Token 对应的节点并生成新的哈希，事务中只做相等比较
+	for k := range checked {
+		plan := &checked[k]
+		var err error
+		if plan.record.Token != "" {
+			if plan.owner, _, err = FindNodeByToken(plan.record.Token); err != nil {
+				return result, err
+			}
+		}
+		if !options.DryRun {
+			if plan.credentials, err = importCredentials(plan.record); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	// 与已有节点的冲突检查和写入在同一个事务中完成，期间不会有其他请求添加或修改节点
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return result, fmt.Errorf("开始事务失败: %w", err)
+	}
+	defer tx.Rollback()
+
+	var plans []importPlan
+	for _, plan := range checked {
+		i, record := plan.index, plan.record
+		var id int
+		err := tx.QueryRow("SELECT ID FROM Node WHERE Name = ?", record.Name).Scan(&id)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return result, fmt.Errorf("读取节点失败: %w", err)
+		}
+		if id > 0 {
+			switch options.OnConflict {
+			case "skip":
+				result.Skipped = append(result.Skipped, record.Name)
+				continue
+			case "error":
+				conflict(i, record.Name, "Name", "节点已存在，请不要使用相同的节点名称")
+				continue
+			}
+			plan.id = id
+		} else if record.Token == "" && record.TokenHash == "" {
+			conflict(i, record.Name, "Token", "Token 不能为空")
+			continue
+		}
+
+		existID, err := importTokenOwner(tx, plan)
+		if err != nil {
+			return result, err
+		}
+		if existID > 0 && existID != plan.id {
+			var name string
+			tx.QueryRow("SELECT Name FROM Node WHERE ID = ?", existID).Scan(&name)
+			conflict(i, record.Name, "Token", fmt.Sprintf("Token已被节点 %s 使用，请不要使用相同的Token", name))
+			continue
+		}
+		plans = append(plans, plan)
+	}
+
+	for _, plan := range plans {
+		if plan.id > 0 {
+			result.Updated = append(result.Updated, plan.record.Name)
+		} else {
+			result.Created = append(result.Created, plan.record.Name)
+		}
+	}
+	if len(result.Conflicts) > 0 {
+		sort.SliceStable(result.Conflicts, func(a, b int) bool { return result.Conflicts[a].Index < result.Conflicts[b].Index })
+		return result, errImportConflict
+	}
+	if options.DryRun || len(plans) == 0 {
+		return result, nil
+	}
+	if err := applyImport(tx, plans); err != nil {
+		return result, err
+	}
+	if err := tx.Commit(); err != nil {
+		return result, fmt.Errorf("提交事务失败: %w", err)
+	}
+	return result, nil
+}
+
+// importTokenOwner 在事务中查找已使用该 Token 的节点，未找到时返回 0
+// 明文 Token 比较 AuthKey，找到获取写锁之后使用相同 Token 添加或更换的节点，没有 AuthKey 的节点使用获取写锁之前的结果
+// 导入的 TokenHash 只能与保存的哈希直接比较，相同的哈希说明是同一个 Token
+func importTokenOwner(tx *sql.Tx, plan importPlan) (int, error) {
+	record := plan.record
+	if record.Token != "" {
+		rows, err := tx.Query("SELECT ID, AuthKey, OldAuthKey, OldTokenExpire FROM Node")
+		if err != nil {
+			return 0, fmt.Errorf("数据库读取失败: %w", err)
+		}
+		defer rows.Close()
+
+		authKey := []byte(nodeAuthKey(record.Token))
+		matches := func(stored *string) bool {
+			key, ok := openAuthKey(stringValue(stored))
+			return ok && hmac.Equal([]byte(key), authKey)
+		}
+		now := time.Now().Unix()
+		owner, ownerExists := 0, false
+		for rows.Next() {
+			var id int
+			var currentKey, oldKey *string
+			var oldExpire *int64
+			if err := rows.Scan(&id, &currentKey, &oldKey, &oldExpire); err != nil {
+				return 0, fmt.Errorf("读取节点认证信息失败: %w", err)
+			}
+			if matches(currentKey) || (oldExpire != nil && *oldExpire >= now && matches(oldKey)) {
+				owner = id
+			}
+			if id == plan.owner {
+				ownerExists = true
+			}
+		}
+		if owner == 0 && ownerExists {
+			owner = plan.owner
+		}
+		return owner, rows.Err()
+	}
+	if record.TokenHash == "" {
+		return 0, nil
+	}
+	var id int
+	err := tx.QueryRow("SELECT ID FROM Node WHERE Token = ? OR OldToken = ?", record.TokenHash, record.TokenHash).Scan(&id)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("数据库读取失败: %w", err)
+	}
+	return id, nil
+}
+
+// importCredentials 导入节点的认证信息列，没有提供 Token 或 TokenHash 时返回 nil
+func importCredentials(record NodeRecord) (map[string]interface{}, error) {
+	if record.Token != "" {
+		return nodeCredentials(record.Token)
+	}
+	if record.TokenHash == "" {
+		return nil, nil
+	}
+	// 没有 AuthKey 时节点需要使用旧版登录一次，之后重新保存
+	var authKey interface{}
+	if record.AuthKey != "" {
+		sealed, err := sealAuthKey(record.AuthKey)
+		if err != nil {
+			return nil, err
+		}
+		authKey = sealed
+	}
+	return map[string]interface{}{"Token": record.TokenHash, "TokenSalt": record.TokenSalt, "AuthKey": authKey}, nil
+}
+
+// applyImport 在检查冲突的事务中写入全部节点，由调用方提交，不计算哈希
+func applyImport(tx *sql.Tx, plans []importPlan) error {
+	for _, plan := range plans {
+		record := plan.record
+		fields := map[string]interface{}{
+			"AllowedIPs": plan.allowedIPs,
+			"Labels":     encodeLabels(record.Labels),
+			"NodeGroups": encodeGroups(plan.groups),
+		}
+		for key, value := range plan.credentials {
+			fields[key] = value
+		}
+
+		var query string
+		var args []interface{}
+		var err error
+		if plan.id == 0 {
+			query, args, err = nodeInsert(record.Name, record.Region, record.City, fields)
+			if err != nil {
+				return err
+			}
+		} else {
+			fields["Region"], fields["City"] = record.Region, record.City
+			if plan.credentials != nil {
+				// 更换 Token 时旧 Token 立即失效
+				fields["TokenID"] = nil
+				fields["OldToken"], fields["OldTokenSalt"], fields["OldTokenID"], fields["OldAuthKey"], fields["OldTokenExpire"] = nil, nil, nil, nil, nil
+			}
+			var sets []string
+			for key, value := range fields {
+				sets = append(sets, key+" = ?")
+				args = append(args, value)
+			}
+			query = fmt.Sprintf("UPDATE Node SET %s WHERE ID = ?", strings.Join(sets, ", "))
+			args = append(args, plan.id)
+		}
+
+		if _, err := tx.Exec(query, args...); err != nil {
+			return fmt.Errorf("导入节点 %s 失败: %w", record.Name, err)
+		}
+	}
+	return nil
+}
+
+// KickUpdatedNodes 导入时更换了 Token 的节点需要重新登录
+func KickUpdatedNodes(records []NodeRecord, result ImportResult) {
+	if result.DryRun {
+		return
+	}
+	for _, record := range records {
+		if (record.Token != "" || record.TokenHash != "") && slices.Contains(result.Updated, record.Name) {
+			if id, err := GetIDByName(record.Name); err == nil {
+				KickClient(id)
+			}
+		}
+	}
+}
+
+// RunCommand 执行命令行子命令 export 或 import
+func RunCommand(args []string) error {
+	command := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	format := command.String("format", "yaml", "文件格式：yaml、json 或 csv")
+	switch args[0] {
+	case "export":
+		output := command.String("o", "", "输出文件，默认为标准输出")
+		credentials := command.Bool("credentials", false, "包含 Token 的哈希及 AuthKey，用于迁移到新的服务端")
+		if err := command.Parse(args[1:]); err != nil {
+			return err
+		}
+		records, err := ExportNodes(*credentials)
+		if err != nil {
+			return err
+		}
+		data, err := FormatNodeRecords(*format, records)
+		if err != nil {
+			return err
+		}
+		if *output == "" {
+			_, err = os.Stdout.Write(data)
+			return err
+		}
+		if err := os.WriteFile(*output, data, 0600); err != nil {
+			return fmt.Errorf("写入文件失败: %w", err)
+		}
+		fmt.Fprintf(os.Stderr, "已导出 %d 个节点到 %s\n", len(records), *output)
+		return nil
+
+	case "import":
+		options := ImportOptions{}
+		command.BoolVar(&options.DryRun, "dry_run", false, "只检查，不写入")
+		command.StringVar(&options.OnConflict, "on_conflict", "error", "名称已存在时：error、skip 或 update")
+		if err := command.Parse(args[1:]); err != nil {
+			return err
+		}
+		if command.NArg() != 1 {
+			return fmt.Errorf("用法: import [-format yaml|json|csv] [-dry_run] [-on_conflict error|skip|update] 文件|-")
+		}
+
+		var data []byte
+		var err error
+		if path := command.Arg(0); path == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(path)
+		}
+		if err != nil {
+			return fmt.Errorf("读取文件失败: %w", err)
+		}
+		records, err := ParseNodeRecords(*format, data)
+		if err != nil {
+			return err
+		}
+
+		result, err := ImportNodes(records, options)
+		for _, conflict := range result.Conflicts {
+			fmt.Fprintf(os.Stderr, "第 %d 个节点 %s: %s (%s)\n", conflict.Index, conflict.Name, conflict.Message, conflict.Field)
+		}
+		if err != nil {
+			return err
+		}
+		prefix := "已导入"
+		if result.DryRun {
+			prefix = "试运行"
+		}
+		fmt.Fprintf(os.Stderr, "%s: 添加 %d 个，更新 %d 个，跳过 %d 个\n", prefix, len(result.Created), len(result.Updated), len(result.Skipped))
+		return nil
+	}
+	return fmt.Errorf("未知的子命令: %s，可选 export、import", args[0])
+}
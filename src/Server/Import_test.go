@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseNodeRecordsCSV(t *testing.T) {
+	data := "Name, TOKEN,region,allowed_ips,labels,groups\n" +
+		"web-1,t1,华东,10.0.0.0/8; 192.168.1.1,env=prod;rack = a1,web;;db\n" +
+		"web-2,,,,,\n"
+	records, err := ParseNodeRecords("csv", []byte(data))
+	if err != nil {
+		t.Fatalf("ParseNodeRecords: %v", err)
+	}
+	want := []NodeRecord{
+		{
+			Name:       "web-1",
+			Token:      "t1",
+			Region:     "华东",
+			AllowedIPs: []string{"10.0.0.0/8", "192.168.1.1"},
+			Labels:     map[string]string{"env": "prod", "rack": "a1"},
+			Groups:     []string{"web", "db"},
+		},
+		{Name: "web-2"},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("解析结果为\n%+v\n应为\n%+v", records, want)
+	}
+}
+
+func TestParseNodeRecordsError(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		data   string
+		want   string // 错误信息应包含的内容
+	}{
+		{name: "CSV 未知的列", format: "csv", data: "name,owner\nweb-1,ops\n", want: "owner"},
+		{name: "CSV 缺少 name 列", format: "csv", data: "token,region\nt1,华东\n", want: "name"},
+		{name: "CSV 标签格式错误", format: "csv", data: "name,labels\nweb-1,env=prod\nweb-2,env\n", want: "第 3 行"},
+		{name: "YAML 未知的字段", format: "yaml", data: "- name: web-1\n  owner: ops\n", want: "owner"},
+		{name: "JSON 未知的字段", format: "json", data: `[{"Name":"web-1","Owner":"ops"}]`, want: "Owner"},
+		{name: "不支持的格式", format: "xml", data: "", want: "xml"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := ParseNodeRecords(tt.format, []byte(tt.data))
+			if err == nil {
+				t.Fatalf("应返回错误，实际为 %+v", records)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("错误 %q 应包含 %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// importedNodes 返回数据库中所有节点的名称及地区
+func importedNodes(t *testing.T) map[string]string {
+	t.Helper()
+	rows, err := SQLRead("SELECT Name, Region FROM Node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := make(map[string]string)
+	for rows.Next() {
+		var name string
+		var region *string
+		if err := rows.Scan(&name, &region); err == nil {
+			nodes[name] = stringValue(region)
+		}
+	}
+	rows.Close()
+	dbMutex.RUnlock()
+	return nodes
+}
+
+// conflictFields 将冲突转换为 名称:字段 以便比较
+func conflictFields(conflicts []ImportConflict) []string {
+	fields := []string{}
+	for _, c := range conflicts {
+		fields = append(fields, c.Name+":"+c.Field)
+	}
+	return fields
+}
+
+func TestImportNodesConflicts(t *testing.T) {
+	newTestDatabase(t)
+	existing := []NodeRecord{{Name: "a", Token: "token-a", Region: "华东"}}
+	if _, err := ImportNodes(existing, ImportOptions{}); err != nil {
+		t.Fatalf("导入已有节点失败: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		records    []NodeRecord
+		onConflict string
+		conflicts  []string
+	}{
+		{
+			name:      "文件中名称重复",
+			records:   []NodeRecord{{Name: "b", Token: "token-b"}, {Name: "b", Token: "token-c"}},
+			conflicts: []string{"b:Name"},
+		},
+		{
+			name:      "文件中 Token 重复",
+			records:   []NodeRecord{{Name: "b", Token: "token-b"}, {Name: "c", Token: "token-b"}},
+			conflicts: []string{"c:Token"},
+		},
+		{
+			name:      "名称已存在",
+			records:   []NodeRecord{{Name: "a", Region: "华南"}, {Name: "b", Token: "token-b"}},
+			conflicts: []string{"a:Name"},
+		},
+		{
+			name:       "Token 已被其他节点使用",
+			records:    []NodeRecord{{Name: "b", Token: "token-a"}},
+			onConflict: "update",
+			conflicts:  []string{"b:Token"},
+		},
+		{
+			name:      "新节点缺少 Token",
+			records:   []NodeRecord{{Name: "b"}},
+			conflicts: []string{"b:Token"},
+		},
+		{
+			name:      "校验错误",
+			records:   []NodeRecord{{Name: "b", Token: "token-b", Labels: map[string]string{"group": "web"}}},
+			conflicts: []string{"b:Labels"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := ImportNodes(tt.records, ImportOptions{OnConflict: tt.onConflict})
+			if !errors.Is(err, errImportConflict) {
+				t.Fatalf("应返回冲突，实际为 %v", err)
+			}
+			if got := conflictFields(result.Conflicts); !reflect.DeepEqual(got, tt.conflicts) {
+				t.Errorf("冲突为 %v，应为 %v", got, tt.conflicts)
+			}
+			// 存在冲突时不写入任何节点
+			if nodes := importedNodes(t); !reflect.DeepEqual(nodes, map[string]string{"a": "华东"}) {
+				t.Errorf("存在冲突时修改了节点: %v", nodes)
+			}
+		})
+	}
+}
+
+func TestImportNodesOnConflict(t *testing.T) {
+	newTestDatabase(t)
+	existing := []NodeRecord{{Name: "a", Token: "token-a", Region: "华东"}}
+	if _, err := ImportNodes(existing, ImportOptions{}); err != nil {
+		t.Fatalf("导入已有节点失败: %v", err)
+	}
+	records := []NodeRecord{{Name: "a", Region: "华南"}, {Name: "b", Token: "token-b"}}
+
+	// 试运行只返回结果，不写入
+	result, err := ImportNodes(records, ImportOptions{DryRun: true, OnConflict: "update"})
+	if err != nil {
+		t.Fatalf("试运行失败: %v", err)
+	}
+	if !reflect.DeepEqual(result.Created, []string{"b"}) || !reflect.DeepEqual(result.Updated, []string{"a"}) {
+		t.Errorf("试运行结果错误: %+v", result)
+	}
+	if nodes := importedNodes(t); !reflect.DeepEqual(nodes, map[string]string{"a": "华东"}) {
+		t.Errorf("试运行修改了节点: %v", nodes)
+	}
+
+	result, err = ImportNodes(records, ImportOptions{OnConflict: "skip"})
+	if err != nil {
+		t.Fatalf("跳过已有节点导入失败: %v", err)
+	}
+	if !reflect.DeepEqual(result.Skipped, []string{"a"}) || !reflect.DeepEqual(result.Created, []string{"b"}) {
+		t.Errorf("跳过已有节点的结果错误: %+v", result)
+	}
+	if nodes := importedNodes(t); !reflect.DeepEqual(nodes, map[string]string{"a": "华东", "b": ""}) {
+		t.Errorf("跳过已有节点后的节点错误: %v", nodes)
+	}
+
+	// 更新已有节点时可以不提供 Token，使用自己的 Token 不算冲突
+	records = []NodeRecord{{Name: "a", Region: "华南"}, {Name: "b", Token: "token-b", Region: "华北"}}
+	result, err = ImportNodes(records, ImportOptions{OnConflict: "update"})
+	if err != nil {
+		t.Fatalf("更新已有节点导入失败: %v", err)
+	}
+	if !reflect.DeepEqual(result.Updated, []string{"a", "b"}) || len(result.Created) != 0 {
+		t.Errorf("更新已有节点的结果错误: %+v", result)
+	}
+	if nodes := importedNodes(t); !reflect.DeepEqual(nodes, map[string]string{"a": "华南", "b": "华北"}) {
+		t.Errorf("更新已有节点后的节点错误: %v", nodes)
+	}
+	if id, _, err := FindNodeByToken("token-a"); err != nil || id == 0 {
+		t.Errorf("未提供 Token 时不应更换节点的 Token: %d %v", id, err)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// 节点的自定义标签（键值对）和分组，保存为 JSON
+// 标签键同时作为 Prometheus 标签名（label_<键>），只允许字母、数字和下划线
+
+var labelKeyPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]{0,63}$`)
+
+// 选择器中表示分组及节点信息的键，不能用作标签名
+var reservedLabelKeys = []string{"group", "name", "region", "city"}
+
+// ValidateLabels 校验标签
+func ValidateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if !labelKeyPattern.MatchString(key) {
+			return invalidField("Labels", fmt.Sprintf("标签名 %q 只能包含字母、数字和下划线，且不能以数字开头", key))
+		}
+		if slices.Contains(reservedLabelKeys, key) {
+			return invalidField("Labels", fmt.Sprintf("标签名 %q 为保留字段（%s），请使用其他名称", key, strings.Join(reservedLabelKeys, "、")))
+		}
+		if utf8.RuneCountInString(value) > 128 {
+			return invalidField("Labels", fmt.Sprintf("标签 %s 的值不能超过 128 个字符", key))
+		}
+	}
+	return nil
+}
+
+// NormalizeGroups 校验分组名称，去除空白及重复项并排序
+func NormalizeGroups(groups []string) ([]string, error) {
+	result := []string{}
+	for _, group := range groups {
+		group = strings.TrimSpace(group)
+		if group == "" {
+			continue
+		}
+		if strings.ContainsAny(group, ",=!") || utf8.RuneCountInString(group) > 64 {
+			return nil, invalidField("Groups", fmt.Sprintf("分组 %q 不能包含 , = ! 且不能超过 64 个字符", group))
+		}
+		if !slices.Contains(result, group) {
+			result = append(result, group)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// encodeLabels 转换为保存到数据库的值，为空时返回空字符串
+func encodeLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(labels)
+	return string(data)
+}
+
+// encodeGroups 转换为保存到数据库的值，为空时返回空字符串
+func encodeGroups(groups []string) string {
+	if len(groups) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(groups)
+	return string(data)
+}
+
+// decodeLabels 解析数据库中的标签
+func decodeLabels(value *string) map[string]string {
+	labels := map[string]string{}
+	if stringValue(value) != "" {
+		json.Unmarshal([]byte(*value), &labels)
+	}
+	return labels
+}
+
+// decodeGroups 解析数据库中的分组
+func decodeGroups(value *string) []string {
+	groups := []string{}
+	if stringValue(value) != "" {
+		json.Unmarshal([]byte(*value), &groups)
+	}
+	return groups
+}
+
+// selectorTerm 选择器中的一个条件
+type selectorTerm struct {
+	key    string
+	value  string
+	op     string // =、!=、存在（空）或不存在（!）
+	source string // 原始文本
+}
+
+// Selector 节点选择器，多个条件以逗号分隔，需全部满足：
+//
+//	key=value   标签 key 的值为 value
+//	key!=value  标签 key 不存在或值不为 value
+//	key         存在标签 key
+//	!key        不存在标签 key
+//
+// 键 group 表示分组（group=web 即属于分组 web），name、region、city 表示节点的名称、地区和城市
+// 空选择器匹配所有节点
+type Selector []selectorTerm
+
+// ParseSelector 解析选择器
+func ParseSelector(text string) (Selector, error) {
+	var selector Selector
+	for _, part := range strings.Split(text, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		term := selectorTerm{source: part}
+		switch {
+		case strings.Contains(part, "!="):
+			term.key, term.value, _ = strings.Cut(part, "!=")
+			term.op = "!="
+		case strings.Contains(part, "="):
+			term.key, term.value, _ = strings.Cut(part, "=")
+			term.op = "="
+		case strings.HasPrefix(part, "!"):
+			term.key, term.op = part[1:], "!"
+		default:
+			term.key = part
+		}
+		term.key, term.value = strings.TrimSpace(term.key), strings.TrimSpace(term.value)
+		if term.key == "" {
+			return nil, fmt.Errorf("选择器格式错误: %s", part)
+		}
+		selector = append(selector, term)
+	}
+	return selector, nil
+}
+
+// String 返回选择器的文本
+func (s Selector) String() string {
+	parts := make([]string, len(s))
+	for i, term := range s {
+		parts[i] = term.source
+	}
+	return strings.Join(parts, ",")
+}
+
+// Match 判断节点是否满足选择器
+func (s Selector) Match(node NodeInfo) bool {
+	for _, term := range s {
+		var values []string
+		switch term.key {
+		case "group":
+			values = node.Groups
+		case "name":
+			values = []string{node.Name}
+		case "region":
+			values = []string{node.Region}
+		case "city":
+			values = []string{node.City}
+		default:
+			if value, ok := node.Labels[term.key]; ok {
+				values = []string{value}
+			}
+		}
+
+		var ok bool
+		switch term.op {
+		case "=":
+			ok = slices.Contains(values, term.value)
+		case "!=":
+			ok = !slices.Contains(values, term.value)
+		case "!":
+			ok = len(values) == 0
+		default:
+			ok = len(values) > 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
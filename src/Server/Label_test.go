@@ -0,0 +1,102 @@
+package main
+
+import "testing"
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    string // 解析后的文本
+		wantErr bool
+	}{
+		{text: "", want: ""},
+		{text: " env = prod , !gpu ,, group=web", want: "env = prod,!gpu,group=web"},
+		{text: "env!=", want: "env!="},
+		{text: "=prod", wantErr: true},
+		{text: "!", wantErr: true},
+		{text: "env,!=x", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			selector, err := ParseSelector(tt.text)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("应返回错误，实际为 %q", selector)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseSelector: %v", err)
+			}
+			if got := selector.String(); got != tt.want {
+				t.Errorf("选择器为 %q，应为 %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectorMatch(t *testing.T) {
+	node := NodeInfo{
+		Name:   "web-1",
+		Region: "华东",
+		Labels: map[string]string{"env": "prod", "gpu": ""},
+		Groups: []string{"db", "web"},
+	}
+	tests := []struct {
+		selector string
+		want     bool
+	}{
+		{selector: "", want: true},
+		{selector: "env=prod", want: true},
+		{selector: "env=dev"},
+		{selector: "env!=dev", want: true},
+		{selector: "env!=prod"},
+		{selector: "owner!=ops", want: true}, // 不存在的标签
+		{selector: "gpu", want: true},        // 值为空的标签也存在
+		{selector: "!gpu"},
+		{selector: "!owner", want: true},
+		{selector: "owner"},
+		{selector: "group=web", want: true},
+		{selector: "group=cache"},
+		{selector: "group!=cache", want: true},
+		{selector: "name=web-1,region=华东", want: true},
+		{selector: "city", want: true},  // 节点信息的键总是存在
+		{selector: "city=", want: true}, // 未设置的城市为空字符串
+		{selector: "region="},
+		{selector: "env=prod,group=cache"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			selector, err := ParseSelector(tt.selector)
+			if err != nil {
+				t.Fatalf("ParseSelector: %v", err)
+			}
+			if got := selector.Match(node); got != tt.want {
+				t.Errorf("Match 为 %v，应为 %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateLabels(t *testing.T) {
+	tests := []struct {
+		name    string
+		labels  map[string]string
+		wantErr bool
+	}{
+		{name: "正确", labels: map[string]string{"env": "prod", "_rack2": "a"}},
+		{name: "数字开头", labels: map[string]string{"2env": "prod"}, wantErr: true},
+		{name: "特殊字符", labels: map[string]string{"env-name": "prod"}, wantErr: true},
+		{name: "保留字段", labels: map[string]string{"group": "web"}, wantErr: true},
+		{name: "值过长", labels: map[string]string{"env": string(make([]rune, 129))}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateLabels(tt.labels); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateLabels 错误为 %v，wantErr 为 %v", err, tt.wantErr)
+			}
+		})
+	}
+}
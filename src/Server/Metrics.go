@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	reportsTotal atomic.Uint64 // 收到的报告总数
+	reportRate   atomic.Uint64 // 最近一分钟的报告速率（math.Float64bits）
+
+	dbWriteBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1} // 数据库写入耗时分桶（秒）
+	dbWriteCounts  = make([]uint64, len(dbWriteBuckets))
+	dbWriteSum     float64
+	dbWriteCount   uint64
+	dbWriteMutex   sync.Mutex
+)
+
+// nodeMetric 节点指标定义，Key 为 Host 或 State 中的字段
+type nodeMetric struct {
+	Name   string
+	Type   string
+	Help   string
+	Source string // Host 或 State
+	Key    string
+}
+
+// 节点指标，均来自节点最近一次上报的数据
+var nodeMetrics = []nodeMetric{
+	{"lightmonitor_node_cpu_usage_percent", "gauge", "CPU usage in percent.", "State", "CPU"},
+	{"lightmonitor_node_cpu_user_percent", "gauge", "CPU time spent in user mode in percent.", "State", "CPUUser"},
+	{"lightmonitor_node_cpu_system_percent", "gauge", "CPU time spent in kernel mode in percent.", "State", "CPUSystem"},
+	{"lightmonitor_node_cpu_iowait_percent", "gauge", "CPU time spent waiting for IO in percent.", "State", "CPUIowait"},
+	{"lightmonitor_node_cpu_steal_percent", "gauge", "CPU time stolen by the hypervisor in percent.", "State", "CPUSteal"},
+	{"lightmonitor_node_load1", "gauge", "1 minute load average.", "State", "Load1"},
+	{"lightmonitor_node_load5", "gauge", "5 minute load average.", "State", "Load5"},
+	{"lightmonitor_node_load15", "gauge", "15 minute load average.", "State", "Load15"},
+	{"lightmonitor_node_memory_total_bytes", "gauge", "Total memory in bytes.", "Host", "MemTotal"},
+	{"lightmonitor_node_memory_used_bytes", "gauge", "Used memory in bytes.", "State", "MemUsed"},
+	{"lightmonitor_node_swap_total_bytes", "gauge", "Total swap in bytes.", "Host", "SwapTotal"},
+	{"lightmonitor_node_swap_used_bytes", "gauge", "Used swap in bytes.", "State", "SwapUsed"},
+	{"lightmonitor_node_disk_total_bytes", "gauge", "Total disk space in bytes.", "Host", "DiskTotal"},
+	{"lightmonitor_node_disk_used_bytes", "gauge", "Used disk space in bytes.", "State", "DiskUsed"},
+	{"lightmonitor_node_network_receive_bytes_per_second", "gauge", "Network receive rate in bytes per second.", "State", "NetInSpeed"},
+	{"lightmonitor_node_network_transmit_bytes_per_second", "gauge", "Network transmit rate in bytes per second.", "State", "NetOutSpeed"},
+	{"lightmonitor_node_network_receive_bytes_total", "counter", "Total bytes received.", "State", "NetInTransfer"},
+	{"lightmonitor_node_network_transmit_bytes_total", "counter", "Total bytes transmitted.", "State", "NetOutTransfer"},
+	{"lightmonitor_node_network_receive_packets_total", "counter", "Total packets received.", "State", "PacketsRecv"},
+	{"lightmonitor_node_network_transmit_packets_total", "counter", "Total packets transmitted.", "State", "PacketsSent"},
+	{"lightmonitor_node_processes", "gauge", "Number of processes.", "State", "Processes"},
+	{"lightmonitor_node_tcp_connections", "gauge", "Number of TCP connections.", "State", "TCPConections"},
+	{"lightmonitor_node_udp_connections", "gauge", "Number of UDP connections.", "State", "UDPConnections"},
+	{"lightmonitor_node_boot_time_seconds", "gauge", "Node boot time as unix timestamp.", "Host", "BootTime"},
+}
+
+// metricsNode 导出指标时读取的节点数据
+type metricsNode struct {
+	Labels    string
+	Host      map[string]interface{}
+	State     map[string]interface{}
+	TimeStamp int64
+	Online    bool
+}
+
+// ObserveDBWrite 记录一次数据库写入耗时
+func ObserveDBWrite(d time.Duration) {
+	seconds := d.Seconds()
+	dbWriteMutex.Lock()
+	for i, bucket := range dbWriteBuckets {
+		if seconds <= bucket {
+			dbWriteCounts[i]++
+		}
+	}
+	dbWriteSum += seconds
+	dbWriteCount++
+	dbWriteMutex.Unlock()
+}
+
+// TrackReportRate 每 10 秒计算一次最近一分钟的报告速率
+func TrackReportRate() {
+	const window = 6 // 6 个 10 秒
+	history := make([]uint64, 0, window+1)
+	for {
+		history = append(history, reportsTotal.Load())
+		if len(history) > window+1 {
+			history = history[1:]
+		}
+		if len(history) > 1 {
+			rate := float64(history[len(history)-1]-history[0]) / float64((len(history)-1)*10)
+			reportRate.Store(math.Float64bits(rate))
+		}
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// Metrics 以 Prometheus 文本格式导出所有节点的最新状态及服务端自身指标
+func Metrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "请求方法不正确", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if config.MetricsToken != "" && r.Header.Get("Authorization") != "Bearer "+config.MetricsToken {
+		http.Error(w, "密钥不正确", http.StatusUnauthorized)
+		return
+	}
+
+	// 可通过 ?selector= 只导出部分节点，便于按分组拆分抓取任务
+	selector, err := ParseSelector(r.URL.Query().Get("selector"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	nodes, err := readMetricsNodes(selector)
+	if err != nil {
+		log.Printf("导出指标失败: %v\n", err)
+		http.Error(w, "内部错误：数据库查询失败", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeNodeMetrics(w, nodes)
+	writeServerMetrics(w)
+}
+
+// readMetricsNodes 读取满足选择器的节点的最新数据
+// 节点的自定义标签导出为 label_<标签名>，分组以逗号连接导出为 groups
+func readMetricsNodes(selector Selector) ([]metricsNode, error) {
+	online := make(map[string]bool)
+	activeMutex.Lock()
+	for _, clientInfo := range WSConnections {
+		if name, ok := clientInfo["name"].(string); ok {
+			online[name] = true
+		}
+	}
+	activeMutex.Unlock()
+
+	rows, err := SQLRead("SELECT Name, Region, City, Labels, NodeGroups, Data, Status, Timestamp FROM Node")
+	if err != nil {
+		return nil, err
+	}
+	defer dbMutex.RUnlock()
+	defer rows.Close()
+
+	var nodes []metricsNode
+	for rows.Next() {
+		var name string
+		var region, city, labelsData, groupsData, hostData, stateData *string
+		var node metricsNode
+		if err := rows.Scan(&name, &region, &city, &labelsData, &groupsData, &hostData, &stateData, &node.TimeStamp); err != nil {
+			continue
+		}
+		info := NodeInfo{Name: name, Region: stringValue(region), City: stringValue(city), Labels: decodeLabels(labelsData), Groups: decodeGroups(groupsData)}
+		if !selector.Match(info) {
+			continue
+		}
+
+		if hostData != nil {
+			json.Unmarshal([]byte(*hostData), &node.Host)
+		}
+		if stateData != nil {
+			json.Unmarshal([]byte(*stateData), &node.State)
+		}
+
+		labels := [][2]string{
+			{"name", name},
+			{"region", info.Region},
+			{"city", info.City},
+			{"groups", strings.Join(info.Groups, ",")},
+		}
+		keys := make([]string, 0, len(info.Labels))
+		for key := range info.Labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			labels = append(labels, [2]string{"label_" + key, info.Labels[key]})
+		}
+		node.Labels = formatLabels(labels)
+		node.Online = online[name]
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// writeNodeMetrics 输出节点指标，同一指标的所有样本必须连续输出
+func writeNodeMetrics(w io.Writer, nodes []metricsNode) {
+	writeHeader(w, "lightmonitor_node_up", "gauge", "Whether the node is currently connected.")
+	for _, node := range nodes {
+		up := 0
+		if node.Online {
+			up = 1
+		}
+		fmt.Fprintf(w, "lightmonitor_node_up%s %d\n", node.Labels, up)
+	}
+
+	writeHeader(w, "lightmonitor_node_last_report_timestamp_seconds", "gauge", "Unix timestamp of the last report.")
+	for _, node := range nodes {
+		fmt.Fprintf(w, "lightmonitor_node_last_report_timestamp_seconds%s %d\n", node.Labels, node.TimeStamp)
+	}
+
+	for _, metric := range nodeMetrics {
+		writeHeader(w, metric.Name, metric.Type, metric.Help)
+		for _, node := range nodes {
+			source := node.State
+			if metric.Source == "Host" {
+				source = node.Host
+			}
+			if value, ok := source[metric.Key].(float64); ok {
+				fmt.Fprintf(w, "%s%s %s\n", metric.Name, node.Labels, formatFloat(value))
+			}
+		}
+	}
+
+	writeHeader(w, "lightmonitor_node_cpu_core_usage_percent", "gauge", "Per-core CPU usage in percent.")
+	for _, node := range nodes {
+		cores, _ := node.State["CPUCores"].([]interface{})
+		for i, core := range cores {
+			if value, ok := core.(float64); ok {
+				labels := strings.TrimSuffix(node.Labels, "}") + fmt.Sprintf(`,core="%d"}`, i)
+				fmt.Fprintf(w, "lightmonitor_node_cpu_core_usage_percent%s %s\n", labels, formatFloat(value))
+			}
+		}
+	}
+}
+
+// writeServerMetrics 输出服务端自身指标
+func writeServerMetrics(w io.Writer) {
+	var nodes, dashboards int
+	activeMutex.Lock()
+	for _, clientInfo := range WSConnections {
+		switch clientInfo["Type"] {
+		case "节点":
+			nodes++
+		case "广播":
+			dashboards++
+		}
+	}
+	activeMutex.Unlock()
+
+	writeHeader(w, "lightmonitor_connected_nodes", "gauge", "Number of connected node websockets.")
+	fmt.Fprintf(w, "lightmonitor_connected_nodes %d\n", nodes)
+
+	writeHeader(w, "lightmonitor_connected_dashboards", "gauge", "Number of connected dashboard websockets.")
+	fmt.Fprintf(w, "lightmonitor_connected_dashboards %d\n", dashboards)
+
+	writeHeader(w, "lightmonitor_reports_total", "counter", "Total number of reports received from nodes.")
+	fmt.Fprintf(w, "lightmonitor_reports_total %d\n", reportsTotal.Load())
+
+	writeHeader(w, "lightmonitor_report_rate", "gauge", "Reports received per second over the last minute.")
+	fmt.Fprintf(w, "lightmonitor_report_rate %s\n", formatFloat(math.Float64frombits(reportRate.Load())))
+
+	dbWriteMutex.Lock()
+	writeHeader(w, "lightmonitor_db_write_duration_seconds", "histogram", "Database write latency in seconds.")
+	for i, bucket := range dbWriteBuckets {
+		fmt.Fprintf(w, "lightmonitor_db_write_duration_seconds_bucket{le=\"%s\"} %d\n", formatFloat(bucket), dbWriteCounts[i])
+	}
+	fmt.Fprintf(w, "lightmonitor_db_write_duration_seconds_bucket{le=\"+Inf\"} %d\n", dbWriteCount)
+	fmt.Fprintf(w, "lightmonitor_db_write_duration_seconds_sum %s\n", formatFloat(dbWriteSum))
+	fmt.Fprintf(w, "lightmonitor_db_write_duration_seconds_count %d\n", dbWriteCount)
+	dbWriteMutex.Unlock()
+}
+
+// writeHeader 输出指标的 HELP 和 TYPE
+func writeHeader(w io.Writer, name, metricType, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// formatLabels 生成标签字符串，并转义标签值
+func formatLabels(labels [][2]string) string {
+	pairs := make([]string, 0, len(labels))
+	for _, label := range labels {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(label[1])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, label[0], value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// formatFloat 格式化数值，避免大整数使用科学计数法
+func formatFloat(value float64) string {
+	if value == math.Trunc(value) && math.Abs(value) < 1e15 {
+		return fmt.Sprintf("%d", int64(value))
+	}
+	return fmt.Sprintf("%g", value)
+}
+
+// stringValue 返回字符串指针的值，nil 返回空字符串
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -3,16 +3,24 @@ package main
 import (
 	"encoding/json"
 	"log"
+	"net/http"
 	"sync"
 	"time"
 )
 
 var (
-	isBroad   bool       = false // 决定是否运行 FetchData 内部逻辑
-	BroadData string             // 准备发送的数据
-	mutex     sync.Mutex         // 保证多协程下的安全操作
+	isBroad      bool          = false // 决定是否运行 FetchData 内部逻辑
+	BroadData    string                // 准备发送的数据
+	broadServers []broadServer         // 准备发送的各节点数据，用于按订阅的选择器筛选
+	mutex        sync.Mutex            // 保证多协程下的安全操作
 )
 
+// broadServer 广播中的一个节点
+type broadServer struct {
+	Node NodeInfo
+	Data map[string]interface{}
+}
+
 // FetchData 整理 Node 表数据
 func FetchData() {
 	for {
@@ -27,20 +35,20 @@ func FetchData() {
 		mutex.Unlock()
 
 		// 读取 Node 表数据
-		rows, err := SQLRead("SELECT Data, Status, TimeStamp, Name, Region, City FROM Node")
+		rows, err := SQLRead("SELECT Data, Status, Checks, Custom, TimeStamp, Name, Region, City, Labels, NodeGroups FROM Node")
 		if err != nil {
 			log.Printf("查询 Node 表失败: %v\n", err)
-		}
-		if err != nil {
+			continue
 		}
 
 		var servers []map[string]interface{}
+		var nodes []broadServer
 		for rows.Next() {
 			var hostData, stateData string
 			var timestamp int64
-			var name, region, city *string
+			var name, region, city, checksData, customData, labelsData, groupsData *string
 
-			if err := rows.Scan(&hostData, &stateData, &timestamp, &name, &region, &city); err != nil {
+			if err := rows.Scan(&hostData, &stateData, &checksData, &customData, &timestamp, &name, &region, &city, &labelsData, &groupsData); err != nil {
 				//log.Printf("读取行数据失败: %v\n", err)
 				continue
 			}
@@ -54,16 +62,34 @@ func FetchData() {
 				//log.Printf("解析 State 数据失败: %v\n", err)
 			}
 
+			labels, groups := decodeLabels(labelsData), decodeGroups(groupsData)
 			host["Name"] = name
 			host["Region"] = region
 			host["City"] = city
+			host["Labels"] = labels
+			host["Groups"] = groups
+
+			checks := []interface{}{}
+			if checksData != nil {
+				json.Unmarshal([]byte(*checksData), &checks)
+			}
+			custom := map[string]interface{}{}
+			if customData != nil {
+				json.Unmarshal([]byte(*customData), &custom)
+			}
 
 			server := map[string]interface{}{
 				"Host":      host,
 				"State":     state,
+				"Checks":    checks,
+				"Custom":    custom,
 				"TimeStamp": timestamp,
 			}
 			servers = append(servers, server)
+			nodes = append(nodes, broadServer{
+				Node: NodeInfo{Name: stringValue(name), Region: stringValue(region), City: stringValue(city), Labels: labels, Groups: groups},
+				Data: server,
+			})
 		}
 		rows.Close()
 		dbMutex.RUnlock()
@@ -81,6 +107,158 @@ func FetchData() {
 		// 更新全局变量 BroadData
 		mutex.Lock()
 		BroadData = string(dataJSON)
+		broadServers = nodes
 		mutex.Unlock()
 	}
 }
+
+// SelectBroadData 生成只包含满足选择器的节点的广播数据，cache 以选择器文本缓存同一轮广播中的结果
+func SelectBroadData(selector Selector, cache map[string][]byte) []byte {
+	key := selector.String()
+	if data, ok := cache[key]; ok {
+		return data
+	}
+
+	mutex.Lock()
+	servers := []map[string]interface{}{}
+	for _, server := range broadServers {
+		if selector.Match(server.Node) {
+			servers = append(servers, server.Data)
+		}
+	}
+	mutex.Unlock()
+
+	data, err := json.Marshal(map[string]interface{}{
+		"Servers":   servers,
+		"Timestamp": time.Now().Unix(),
+	})
+	if err != nil {
+		return nil
+	}
+	cache[key] = data
+	return data
+}
+
+// Detail 返回单个节点的详细信息（包含不参与广播的进程和容器信息）
+// 进程的用户和命令行可能包含密码等敏感信息，只返回给携带 Authorization: Bearer <密钥> 的控制台用户
+func Detail(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET")
+	w.Header().Set("Access-Control-Allow-Headers", "*, Authorization")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "请求方法不正确", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "未指定节点名称", http.StatusBadRequest)
+		return
+	}
+
+	// 携带密钥时校验，密钥错误按认证失败计入频率限制
+	showProcess := false
+	if r.Header.Get("Authorization") != "" {
+		ip, _ := RealIP(r)
+		if ok, wait := CheckLimit(ip, "控制台"); !ok {
+			LimitError(w, wait)
+			return
+		}
+		user, err := Authenticate(r, "")
+		if err != nil {
+			RecordFailure(ip, "控制台")
+			http.Error(w, "认证失败", http.StatusUnauthorized)
+			return
+		}
+		RecordSuccess(ip)
+		showProcess = user.Can("Detail")
+	}
+
+	rows, err := SQLRead("SELECT Data, Status, Process, Containers, Timestamp, Region, City, Labels, NodeGroups FROM Node WHERE Name = ?", name)
+	if err != nil {
+		log.Printf("查询节点 %s 详情失败: %v\n", name, err)
+		http.Error(w, "内部错误：数据库查询失败", http.StatusInternalServerError)
+		return
+	}
+
+	var hostData, stateData, processData, containersData, region, city, labels, groups *string
+	var timestamp int64
+	found := rows.Next()
+	if found {
+		err = rows.Scan(&hostData, &stateData, &processData, &containersData, &timestamp, &region, &city, &labels, &groups)
+	}
+	rows.Close()
+	dbMutex.RUnlock()
+
+	if !found {
+		http.Error(w, "未找到节点", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("读取节点 %s 详情失败: %v\n", name, err)
+		http.Error(w, "内部错误：读取节点失败", http.StatusInternalServerError)
+		return
+	}
+
+	host := map[string]interface{}{}
+	state := map[string]interface{}{}
+	var process, containers interface{}
+	if hostData != nil {
+		json.Unmarshal([]byte(*hostData), &host)
+	}
+	if stateData != nil {
+		json.Unmarshal([]byte(*stateData), &state)
+	}
+	if processData != nil {
+		json.Unmarshal([]byte(*processData), &process)
+		if !showProcess {
+			redactProcess(process)
+		}
+	}
+	if containersData != nil {
+		json.Unmarshal([]byte(*containersData), &containers)
+	}
+
+	host["Name"] = name
+	host["Region"] = region
+	host["City"] = city
+	host["Labels"] = decodeLabels(labels)
+	host["Groups"] = decodeGroups(groups)
+
+	detail := map[string]interface{}{
+		"Host":       host,
+		"State":      state,
+		"Process":    process,
+		"Containers": containers,
+		"TimeStamp":  timestamp,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(detail)
+}
+
+// redactProcess 去除进程列表中的用户和命令行
+func redactProcess(process interface{}) {
+	lists, ok := process.(map[string]interface{})
+	if !ok {
+		return
+	}
+	for _, list := range lists {
+		entries, ok := list.([]interface{})
+		if !ok {
+			continue
+		}
+		for _, entry := range entries {
+			if fields, ok := entry.(map[string]interface{}); ok {
+				delete(fields, "User")
+				delete(fields, "Cmdline")
+			}
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var trustedProxies []*net.IPNet // 可信代理，只有来自这些地址的 X-Forwarded-For、X-Real-IP 和 PROXY 协议头才会被采信
+
+// InitTrustedProxies 解析配置中的可信代理，支持 CIDR 或单个 IP
+func InitTrustedProxies() error {
+	trustedProxies = nil
+	for _, entry := range config.TrustedProxies {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return fmt.Errorf("可信代理格式错误: %s", entry)
+			}
+			if ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return fmt.Errorf("可信代理格式错误: %s", entry)
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+	return nil
+}
+
+// isTrustedProxy 判断地址是否为可信代理
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIP 解析地址，去除端口、方括号及 IPv6 zone，IPv4 映射的 IPv6 地址转换为 IPv4
+func parseIP(addr string) net.IP {
+	addr = strings.TrimSpace(addr)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	addr = strings.Trim(addr, "[]")
+	if i := strings.Index(addr, "%"); i >= 0 {
+		addr = addr[:i]
+	}
+	ip := net.ParseIP(addr)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// NormalizeIP 返回地址的标准形式，无法解析时返回空字符串
+func NormalizeIP(addr string) string {
+	ip := parseIP(addr)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// RealIP 获取客户端真实地址及来源
+// 只有直接连接的地址为可信代理时才解析 X-Forwarded-For（从右向左跳过可信代理）和 X-Real-IP
+func RealIP(r *http.Request) (string, string) {
+	peer := parseIP(r.RemoteAddr)
+	if peer == nil {
+		return "", ""
+	}
+	if !isTrustedProxy(peer) {
+		return peer.String(), "RemoteIP"
+	}
+
+	if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+		hops := strings.Split(strings.Join(values, ","), ",")
+		var client net.IP
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := parseIP(hops[i])
+			if ip == nil {
+				break // 格式错误的地址之前的内容均不可信
+			}
+			client = ip
+			if !isTrustedProxy(ip) {
+				break
+			}
+		}
+		if client != nil {
+			return client.String(), "X-Forwarded-For"
+		}
+	}
+
+	if ip := parseIP(r.Header.Get("X-Real-IP")); ip != nil {
+		return ip.String(), "X-Real-IP"
+	}
+	return peer.String(), "RemoteIP"
+}
+
+// proxyListener 支持 PROXY 协议 v1/v2 的监听器，仅采信来自可信代理的协议头
+type proxyListener struct {
+	net.Listener
+}
+
+// NewProxyListener 包装监听器，使连接的 RemoteAddr 返回 PROXY 协议头中的客户端地址
+func NewProxyListener(listener net.Listener) net.Listener {
+	return &proxyListener{Listener: listener}
+}
+
+// Accept 不在此处读取协议头，避免慢速连接阻塞其他连接
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn 在首次读取或获取地址时解析 PROXY 协议头
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.remote = c.Conn.RemoteAddr()
+		tcpAddr, ok := c.remote.(*net.TCPAddr)
+		if !ok || !isTrustedProxy(parseIP(tcpAddr.IP.String())) {
+			return
+		}
+
+		c.Conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		addr, err := readProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			log.Printf("%s PROXY 协议头解析失败: %v\n", c.remote, err)
+			c.err = err
+			return
+		}
+		if addr != nil {
+			c.remote = addr
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+// PROXY 协议 v2 的签名
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// readProxyHeader 读取 PROXY 协议头，返回客户端地址，LOCAL 或 UNKNOWN 时返回 nil
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	peek, err := reader.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("读取协议头失败: %v", err)
+	}
+
+	if bytes.Equal(peek, proxyV2Signature) {
+		return readProxyV2(reader)
+	}
+	if bytes.HasPrefix(peek, []byte("PROXY ")) {
+		return readProxyV1(reader)
+	}
+	return nil, fmt.Errorf("缺少 PROXY 协议头")
+}
+
+// readProxyV1 解析文本格式：PROXY TCP4 源地址 目标地址 源端口 目标端口\r\n
+func readProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 { // 协议规定的最大长度
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("v1 协议头过长")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("v1 协议头格式错误")
+	}
+	ip := parseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("v1 协议头地址错误")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 解析二进制格式
+func readProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("v2 协议版本错误")
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+
+	// LOCAL 命令为代理自身的健康检查等，使用连接地址
+	if header[12]&0x0f == 0 {
+		return nil, nil
+	}
+
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("v2 地址长度错误")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("v2 地址长度错误")
+		}
+		return &net.TCPAddr{IP: parseIP(net.IP(payload[0:16]).String()), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		return nil, nil
+	}
+}
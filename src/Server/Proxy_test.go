@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyV1(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    string // 为空时应返回 nil 地址
+		wantErr bool
+	}{
+		{name: "TCP4", header: "PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\n", want: "203.0.113.7:51234"},
+		{name: "TCP6", header: "PROXY TCP6 2001:db8::1 2001:db8::2 8080 443\r\n", want: "[2001:db8::1]:8080"},
+		{name: "UNKNOWN", header: "PROXY UNKNOWN\r\n"},
+		{name: "服务名端口", header: "PROXY TCP4 203.0.113.7 10.0.0.1 http 443\r\n", wantErr: true},
+		{name: "端口超出范围", header: "PROXY TCP4 203.0.113.7 10.0.0.1 70000 443\r\n", wantErr: true},
+		{name: "负数端口", header: "PROXY TCP4 203.0.113.7 10.0.0.1 -1 443\r\n", wantErr: true},
+		{name: "地址错误", header: "PROXY TCP4 example.com 10.0.0.1 1234 443\r\n", wantErr: true},
+		{name: "字段数量错误", header: "PROXY TCP4 203.0.113.7 10.0.0.1 1234\r\n", wantErr: true},
+		{name: "协议错误", header: "PROXY UDP4 203.0.113.7 10.0.0.1 1234 443\r\n", wantErr: true},
+		{name: "缺少 CRLF", header: "PROXY TCP4 203.0.113.7 10.0.0.1 1234 443\n", wantErr: true},
+		{name: "协议头过长", header: "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, err := readProxyV1(bufio.NewReader(strings.NewReader(tt.header + "GET / HTTP/1.1\r\n")))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("应返回错误，实际地址为 %v", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readProxyV1: %v", err)
+			}
+			if got := addrString(addr); got != tt.want {
+				t.Errorf("地址为 %q，应为 %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// proxyV2Header 生成 v2 协议头，command 为版本及命令，family 为地址族及协议
+func proxyV2Header(command, family byte, payload []byte) []byte {
+	header := []byte("\r\n\r\n\x00\r\nQUIT\n")
+	header = append(header, command, family, byte(len(payload)>>8), byte(len(payload)))
+	return append(header, payload...)
+}
+
+func TestReadProxyV2(t *testing.T) {
+	ipv4 := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0xc8, 0x22, 0x01, 0xbb}
+	ipv6 := append(append(append([]byte{}, bytes.Repeat([]byte{0}, 10)...), 0xff, 0xff, 203, 0, 113, 8), bytes.Repeat([]byte{0}, 16)...)
+	ipv6 = append(ipv6, 0x1f, 0x90, 0x01, 0xbb)
+
+	tests := []struct {
+		name    string
+		header  []byte
+		want    string
+		wantErr bool
+	}{
+		{name: "TCP over IPv4", header: proxyV2Header(0x21, 0x11, ipv4), want: "203.0.113.7:51234"},
+		{name: "IPv4 映射的 IPv6", header: proxyV2Header(0x21, 0x21, ipv6), want: "203.0.113.8:8080"},
+		{name: "LOCAL 命令", header: proxyV2Header(0x20, 0x11, ipv4)},
+		{name: "UDP 不处理", header: proxyV2Header(0x21, 0x12, ipv4)},
+		{name: "版本错误", header: proxyV2Header(0x11, 0x11, ipv4), wantErr: true},
+		{name: "IPv4 地址长度错误", header: proxyV2Header(0x21, 0x11, ipv4[:8]), wantErr: true},
+		{name: "IPv6 地址长度错误", header: proxyV2Header(0x21, 0x21, ipv4), wantErr: true},
+		{name: "数据不完整", header: proxyV2Header(0x21, 0x11, ipv4)[:20], wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, err := readProxyV2(bufio.NewReader(bytes.NewReader(tt.header)))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("应返回错误，实际地址为 %v", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readProxyV2: %v", err)
+			}
+			if got := addrString(addr); got != tt.want {
+				t.Errorf("地址为 %q，应为 %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	saved := config.TrustedProxies
+	config.TrustedProxies = []string{"10.0.0.0/8", "2001:db8::1"}
+	if err := InitTrustedProxies(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		config.TrustedProxies = saved
+		InitTrustedProxies()
+	})
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string][]string
+		want       string
+		wantSource string
+	}{
+		{name: "直接连接", remoteAddr: "203.0.113.7:1234", want: "203.0.113.7", wantSource: "RemoteIP"},
+		{name: "不可信来源的 X-Forwarded-For", remoteAddr: "203.0.113.7:1234",
+			headers: map[string][]string{"X-Forwarded-For": {"198.51.100.1"}}, want: "203.0.113.7", wantSource: "RemoteIP"},
+		{name: "可信代理", remoteAddr: "10.0.0.1:1234",
+			headers: map[string][]string{"X-Forwarded-For": {"198.51.100.1"}}, want: "198.51.100.1", wantSource: "X-Forwarded-For"},
+		{name: "伪造的最左侧地址", remoteAddr: "10.0.0.1:1234",
+			headers: map[string][]string{"X-Forwarded-For": {"1.1.1.1, 198.51.100.1, 10.0.0.2"}}, want: "198.51.100.1", wantSource: "X-Forwarded-For"},
+		{name: "多个请求头", remoteAddr: "10.0.0.1:1234",
+			headers: map[string][]string{"X-Forwarded-For": {"1.1.1.1", "198.51.100.1, 10.0.0.2"}}, want: "198.51.100.1", wantSource: "X-Forwarded-For"},
+		{name: "全部为可信代理", remoteAddr: "10.0.0.1:1234",
+			headers: map[string][]string{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, want: "10.0.0.3", wantSource: "X-Forwarded-For"},
+		{name: "格式错误之前的地址不可信", remoteAddr: "10.0.0.1:1234",
+			headers: map[string][]string{"X-Forwarded-For": {"198.51.100.1, unknown, 10.0.0.2"}}, want: "10.0.0.2", wantSource: "X-Forwarded-For"},
+		{name: "IPv6 及端口", remoteAddr: "[2001:db8::1]:443",
+			headers: map[string][]string{"X-Forwarded-For": {"[2001:db8::5]:5555"}}, want: "2001:db8::5", wantSource: "X-Forwarded-For"},
+		{name: "X-Real-IP", remoteAddr: "10.0.0.1:1234",
+			headers: map[string][]string{"X-Real-Ip": {"198.51.100.2"}}, want: "198.51.100.2", wantSource: "X-Real-IP"},
+		{name: "IPv4 映射的代理地址", remoteAddr: "[::ffff:10.0.0.1]:1234",
+			headers: map[string][]string{"X-Forwarded-For": {"198.51.100.1"}}, want: "198.51.100.1", wantSource: "X-Forwarded-For"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &http.Request{RemoteAddr: tt.remoteAddr, Header: http.Header(tt.headers)}
+			if r.Header == nil {
+				r.Header = http.Header{}
+			}
+			ip, source := RealIP(r)
+			if ip != tt.want || source != tt.wantSource {
+				t.Errorf("RealIP 为 %s (%s)，应为 %s (%s)", ip, source, tt.want, tt.wantSource)
+			}
+		})
+	}
+}
+
+// addrString 返回地址的字符串形式，nil 时返回空字符串
+func addrString(addr interface{ String() string }) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// limitEntry 单个 IP 的登录尝试状态
+type limitEntry struct {
+	tokens      float64   // 令牌桶中剩余的失败次数
+	lastRefill  time.Time // 上次补充令牌的时间
+	failures    []int64   // 统计窗口内失败的时间戳
+	lockouts    int       // 连续锁定次数，用于计算指数退避
+	lockedUntil time.Time
+	limited     bool      // 是否正在被限制频率
+	bannedAt    time.Time // 上次记录禁止访问事件的时间
+}
+
+var (
+	limitEntries = make(map[string]*limitEntry) // IP -> 登录尝试状态
+	limitMutex   sync.Mutex
+	bannedIPs    []*net.IPNet // 禁止访问的 IP 或 CIDR
+)
+
+// InitSecurity 解析禁止名单并启动过期状态的清理
+func InitSecurity() error {
+	bannedIPs = nil
+	for _, entry := range config.Security.BanList {
+		network, err := parseNetwork(entry)
+		if err != nil {
+			return fmt.Errorf("禁止名单格式错误: %s", entry)
+		}
+		bannedIPs = append(bannedIPs, network)
+	}
+
+	go func() {
+		for {
+			time.Sleep(10 * time.Minute)
+			cleanLimits()
+		}
+	}()
+	return nil
+}
+
+// parseNetwork 解析 CIDR 或单个 IP
+func parseNetwork(entry string) (*net.IPNet, error) {
+	if ip := parseIP(entry); ip != nil {
+		bits := 8 * len(ip)
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(entry)
+	return network, err
+}
+
+// ParseAllowedIPs 校验节点允许的来源地址，返回保存到数据库的 JSON，为空时返回空字符串
+func ParseAllowedIPs(entries []string) (string, error) {
+	var allowed []string
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		network, err := parseNetwork(entry)
+		if err != nil {
+			return "", fmt.Errorf("允许的地址格式错误: %s", entry)
+		}
+		allowed = append(allowed, network.String())
+	}
+	if len(allowed) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(allowed)
+	return string(data), err
+}
+
+// IPAllowed 判断 IP 是否在节点允许的来源地址中，未设置时允许所有地址
+func IPAllowed(allowedIPs, ip string) bool {
+	var allowed []string
+	if allowedIPs == "" || json.Unmarshal([]byte(allowedIPs), &allowed) != nil || len(allowed) == 0 {
+		return allowedIPs == ""
+	}
+	addr := parseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, entry := range allowed {
+		if network, err := parseNetwork(entry); err == nil && network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsBanned 判断 IP 是否在禁止名单中
+func IsBanned(ip string) bool {
+	addr := parseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, network := range bannedIPs {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckLimit 检查 IP 是否允许进行认证，不允许时返回需要等待的时间
+// 只有认证失败（RecordFailure）才消耗次数，已认证的正常请求不受频率限制
+// scope 为尝试的位置（节点登录、控制台等），记录在安全事件中
+func CheckLimit(ip, scope string) (bool, time.Duration) {
+	limitMutex.Lock()
+	now := time.Now()
+	entry := getLimitEntry(ip, now)
+
+	// 禁止名单中的地址每个统计窗口只记录一次事件
+	if IsBanned(ip) {
+		first := now.Sub(entry.bannedAt) >= time.Duration(config.Security.Window)*time.Second
+		if first {
+			entry.bannedAt = now
+		}
+		limitMutex.Unlock()
+		if first {
+			AddEvent("ban", ip, fmt.Sprintf("禁止名单中的地址访问%s", scope))
+		}
+		return false, 0
+	}
+
+	if now.Before(entry.lockedUntil) {
+		limitMutex.Unlock()
+		return false, entry.lockedUntil.Sub(now)
+	}
+
+	// 令牌桶，容量和每分钟补充的数量均为 rate
+	rate := float64(config.Security.Rate)
+	refillLimit(entry, now)
+	if entry.tokens >= 1 {
+		entry.limited = false
+		limitMutex.Unlock()
+		return true, 0
+	}
+
+	// 只在开始限制时记录一次事件
+	wait := time.Duration((1 - entry.tokens) / rate * float64(time.Minute))
+	first := !entry.limited
+	entry.limited = true
+	limitMutex.Unlock()
+
+	if first {
+		AddEvent("ratelimit", ip, fmt.Sprintf("%s请求过于频繁", scope))
+	}
+	return false, wait
+}
+
+// LimitError 返回被限制的响应，wait 为 0 时表示在禁止名单中
+func LimitError(w http.ResponseWriter, wait time.Duration) {
+	if wait == 0 {
+		http.Error(w, "禁止访问", http.StatusForbidden)
+		return
+	}
+	http.Error(w, fmt.Sprintf("尝试次数过多，请 %d 秒后重试", int(wait.Seconds())+1), http.StatusTooManyRequests)
+}
+
+// RecordFailure 记录一次认证失败并消耗一次次数，窗口内失败次数达到上限时按指数退避锁定
+func RecordFailure(ip, scope string) {
+	limitMutex.Lock()
+	now := time.Now()
+	entry := getLimitEntry(ip, now)
+	refillLimit(entry, now)
+	entry.tokens = math.Max(0, entry.tokens-1)
+
+	windowStart := now.Unix() - int64(config.Security.Window)
+	failures := entry.failures[:0]
+	for _, t := range entry.failures {
+		if t > windowStart {
+			failures = append(failures, t)
+		}
+	}
+	entry.failures = append(failures, now.Unix())
+
+	var lockout time.Duration
+	if len(entry.failures) >= config.Security.MaxFailures {
+		lockout = time.Duration(config.Security.Lockout) * time.Second << min(entry.lockouts, 20)
+		lockout = min(lockout, time.Duration(config.Security.MaxLockout)*time.Second)
+		entry.lockouts++
+		entry.lockedUntil = now.Add(lockout)
+		entry.failures = nil
+	}
+	limitMutex.Unlock()
+
+	if lockout > 0 {
+		AddEvent("lockout", ip, fmt.Sprintf("%s认证连续失败 %d 次，锁定 %s", scope, config.Security.MaxFailures, lockout))
+	}
+}
+
+// RecordSuccess 认证成功后清除失败记录
+func RecordSuccess(ip string) {
+	limitMutex.Lock()
+	if entry, ok := limitEntries[ip]; ok {
+		entry.failures = nil
+		entry.lockouts = 0
+	}
+	limitMutex.Unlock()
+}
+
+// refillLimit 按经过的时间补充令牌，需持有 limitMutex
+func refillLimit(entry *limitEntry, now time.Time) {
+	rate := float64(config.Security.Rate)
+	entry.tokens = math.Min(rate, entry.tokens+now.Sub(entry.lastRefill).Minutes()*rate)
+	entry.lastRefill = now
+}
+
+// getLimitEntry 获取 IP 的状态，不存在时创建，需持有 limitMutex
+func getLimitEntry(ip string, now time.Time) *limitEntry {
+	entry, ok := limitEntries[ip]
+	if !ok {
+		entry = &limitEntry{tokens: float64(config.Security.Rate), lastRefill: now}
+		limitEntries[ip] = entry
+	}
+	return entry
+}
+
+// cleanLimits 删除已过期且无失败记录的状态
+func cleanLimits() {
+	limitMutex.Lock()
+	defer limitMutex.Unlock()
+
+	now := time.Now()
+	windowStart := now.Unix() - int64(config.Security.Window)
+	for ip, entry := range limitEntries {
+		idle := now.Sub(entry.lastRefill) > time.Minute && entry.bannedAt.Unix() <= windowStart
+		if idle && now.After(entry.lockedUntil) && (len(entry.failures) == 0 || entry.failures[len(entry.failures)-1] <= windowStart) {
+			delete(limitEntries, ip)
+		}
+	}
+}
+
+// 创建表 Event
+func createEventTable() error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS Event (
+		ID INTEGER PRIMARY KEY AUTOINCREMENT,
+		TimeStamp INTEGER NOT NULL,
+		Type TEXT NOT NULL,
+		IP TEXT,
+		Message TEXT
+	);
+	CREATE INDEX IF NOT EXISTS idx_event_time ON Event (TimeStamp);
+	`
+	return SQLWrite(createTableSQL)
+}
+
+// AddEvent 记录安全事件
+func AddEvent(eventType, ip, message string) {
+	log.Printf("[安全事件] %s %s %s\n", eventType, ip, message)
+	err := SQLWrite("INSERT INTO Event (TimeStamp, Type, IP, Message) VALUES (?, ?, ?, ?)", time.Now().Unix(), eventType, ip, message)
+	if err != nil {
+		log.Printf("记录安全事件失败: %v\n", err)
+	}
+}
+
+// ListEvents 控制台查询安全事件，按时间倒序
+func ListEvents(w http.ResponseWriter, requestData map[string]interface{}) {
+	limit, offset := 100, 0
+	if v, ok := requestData["Limit"].(float64); ok && v > 0 && v <= 1000 {
+		limit = int(v)
+	}
+	if v, ok := requestData["Offset"].(float64); ok && v > 0 {
+		offset = int(v)
+	}
+
+	rows, err := SQLRead("SELECT TimeStamp, Type, IP, Message FROM Event ORDER BY ID DESC LIMIT ? OFFSET ?", limit, offset)
+	if err != nil {
+		http.Error(w, "内部错误：数据库查询失败", http.StatusInternalServerError)
+		return
+	}
+	events := []map[string]interface{}{}
+	for rows.Next() {
+		var timestamp int64
+		var eventType string
+		var ip, message *string
+		if err := rows.Scan(&timestamp, &eventType, &ip, &message); err != nil {
+			continue
+		}
+		events = append(events, map[string]interface{}{
+			"TimeStamp": timestamp,
+			"Type":      eventType,
+			"IP":        stringValue(ip),
+			"Message":   stringValue(message),
+		})
+	}
+	rows.Close()
+	dbMutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
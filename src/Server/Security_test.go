@@ -0,0 +1,135 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// setSecurity 使用测试的配置及空的尝试状态，测试结束后恢复
+func setSecurity(t *testing.T, security SecurityConfig) {
+	t.Helper()
+	oldSecurity, oldEntries, oldBanned := config.Security, limitEntries, bannedIPs
+	t.Cleanup(func() {
+		config.Security, limitEntries, bannedIPs = oldSecurity, oldEntries, oldBanned
+	})
+
+	config.Security = security
+	limitEntries = make(map[string]*limitEntry)
+	bannedIPs = nil
+	for _, entry := range security.BanList {
+		network, err := parseNetwork(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bannedIPs = append(bannedIPs, network)
+	}
+}
+
+// countEvents 返回指定类型的安全事件数量
+func countEvents(t *testing.T, eventType string) int {
+	t.Helper()
+	rows, err := SQLRead("SELECT COUNT(*) FROM Event WHERE Type = ?", eventType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if rows.Next() {
+		rows.Scan(&count)
+	}
+	rows.Close()
+	dbMutex.RUnlock()
+	return count
+}
+
+func TestCheckLimitRate(t *testing.T) {
+	newTestDatabase(t)
+	setSecurity(t, SecurityConfig{Rate: 3, MaxFailures: 100, Window: 300, Lockout: 60, MaxLockout: 3600})
+
+	// 认证成功的请求不消耗次数
+	for i := 0; i < 10; i++ {
+		if ok, _ := CheckLimit("192.0.2.1", "控制台"); !ok {
+			t.Fatalf("第 %d 次请求被限制", i+1)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		RecordFailure("192.0.2.1", "控制台")
+	}
+	for i := 0; i < 2; i++ {
+		ok, wait := CheckLimit("192.0.2.1", "控制台")
+		if ok || wait <= 0 || wait > 20*time.Second {
+			t.Errorf("失败 3 次后应限制约 20 秒，实际为 %v %v", ok, wait)
+		}
+	}
+	if count := countEvents(t, "ratelimit"); count != 1 {
+		t.Errorf("应只记录 1 次限制事件，实际为 %d", count)
+	}
+
+	// 其他 IP 不受影响
+	if ok, _ := CheckLimit("192.0.2.2", "控制台"); !ok {
+		t.Error("其他 IP 被限制")
+	}
+}
+
+func TestRecordFailureLockout(t *testing.T) {
+	newTestDatabase(t)
+	setSecurity(t, SecurityConfig{Rate: 100, MaxFailures: 3, Window: 300, Lockout: 60, MaxLockout: 100})
+	ip := "192.0.2.1"
+
+	for i := 0; i < 2; i++ {
+		RecordFailure(ip, "节点登录")
+	}
+	if ok, _ := CheckLimit(ip, "节点登录"); !ok {
+		t.Fatal("未达到失败次数上限时被锁定")
+	}
+
+	RecordFailure(ip, "节点登录")
+	ok, wait := CheckLimit(ip, "节点登录")
+	if ok || wait <= 59*time.Second || wait > 60*time.Second {
+		t.Fatalf("首次锁定应为 60 秒，实际为 %v %v", ok, wait)
+	}
+
+	// 锁定结束后再次失败，锁定时长翻倍且不超过上限
+	limitEntries[ip].lockedUntil = time.Now()
+	for i := 0; i < 3; i++ {
+		RecordFailure(ip, "节点登录")
+	}
+	ok, wait = CheckLimit(ip, "节点登录")
+	if ok || wait <= 99*time.Second || wait > 100*time.Second {
+		t.Fatalf("第二次锁定应为 100 秒，实际为 %v %v", ok, wait)
+	}
+	if count := countEvents(t, "lockout"); count != 2 {
+		t.Errorf("应记录 2 次锁定事件，实际为 %d", count)
+	}
+
+	// 认证成功后重新计算失败次数及锁定时长
+	limitEntries[ip].lockedUntil = time.Now()
+	RecordSuccess(ip)
+	for i := 0; i < 2; i++ {
+		RecordFailure(ip, "节点登录")
+	}
+	if ok, _ := CheckLimit(ip, "节点登录"); !ok {
+		t.Error("认证成功后未清除失败记录")
+	}
+	RecordFailure(ip, "节点登录")
+	if _, wait := CheckLimit(ip, "节点登录"); wait > 60*time.Second {
+		t.Errorf("认证成功后锁定时长应重新从 60 秒开始，实际为 %v", wait)
+	}
+}
+
+func TestCheckLimitBanList(t *testing.T) {
+	newTestDatabase(t)
+	setSecurity(t, SecurityConfig{Rate: 30, MaxFailures: 5, Window: 300, Lockout: 60, MaxLockout: 3600, BanList: []string{"198.51.100.0/24", "2001:db8::1"}})
+
+	for _, ip := range []string{"198.51.100.7", "198.51.100.7", "2001:db8::1"} {
+		if ok, wait := CheckLimit(ip, "控制台"); ok || wait != 0 {
+			t.Errorf("禁止名单中的 %s 应被禁止，实际为 %v %v", ip, ok, wait)
+		}
+	}
+	if count := countEvents(t, "ban"); count != 2 {
+		t.Errorf("每个地址在统计窗口内应只记录 1 次事件，实际共 %d 次", count)
+	}
+	if ok, _ := CheckLimit("198.51.101.7", "控制台"); !ok {
+		t.Error("禁止名单以外的地址被禁止")
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// certReloader 证书文件更新后自动重新加载，便于证书轮换时不必重启
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex   sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// GetCertificate 供 tls.Config 使用，每次握手时检查证书文件是否更新
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	info, err := os.Stat(c.certFile)
+	if err == nil && info.ModTime().After(c.modTime) {
+		cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+		if err != nil {
+			log.Printf("重新加载证书失败: %v\n", err)
+		} else {
+			c.cert = &cert
+			c.modTime = info.ModTime()
+		}
+	}
+	if c.cert == nil {
+		return nil, fmt.Errorf("证书未加载")
+	}
+	return c.cert, nil
+}
+
+// LoadTLSConfig 根据配置生成 TLS 配置，未配置证书时返回 nil
+func LoadTLSConfig() (*tls.Config, error) {
+	if config.TLSClientAuth != "optional" && config.TLSClientAuth != "require" {
+		return nil, fmt.Errorf("tls_client_auth 只能为 optional 或 require")
+	}
+	if config.TLSClientAuth == "require" && config.TLSClientCA == "" {
+		return nil, fmt.Errorf("tls_client_auth 为 require 时需要配置 tls_client_ca")
+	}
+	if config.TLSCert == "" && config.TLSKey == "" {
+		if config.TLSClientCA != "" {
+			return nil, fmt.Errorf("使用客户端证书需要同时配置 tls_cert 和 tls_key")
+		}
+		return nil, nil
+	}
+	if config.TLSCert == "" || config.TLSKey == "" {
+		return nil, fmt.Errorf("tls_cert 和 tls_key 需要同时配置")
+	}
+
+	reloader := &certReloader{certFile: config.TLSCert, keyFile: config.TLSKey}
+	if _, err := reloader.GetCertificate(nil); err != nil {
+		return nil, fmt.Errorf("加载证书失败: %v", err)
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if config.TLSClientCA != "" {
+		data, err := os.ReadFile(config.TLSClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("读取客户端 CA 失败: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("解析客户端 CA 失败: %s", config.TLSClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		// 同一端口还提供控制台和广播，是否必须携带证书在节点 URI 中判断
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// NodeCertName 返回节点客户端证书中的名称（CN 及 DNS SAN），未提供证书时返回 nil
+func NodeCertName(r *http.Request) []string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	return slices.DeleteFunc(names, func(name string) bool { return name == "" })
+}
+
+// CheckNodeCert 校验节点的客户端证书：require 时必须提供证书，提供证书时名称必须与节点名称一致
+func CheckNodeCert(certNames []string, nodeName string) error {
+	if len(certNames) == 0 {
+		if config.TLSClientAuth == "require" {
+			return fmt.Errorf("未提供客户端证书")
+		}
+		return nil
+	}
+	if !slices.Contains(certNames, nodeName) {
+		return fmt.Errorf("客户端证书 %v 与节点 %s 不匹配", certNames, nodeName)
+	}
+	return nil
+}
+
+// FindNodeByCert 查找名称与客户端证书名称一致的节点，未找到或匹配多个节点时返回 0
+func FindNodeByCert(certNames []string) (int, error) {
+	found := 0
+	for _, name := range certNames {
+		var id int
+		dbMutex.RLock()
+		err := db.QueryRow("SELECT ID FROM Node WHERE Name = ?", name).Scan(&id)
+		dbMutex.RUnlock()
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if found != 0 && found != id {
+			return 0, fmt.Errorf("客户端证书 %v 匹配多个节点", certNames)
+		}
+		found = id
+	}
+	return found, nil
+}
+
+// CertLogin 只使用客户端证书登录，需要开启 tls_cert_login
+func CertLogin(conn *websocket.Conn, clientKey, NodeIP, clientEncoding string, certNames []string) (error, int) {
+	if !config.TLSCertLogin {
+		return SendWS(conn, []byte(`{"status":2,"message":"服务端未开启证书登录，请配置 Token"}`), clientEncoding), 0
+	}
+	if len(certNames) == 0 {
+		log.Printf("%s 证书登录未提供客户端证书", NodeIP)
+		return SendWS(conn, []byte(`{"status":2,"message":"未提供客户端证书"}`), clientEncoding), 0
+	}
+
+	nodeID, err := FindNodeByCert(certNames)
+	if err != nil {
+		log.Printf("%s 证书登录失败: %v", NodeIP, err)
+		return SendWS(conn, []byte(`{"status":2,"message":"客户端证书与节点不匹配"}`), clientEncoding), 0
+	}
+	if nodeID == 0 {
+		log.Printf("%s 没有与客户端证书 %v 匹配的节点", NodeIP, certNames)
+		return SendWS(conn, []byte(`{"status":2,"message":"客户端证书与节点不匹配"}`), clientEncoding), 0
+	}
+	return completeLogin(conn, clientKey, nodeID, NodeIP, clientEncoding, certNames, "")
+}
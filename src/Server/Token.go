@@ -0,0 +1,438 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// 节点 Token 以 PBKDF2-SHA256 哈希保存，格式为 pbkdf2-sha256$迭代次数$哈希，轮换后旧 Token 在宽限期内仍可登录
+// 挑战应答登录使用由 Token 派生的 AuthKey，客户端使用相同方式计算，Token 本身不再传输
+// AuthKey 使用主密钥以 AES-GCM 加密保存，只拿到数据库无法登录；不再保存可用于查找节点的 TokenID
+
+// nodeTokenPrefix PBKDF2 哈希的前缀，没有该前缀的是旧版本的 sha256(盐 + Token)
+const nodeTokenPrefix = "pbkdf2-sha256$"
+
+// hashNodeToken 计算节点 Token 的哈希
+func hashNodeToken(salt, token string) string {
+	return stretchNodeToken(salt, legacyNodeToken(salt, token), passwordIterations)
+}
+
+// legacyNodeToken 旧版本保存的 sha256(盐 + Token)
+func legacyNodeToken(salt, token string) string {
+	sum := sha256.Sum256([]byte(salt + token))
+	return hex.EncodeToString(sum[:])
+}
+
+// stretchNodeToken 对 sha256(盐 + Token) 计算 PBKDF2，旧版本的哈希无需 Token 即可直接转换
+func stretchNodeToken(salt, digest string, iterations int) string {
+	key := pbkdf2.Key([]byte(digest), []byte(salt), iterations, 32, sha256.New)
+	return fmt.Sprintf("%s%d$%s", nodeTokenPrefix, iterations, hex.EncodeToString(key))
+}
+
+// authKeyPrefix 加密保存的 AuthKey 的前缀
+const authKeyPrefix = "enc:"
+
+// authSecret 加密 AuthKey 的主密钥
+var authSecret cipher.AEAD
+
+// LoadAuthSecret 读取主密钥，文件不存在时生成
+func LoadAuthSecret(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		raw := make([]byte, 32)
+		if _, err := rand.Read(raw); err != nil {
+			return fmt.Errorf("生成主密钥失败: %w", err)
+		}
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return fmt.Errorf("保存主密钥失败: %w", err)
+		}
+		data = []byte(hex.EncodeToString(raw))
+		_, err = file.Write(append(data, '\n'))
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("保存主密钥失败: %w", err)
+		}
+		log.Printf("已生成主密钥 %s，请与数据库分开备份\n", path)
+	} else if err != nil {
+		return fmt.Errorf("读取主密钥失败: %w", err)
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return fmt.Errorf("主密钥 %s 格式错误，应为 64 个十六进制字符", path)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	authSecret, err = cipher.NewGCM(block)
+	return err
+}
+
+// sealAuthKey 加密 AuthKey
+func sealAuthKey(key string) (string, error) {
+	nonce := make([]byte, authSecret.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("生成随机数失败: %w", err)
+	}
+	sealed := authSecret.Seal(nonce, nonce, []byte(key), nil)
+	return authKeyPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// openAuthKey 解密 AuthKey，未保存或无法解密（如主密钥已更换）时返回 false
+func openAuthKey(stored string) (string, bool) {
+	if !strings.HasPrefix(stored, authKeyPrefix) {
+		return "", false
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(stored, authKeyPrefix))
+	if err != nil || len(sealed) < authSecret.NonceSize() {
+		return "", false
+	}
+	nonceSize := authSecret.NonceSize()
+	key, err := authSecret.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return "", false
+	}
+	return string(key), true
+}
+
+// nodeAuthKey 由 Token 派生的认证密钥
+func nodeAuthKey(token string) string {
+	return authMAC(token, "LightMonitor-auth")
+}
+
+// authMAC 计算 HMAC-SHA256 并以十六进制返回
+func authMAC(key, message string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(message))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// randomHex 生成 n 字节的随机数并以十六进制返回
+func randomHex(n int) (string, error) {
+	raw := make([]byte, n)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("生成随机数失败: %w", err)
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// matchNodeToken 使用恒定时间比较 Token 与保存的哈希
+func matchNodeToken(token, salt, hash string) bool {
+	iterations, ok := nodeTokenIterations(hash)
+	if salt == "" || !ok {
+		return false
+	}
+	expected := stretchNodeToken(salt, legacyNodeToken(salt, token), iterations)
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(hash)) == 1
+}
+
+// nodeTokenIterations 解析 PBKDF2 哈希的迭代次数，格式不正确时 ok 为 false
+func nodeTokenIterations(hash string) (int, bool) {
+	if !strings.HasPrefix(hash, nodeTokenPrefix) {
+		return 0, false
+	}
+	parts := strings.Split(strings.TrimPrefix(hash, nodeTokenPrefix), "$")
+	if len(parts) != 2 {
+		return 0, false
+	}
+	iterations, err := strconv.Atoi(parts[0])
+	if err != nil || iterations <= 0 {
+		return 0, false
+	}
+	if digest, err := hex.DecodeString(parts[1]); err != nil || len(digest) != 32 {
+		return 0, false
+	}
+	return iterations, true
+}
+
+// nodeCredentials 生成保存新 Token 所需的 Token、TokenSalt 及 AuthKey 列
+func nodeCredentials(token string) (map[string]interface{}, error) {
+	salt, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	authKey, err := sealAuthKey(nodeAuthKey(token))
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"Token": hashNodeToken(salt, token), "TokenSalt": salt, "AuthKey": authKey}, nil
+}
+
+// migrateNodeTokens 将旧版本明文保存的 Token 转换为哈希
+func migrateNodeTokens() error {
+	rows, err := SQLRead("SELECT ID, Token FROM Node WHERE TokenSalt IS NULL OR TokenSalt = ''")
+	if err != nil {
+		return err
+	}
+
+	plain := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var token string
+		if err := rows.Scan(&id, &token); err != nil {
+			rows.Close()
+			dbMutex.RUnlock()
+			return fmt.Errorf("读取节点 Token 失败: %w", err)
+		}
+		plain[id] = token
+	}
+	rows.Close()
+	dbMutex.RUnlock()
+
+	for id, token := range plain {
+		salt, err := randomHex(16)
+		if err != nil {
+			return err
+		}
+		err = SQLWrite("UPDATE Node SET Token = ?, TokenSalt = ? WHERE ID = ?", hashNodeToken(salt, token), salt, id)
+		if err != nil {
+			return err
+		}
+	}
+	if len(plain) > 0 {
+		log.Printf("已将 %d 个节点的 Token 转换为哈希保存\n", len(plain))
+	}
+	return stretchNodeTokens()
+}
+
+// stretchNodeTokens 将旧版本的 sha256 哈希（包括宽限期内的旧 Token）转换为 PBKDF2 哈希
+func stretchNodeTokens() error {
+	rows, err := SQLRead(`SELECT ID, Token, TokenSalt, OldToken, OldTokenSalt FROM Node
+		WHERE Token NOT LIKE 'pbkdf2-sha256$%' OR (OldToken IS NOT NULL AND OldToken NOT LIKE 'pbkdf2-sha256$%')`)
+	if err != nil {
+		return err
+	}
+
+	type legacyHash struct {
+		id                           int
+		hash, salt, oldHash, oldSalt string
+	}
+	var legacy []legacyHash
+	for rows.Next() {
+		var item legacyHash
+		var salt, oldHash, oldSalt *string
+		if err := rows.Scan(&item.id, &item.hash, &salt, &oldHash, &oldSalt); err != nil {
+			rows.Close()
+			dbMutex.RUnlock()
+			return fmt.Errorf("读取节点 Token 失败: %w", err)
+		}
+		item.salt, item.oldHash, item.oldSalt = stringValue(salt), stringValue(oldHash), stringValue(oldSalt)
+		legacy = append(legacy, item)
+	}
+	rows.Close()
+	dbMutex.RUnlock()
+
+	for _, item := range legacy {
+		hash, oldHash := item.hash, item.oldHash
+		if !strings.HasPrefix(hash, nodeTokenPrefix) {
+			hash = stretchNodeToken(item.salt, hash, passwordIterations)
+		}
+		if oldHash != "" && !strings.HasPrefix(oldHash, nodeTokenPrefix) {
+			oldHash = stretchNodeToken(item.oldSalt, oldHash, passwordIterations)
+		}
+		err := SQLWrite("UPDATE Node SET Token = ?, OldToken = NULLIF(?, '') WHERE ID = ?", hash, oldHash, item.id)
+		if err != nil {
+			return err
+		}
+	}
+	if len(legacy) > 0 {
+		log.Printf("已将 %d 个节点的 Token 哈希转换为 PBKDF2\n", len(legacy))
+	}
+	return sealAuthKeys()
+}
+
+// sealAuthKeys 加密旧版本明文保存的 AuthKey，并清除 TokenID
+func sealAuthKeys() error {
+	rows, err := SQLRead(`SELECT ID, AuthKey, OldAuthKey FROM Node
+		WHERE AuthKey NOT LIKE 'enc:%' OR OldAuthKey NOT LIKE 'enc:%' OR TokenID IS NOT NULL OR OldTokenID IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+
+	plain := make(map[int][2]string)
+	for rows.Next() {
+		var id int
+		var authKey, oldAuthKey *string
+		if err := rows.Scan(&id, &authKey, &oldAuthKey); err != nil {
+			rows.Close()
+			dbMutex.RUnlock()
+			return fmt.Errorf("读取节点认证信息失败: %w", err)
+		}
+		plain[id] = [2]string{stringValue(authKey), stringValue(oldAuthKey)}
+	}
+	rows.Close()
+	dbMutex.RUnlock()
+
+	for id, keys := range plain {
+		var sealed [2]interface{}
+		for i, key := range keys {
+			if key == "" {
+				continue
+			}
+			if strings.HasPrefix(key, authKeyPrefix) {
+				sealed[i] = key
+				continue
+			}
+			value, err := sealAuthKey(key)
+			if err != nil {
+				return err
+			}
+			sealed[i] = value
+		}
+		err := SQLWrite("UPDATE Node SET AuthKey = ?, OldAuthKey = ?, TokenID = NULL, OldTokenID = NULL WHERE ID = ?", sealed[0], sealed[1], id)
+		if err != nil {
+			return err
+		}
+	}
+	if len(plain) > 0 {
+		log.Printf("已加密 %d 个节点的认证信息\n", len(plain))
+	}
+	return nil
+}
+
+// FindNodeByToken 查找 Token 对应的节点ID，未找到时返回 0
+// 宽限期内的旧 Token 同样有效，此时 old 为 true
+// PBKDF2 计算量较大，只校验 AuthKey 与 Token 匹配的节点以及没有可用 AuthKey 的节点
+func FindNodeByToken(token string) (int, bool, error) {
+	rows, err := SQLRead("SELECT ID, Token, TokenSalt, AuthKey, OldToken, OldTokenSalt, OldAuthKey, OldTokenExpire FROM Node")
+	if err != nil {
+		return 0, false, err
+	}
+	defer dbMutex.RUnlock()
+	defer rows.Close()
+
+	authKey := []byte(nodeAuthKey(token))
+	candidate := func(stored *string) bool {
+		key, ok := openAuthKey(stringValue(stored))
+		return !ok || hmac.Equal([]byte(key), authKey)
+	}
+
+	now := time.Now().Unix()
+	found, old := 0, false
+	for rows.Next() {
+		var id int
+		var hash string
+		var salt, currentKey, oldHash, oldSalt, oldKey *string
+		var oldExpire *int64
+		if err := rows.Scan(&id, &hash, &salt, &currentKey, &oldHash, &oldSalt, &oldKey, &oldExpire); err != nil {
+			return 0, false, fmt.Errorf("读取节点 Token 失败: %w", err)
+		}
+
+		// 遍历全部节点，不提前返回，避免通过耗时推测节点位置
+		if candidate(currentKey) && matchNodeToken(token, stringValue(salt), hash) {
+			found, old = id, false
+		} else if oldExpire != nil && *oldExpire >= now && candidate(oldKey) && matchNodeToken(token, stringValue(oldSalt), stringValue(oldHash)) {
+			found, old = id, true
+		}
+	}
+	return found, old, nil
+}
+
+// FindNodeByAuth 查找 AuthKey 能通过客户端对 nonce:cnonce 的 MAC 校验的节点
+// 成功时返回节点ID及对应的 AuthKey，用于生成服务端的应答
+func FindNodeByAuth(nonce, cnonce, mac string) (int, string, error) {
+	rows, err := SQLRead("SELECT ID, AuthKey, OldAuthKey, OldTokenExpire FROM Node")
+	if err != nil {
+		return 0, "", err
+	}
+	defer dbMutex.RUnlock()
+	defer rows.Close()
+
+	now := time.Now().Unix()
+	for rows.Next() {
+		var id int
+		var currentKey, oldKey *string
+		var oldExpire *int64
+		if err := rows.Scan(&id, &currentKey, &oldKey, &oldExpire); err != nil {
+			return 0, "", fmt.Errorf("读取节点认证信息失败: %w", err)
+		}
+
+		if key, ok := openAuthKey(stringValue(currentKey)); ok && hmac.Equal([]byte(authMAC(key, nonce+":"+cnonce)), []byte(mac)) {
+			return id, key, nil
+		}
+		if oldExpire == nil || *oldExpire < now {
+			continue
+		}
+		if key, ok := openAuthKey(stringValue(oldKey)); ok && hmac.Equal([]byte(authMAC(key, nonce+":"+cnonce)), []byte(mac)) {
+			return id, key, nil
+		}
+	}
+	return 0, "", nil
+}
+
+// MissingAuthKey 判断是否有节点没有可用的 AuthKey（升级前添加的节点或主密钥已更换）
+func MissingAuthKey() bool {
+	rows, err := SQLRead("SELECT AuthKey FROM Node")
+	if err != nil {
+		return false
+	}
+	defer dbMutex.RUnlock()
+	defer rows.Close()
+
+	for rows.Next() {
+		var authKey *string
+		if err := rows.Scan(&authKey); err != nil {
+			return false
+		}
+		if _, ok := openAuthKey(stringValue(authKey)); !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// SaveAuthKey 旧版登录成功后保存 AuthKey，之后该节点即可使用挑战应答登录
+func SaveAuthKey(id int, token string) error {
+	authKey, err := sealAuthKey(nodeAuthKey(token))
+	if err != nil {
+		return err
+	}
+	return SQLWrite("UPDATE Node SET AuthKey = ? WHERE ID = ?", authKey, id)
+}
+
+// SetNodeToken 设置节点的新 Token，grace 大于 0 时旧 Token 在 grace 秒内仍可登录
+// 返回旧 Token 的失效时间
+func SetNodeToken(id int, token string, grace int64) (int64, error) {
+	salt, err := randomHex(16)
+	if err != nil {
+		return 0, err
+	}
+	authKey, err := sealAuthKey(nodeAuthKey(token))
+	if err != nil {
+		return 0, err
+	}
+
+	var oldExpire int64
+	if grace > 0 {
+		oldExpire = time.Now().Unix() + grace
+		err = SQLWrite(`UPDATE Node SET OldToken = Token, OldTokenSalt = TokenSalt, OldAuthKey = AuthKey,
+			OldTokenExpire = ?, Token = ?, TokenSalt = ?, AuthKey = ? WHERE ID = ?`,
+			oldExpire, hashNodeToken(salt, token), salt, authKey, id)
+	} else {
+		err = SQLWrite(`UPDATE Node SET OldToken = NULL, OldTokenSalt = NULL, OldAuthKey = NULL,
+			OldTokenExpire = NULL, Token = ?, TokenSalt = ?, AuthKey = ? WHERE ID = ?`,
+			hashNodeToken(salt, token), salt, authKey, id)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("更新节点 Token 失败: %w", err)
+	}
+	return oldExpire, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatchNodeToken(t *testing.T) {
+	hash := hashNodeToken("salt", "token")
+	tests := []struct {
+		name  string
+		token string
+		salt  string
+		hash  string
+		want  bool
+	}{
+		{name: "正确", token: "token", salt: "salt", hash: hash, want: true},
+		{name: "Token 错误", token: "token2", salt: "salt", hash: hash},
+		{name: "盐错误", token: "token", salt: "salt2", hash: hash},
+		{name: "盐为空", token: "token", salt: "", hash: hash},
+		{name: "旧版本哈希", token: "token", salt: "salt", hash: legacyNodeToken("salt", "token")},
+		{name: "迭代次数错误", token: "token", salt: "salt", hash: strings.Replace(hash, "$100000$", "$0$", 1)},
+		{name: "哈希长度错误", token: "token", salt: "salt", hash: hash[:len(hash)-2]},
+		{name: "其他迭代次数", token: "token", salt: "salt", hash: stretchNodeToken("salt", legacyNodeToken("salt", "token"), 1000), want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchNodeToken(tt.token, tt.salt, tt.hash); got != tt.want {
+				t.Errorf("matchNodeToken 为 %v，应为 %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStretchNodeTokens(t *testing.T) {
+	newTestDatabase(t)
+
+	// 旧版本保存的 sha256 哈希，节点 2 在宽限期内还有旧 Token
+	err := SQLWrite("INSERT INTO Node (ID, Name, Token, TokenSalt) VALUES (1, 'a', ?, 's1')", legacyNodeToken("s1", "token1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SQLWrite("INSERT INTO Node (ID, Name, Token, TokenSalt, OldToken, OldTokenSalt) VALUES (2, 'b', ?, 's2', ?, 's3')",
+		hashNodeToken("s2", "token2"), legacyNodeToken("s3", "old2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stretchNodeTokens(); err != nil {
+		t.Fatalf("stretchNodeTokens: %v", err)
+	}
+
+	tests := []struct {
+		id    int
+		token string
+		old   string
+	}{
+		{id: 1, token: "token1"},
+		{id: 2, token: "token2", old: "old2"},
+	}
+	for _, tt := range tests {
+		rows, err := SQLRead("SELECT Token, TokenSalt, OldToken, OldTokenSalt FROM Node WHERE ID = ?", tt.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var hash, salt string
+		var oldHash, oldSalt *string
+		if !rows.Next() {
+			rows.Close()
+			dbMutex.RUnlock()
+			t.Fatalf("节点 %d 不存在", tt.id)
+		}
+		err = rows.Scan(&hash, &salt, &oldHash, &oldSalt)
+		rows.Close()
+		dbMutex.RUnlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.HasPrefix(hash, nodeTokenPrefix) || !matchNodeToken(tt.token, salt, hash) {
+			t.Errorf("节点 %d 的 Token 哈希转换错误: %s", tt.id, hash)
+		}
+		if tt.old == "" {
+			if oldHash != nil {
+				t.Errorf("节点 %d 不应有旧 Token: %s", tt.id, *oldHash)
+			}
+		} else if !matchNodeToken(tt.old, stringValue(oldSalt), stringValue(oldHash)) {
+			t.Errorf("节点 %d 的旧 Token 哈希转换错误: %s", tt.id, stringValue(oldHash))
+		}
+	}
+}
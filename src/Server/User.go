@@ -0,0 +1,405 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// 控制台角色，数值越大权限越高
+var roleLevels = map[string]int{
+	"viewer":   1, // 只读
+	"operator": 2, // 管理节点
+	"admin":    3, // 管理节点及用户
+}
+
+// 控制台各操作所需的最低角色
+var actionRoles = map[string]string{
+	"List":         "viewer",
+	"Detail":       "viewer",
+	"Password":     "viewer",
+	"Add":          "operator",
+	"Delete":       "operator",
+	"Update":       "operator",
+	"Rotate":       "operator",
+	"Export":       "viewer",
+	"ExportAuth":   "admin", // 导出包含认证信息的节点
+	"Import":       "operator",
+	"EnrollCreate": "operator",
+	"EnrollList":   "operator",
+	"EnrollDelete": "operator",
+	"Command":      "operator",
+	"UserList":     "admin",
+	"UserAdd":      "admin",
+	"UserDelete":   "admin",
+	"UserPassword": "admin",
+	"Events":       "admin",
+	"Audit":        "admin",
+}
+
+const passwordIterations = 100000 // PBKDF2 迭代次数
+
+// dummyPasswordHash 用户不存在时用于校验的哈希，与真实哈希的计算量相同
+var dummyPasswordHash, _ = HashPassword("")
+
+// ConsoleUser 通过认证的控制台用户
+type ConsoleUser struct {
+	ID   int // 使用配置文件中的 token 时为 0
+	Name string
+	Role string
+}
+
+// Can 判断用户是否有权限执行指定操作
+func (u ConsoleUser) Can(action string) bool {
+	required, ok := actionRoles[action]
+	if !ok {
+		return false
+	}
+	return roleLevels[u.Role] >= roleLevels[required]
+}
+
+// 创建表 User 和 Session
+func createUserTable() error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS User (
+		ID INTEGER PRIMARY KEY AUTOINCREMENT,
+		Name TEXT NOT NULL UNIQUE,
+		Password TEXT NOT NULL,
+		Role TEXT NOT NULL,
+		TimeStamp INTEGER DEFAULT (strftime('%s', 'now'))
+	);
+	CREATE TABLE IF NOT EXISTS Session (
+		Token TEXT PRIMARY KEY,
+		UserID INTEGER NOT NULL,
+		Expire INTEGER NOT NULL
+	);
+	`
+	return SQLWrite(createTableSQL)
+}
+
+// HashPassword 使用 PBKDF2-SHA256 计算密码哈希，格式为 pbkdf2-sha256$迭代次数$盐$哈希
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("生成盐失败: %w", err)
+	}
+	key := pbkdf2.Key([]byte(password), salt, passwordIterations, 32, sha256.New)
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// CheckPassword 校验密码是否与哈希匹配
+func CheckPassword(password, hash string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	key := pbkdf2.Key([]byte(password), salt, iterations, len(expected), sha256.New)
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+// hashSessionToken 会话 Token 只保存哈希，数据库泄露时无法直接使用
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateSession 为用户创建会话，返回 Token 及过期时间
+func CreateSession(userID int) (string, int64, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", 0, fmt.Errorf("生成会话失败: %w", err)
+	}
+	token := hex.EncodeToString(raw)
+	expire := time.Now().Add(time.Duration(config.SessionTTL) * time.Hour).Unix()
+
+	// 顺便清理已过期的会话
+	err := SQLWrite("DELETE FROM Session WHERE Expire < ?", time.Now().Unix())
+	if err != nil {
+		return "", 0, err
+	}
+	err = SQLWrite("INSERT INTO Session (Token, UserID, Expire) VALUES (?, ?, ?)", hashSessionToken(token), userID, expire)
+	if err != nil {
+		return "", 0, err
+	}
+	return token, expire, nil
+}
+
+// Authenticate 从 Authorization: Bearer 请求头识别控制台用户
+// 配置文件中的 token 视为管理员，兼容旧版时也可放在请求体的 Token 字段中
+func Authenticate(r *http.Request, bodyToken string) (ConsoleUser, error) {
+	token := bodyToken
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if token == "" {
+		return ConsoleUser{}, fmt.Errorf("未携带密钥")
+	}
+
+	if config.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(config.Token)) == 1 {
+		return ConsoleUser{Name: "token", Role: "admin"}, nil
+	}
+
+	rows, err := SQLRead(`SELECT User.ID, User.Name, User.Role FROM Session JOIN User ON User.ID = Session.UserID
+		WHERE Session.Token = ? AND Session.Expire >= ?`, hashSessionToken(token), time.Now().Unix())
+	if err != nil {
+		return ConsoleUser{}, err
+	}
+	defer dbMutex.RUnlock()
+	defer rows.Close()
+
+	var user ConsoleUser
+	if !rows.Next() {
+		return ConsoleUser{}, fmt.Errorf("密钥不正确或已过期")
+	}
+	if err := rows.Scan(&user.ID, &user.Name, &user.Role); err != nil {
+		return ConsoleUser{}, err
+	}
+	return user, nil
+}
+
+// ConsoleLogin 控制台登录：POST 用户名和密码获取会话 Token，DELETE 注销当前会话
+func ConsoleLogin(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", "*, Authorization")
+
+	_, ip, _, ua, _ := ClientInfo(r)
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodPost:
+		var request struct {
+			Username string
+			Password string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, fmt.Sprintf("请求解析失败: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		if ok, wait := CheckLimit(ip, "控制台登录"); !ok {
+			LimitError(w, wait)
+			return
+		}
+
+		var id int
+		var hash, role string
+		dbMutex.RLock()
+		err := db.QueryRow("SELECT ID, Password, Role FROM User WHERE Name = ?", request.Username).Scan(&id, &hash, &role)
+		dbMutex.RUnlock()
+		if err != nil {
+			// 用户不存在时同样计算一次哈希，避免通过响应时间判断用户名是否存在
+			hash = dummyPasswordHash
+		}
+		if !CheckPassword(request.Password, hash) || err != nil {
+			log.Printf("%s 用户 %s 登录失败 | %s\n", ip, request.Username, ua)
+			RecordFailure(ip, "控制台登录")
+			http.Error(w, "用户名或密码不正确", http.StatusUnauthorized)
+			return
+		}
+		RecordSuccess(ip)
+
+		token, expire, err := CreateSession(id)
+		if err != nil {
+			log.Printf("%s 用户 %s 创建会话失败: %v | %s\n", ip, request.Username, err, ua)
+			http.Error(w, "内部错误：创建会话失败", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("%s 用户 %s 登录成功，角色: %s | %s\n", ip, request.Username, role, ua)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Token":  token,
+			"Role":   role,
+			"Expire": expire,
+		})
+
+	case http.MethodDelete:
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if err := SQLWrite("DELETE FROM Session WHERE Token = ?", hashSessionToken(token)); err != nil {
+			http.Error(w, "内部错误：注销失败", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("已注销"))
+
+	default:
+		http.Error(w, "请求方法不正确", http.StatusMethodNotAllowed)
+	}
+}
+
+// UserAction 处理控制台中的用户管理操作
+func UserAction(w http.ResponseWriter, user ConsoleUser, action string, requestData map[string]interface{}, ip, ua string) {
+	name, _ := requestData["Username"].(string)
+	password, _ := requestData["Password"].(string)
+	role, _ := requestData["Role"].(string)
+
+	switch action {
+	case "UserList":
+		rows, err := SQLRead("SELECT Name, Role, TimeStamp FROM User ORDER BY ID")
+		if err != nil {
+			http.Error(w, "内部错误：数据库查询失败", http.StatusInternalServerError)
+			return
+		}
+		users := []map[string]interface{}{}
+		for rows.Next() {
+			var userName, userRole string
+			var timestamp int64
+			if err := rows.Scan(&userName, &userRole, &timestamp); err != nil {
+				continue
+			}
+			users = append(users, map[string]interface{}{"Username": userName, "Role": userRole, "TimeStamp": timestamp})
+		}
+		rows.Close()
+		dbMutex.RUnlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(users)
+
+	case "UserAdd":
+		if name == "" || password == "" {
+			http.Error(w, "用户名和密码不能为空", http.StatusBadRequest)
+			return
+		}
+		if _, ok := roleLevels[role]; !ok {
+			http.Error(w, "角色不正确，可选 viewer、operator、admin", http.StatusBadRequest)
+			return
+		}
+		hash, err := HashPassword(password)
+		if err != nil {
+			http.Error(w, "内部错误：密码处理失败", http.StatusInternalServerError)
+			return
+		}
+		if err := SQLWrite("INSERT INTO User (Name, Password, Role) VALUES (?, ?, ?)", name, hash, role); err != nil {
+			log.Printf("%s %s 添加用户 %s 失败: %v | %s\n", ip, user.Name, name, err, ua)
+			http.Error(w, "添加用户失败: 用户已存在", http.StatusConflict)
+			return
+		}
+		log.Printf("%s %s 添加用户 %s，角色: %s | %s\n", ip, user.Name, name, role, ua)
+		w.Write([]byte("添加成功"))
+
+	case "UserDelete":
+		if name == user.Name {
+			http.Error(w, "不能删除当前登录的用户", http.StatusBadRequest)
+			return
+		}
+		var id int
+		dbMutex.RLock()
+		err := db.QueryRow("SELECT ID FROM User WHERE Name = ?", name).Scan(&id)
+		dbMutex.RUnlock()
+		if err != nil {
+			http.Error(w, "未找到用户", http.StatusNotFound)
+			return
+		}
+		if err := SQLWrite("DELETE FROM Session WHERE UserID = ?", id); err != nil {
+			http.Error(w, "内部错误：删除会话失败", http.StatusInternalServerError)
+			return
+		}
+		if err := SQLWrite("DELETE FROM User WHERE ID = ?", id); err != nil {
+			http.Error(w, "内部错误：删除用户失败", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("%s %s 删除用户 %s | %s\n", ip, user.Name, name, ua)
+		w.Write([]byte("删除成功"))
+
+	case "UserPassword", "Password":
+		// Password 修改自己的密码，UserPassword 由管理员修改任意用户的密码或角色
+		if action == "Password" {
+			if user.ID == 0 {
+				http.Error(w, "配置文件中的密钥不能修改密码", http.StatusBadRequest)
+				return
+			}
+			if password == "" {
+				http.Error(w, "新密码不能为空", http.StatusBadRequest)
+				return
+			}
+			// 需要验证原密码，避免会话被盗用后直接修改密码
+			oldPassword, _ := requestData["OldPassword"].(string)
+			var hash string
+			dbMutex.RLock()
+			err := db.QueryRow("SELECT Password FROM User WHERE ID = ?", user.ID).Scan(&hash)
+			dbMutex.RUnlock()
+			if err != nil || !CheckPassword(oldPassword, hash) {
+				log.Printf("%s %s 修改密码失败：原密码不正确 | %s\n", ip, user.Name, ua)
+				http.Error(w, "原密码不正确", http.StatusForbidden)
+				return
+			}
+			name, role = user.Name, ""
+		}
+		if role != "" {
+			if _, ok := roleLevels[role]; !ok {
+				http.Error(w, "角色不正确，可选 viewer、operator、admin", http.StatusBadRequest)
+				return
+			}
+			found, err := updateUser("UPDATE User SET Role = ? WHERE Name = ?", role, name)
+			if err != nil {
+				http.Error(w, "内部错误：更新用户失败", http.StatusInternalServerError)
+				return
+			}
+			if !found {
+				http.Error(w, "未找到用户", http.StatusNotFound)
+				return
+			}
+		}
+		if password != "" {
+			hash, err := HashPassword(password)
+			if err != nil {
+				http.Error(w, "内部错误：密码处理失败", http.StatusInternalServerError)
+				return
+			}
+			found, err := updateUser("UPDATE User SET Password = ? WHERE Name = ?", hash, name)
+			if err != nil {
+				http.Error(w, "内部错误：更新用户失败", http.StatusInternalServerError)
+				return
+			}
+			if !found {
+				http.Error(w, "未找到用户", http.StatusNotFound)
+				return
+			}
+			// 修改密码后已有会话全部失效
+			if err := SQLWrite("DELETE FROM Session WHERE UserID = (SELECT ID FROM User WHERE Name = ?)", name); err != nil {
+				http.Error(w, "内部错误：删除会话失败", http.StatusInternalServerError)
+				return
+			}
+		}
+		log.Printf("%s %s 更新用户 %s | %s\n", ip, user.Name, name, ua)
+		w.Write([]byte("更新成功"))
+	}
+}
+
+// updateUser 更新用户，返回用户是否存在
+func updateUser(query string, args ...interface{}) (bool, error) {
+	dbMutex.Lock()
+	result, err := db.Exec(query, args...)
+	dbMutex.Unlock()
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
@@ -3,12 +3,13 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"log"
-	"net"
 	"net/http"
 	"strconv"
 	"strings"
@@ -30,6 +31,7 @@ var WSUpgrade = websocket.Upgrader{
 
 var WSConnections = make(map[string]map[string]interface{}) // 存储所有连接的客户端
 var activeMutex sync.Mutex                                  // 连接锁
+var writeMutexes sync.Map                                   // 每个连接的写锁 *websocket.Conn -> *sync.Mutex，同一连接同时只能有一个写入
 
 // GetGzip 封装或解压数据
 func GetGzip(data []byte, compress bool) ([]byte, error) {
@@ -82,6 +84,11 @@ func BroadWS(w http.ResponseWriter, r *http.Request) {
 	AddWSClient(clientKey, clientAddr, clientIPType, clientUA, "", "广播", conn)
 	defer RemoveWSClient(clientKey)
 
+	// 通过 ?selector= 订阅部分节点，连接后也可发送 {"action":"subscribe","selector":"..."} 修改
+	if !subscribe(clientKey, r.URL.Query().Get("selector")) {
+		return
+	}
+
 	// 广播状态
 	if !isBroad {
 		isBroad = true // 至少有一个客户端连接时启用广播
@@ -89,17 +96,54 @@ func BroadWS(w http.ResponseWriter, r *http.Request) {
 	}
 
 	for {
-		_, _, err := conn.ReadMessage()
+		_, message, err := conn.ReadMessage()
 		if err != nil {
 			break
 		}
+		var request struct {
+			Action   string `json:"action"`
+			Selector string `json:"selector"`
+		}
+		if json.Unmarshal(message, &request) == nil && request.Action == "subscribe" {
+			subscribe(clientKey, request.Selector)
+		}
 	}
 }
 
+// subscribe 设置广播客户端订阅的选择器，格式错误时通知客户端并返回 false
+func subscribe(clientKey, text string) bool {
+	selector, err := ParseSelector(text)
+	if err != nil {
+		message, _ := json.Marshal(map[string]string{"error": err.Error()})
+		SendToClient(clientKey, string(message))
+		return false
+	}
+	activeMutex.Lock()
+	if clientInfo, ok := WSConnections[clientKey]; ok {
+		clientInfo["Selector"] = selector
+	}
+	activeMutex.Unlock()
+	return true
+}
+
 func NodeWS(w http.ResponseWriter, r *http.Request) {
 	var clientAddr, clientKey, clientUA, clientIPType, clientEncoding string
 	var NodeID int
 
+	// 禁止名单中或已被锁定的地址直接拒绝
+	ip, _ := RealIP(r)
+	if ok, wait := CheckLimit(ip, "节点登录"); !ok {
+		LimitError(w, wait)
+		return
+	}
+
+	// 要求客户端证书时，未提供证书的连接直接拒绝
+	certNames := NodeCertName(r)
+	if len(certNames) == 0 && config.TLSClientAuth == "require" {
+		http.Error(w, "需要客户端证书", http.StatusForbidden)
+		return
+	}
+
 	// 升级到WS
 	conn, err := WSUpgrade.Upgrade(w, r, nil)
 	if err != nil {
@@ -111,11 +155,18 @@ func NodeWS(w http.ResponseWriter, r *http.Request) {
 	AddWSClient(clientKey, clientAddr, clientIPType, clientUA, clientEncoding, "节点", conn)
 	defer RemoveWSClient(clientKey)
 
-	// 发送欢迎信息
+	// 发送欢迎信息，nonce 用于挑战应答登录，每个连接只能使用一次
+	nonce, err := randomHex(16)
+	if err != nil {
+		log.Printf("生成 nonce 失败: %v", err)
+		return
+	}
+	loginAttempts := 0 // 本连接的登录尝试次数
 	welcomeMessage := map[string]interface{}{
 		"status":  0,
 		"message": "LightMonitor",
 		"version": version,
+		"nonce":   nonce,
 	}
 
 	message, err := json.Marshal(welcomeMessage)
@@ -167,8 +218,74 @@ func NodeWS(w http.ResponseWriter, r *http.Request) {
 			// 判断行为逻辑
 			if action, ok := received["action"]; ok {
 				switch action {
-				// 处理登录
+				// 处理挑战应答登录
+				case "auth":
+					if nonce == "" || NodeID != 0 {
+						err = SendWS(conn, []byte(`{"status":3,"message":"nonce 已使用，请重新连接"}`), clientEncoding)
+						if err != nil {
+							return
+						}
+						continue
+					}
+
+					if !allowLogin(&loginAttempts, clientAddr) {
+						return
+					}
+					err, NodeID = AuthLogin(conn, clientKey, received, nonce, clientAddr, clientEncoding, certNames)
+					nonce = ""
+					recordLogin(clientAddr, NodeID)
+					if err != nil {
+						log.Printf("登录失败: %v\n", err)
+						break
+					}
+				// 只使用客户端证书登录
+				case "cert":
+					if NodeID != 0 {
+						err = SendWS(conn, []byte(`{"status":3,"message":"已登录"}`), clientEncoding)
+						if err != nil {
+							return
+						}
+						continue
+					}
+
+					if !allowLogin(&loginAttempts, clientAddr) {
+						return
+					}
+					err, NodeID = CertLogin(conn, clientKey, clientAddr, clientEncoding, certNames)
+					nonce = ""
+					recordLogin(clientAddr, NodeID)
+					if err != nil {
+						log.Printf("登录失败: %v\n", err)
+						break
+					}
+				// 使用注册码添加节点，成功后客户端使用新的 Token 在本连接继续登录
+				case "enroll":
+					if NodeID != 0 {
+						err = SendWS(conn, []byte(`{"status":3,"message":"已登录"}`), clientEncoding)
+						if err != nil {
+							return
+						}
+						continue
+					}
+
+					if !allowLogin(&loginAttempts, clientAddr) {
+						return
+					}
+					err = Enroll(conn, received, clientAddr, clientEncoding)
+					if err != nil {
+						log.Printf("注册失败: %v\n", err)
+						break
+					}
+				// 处理旧版登录
 				case "login":
+					if !config.LegacyLogin {
+						log.Printf("%s 使用旧版登录被拒绝\n", clientAddr)
+						err = SendWS(conn, []byte(`{"status":3,"message":"服务端已禁用旧版登录，请升级客户端"}`), clientEncoding)
+						if err != nil {
+							return
+						}
+						continue
+					}
 					tokenRaw, exists := received["token"]
 					if !exists {
 						log.Printf("Token不存在: \n")
@@ -198,7 +315,11 @@ func NodeWS(w http.ResponseWriter, r *http.Request) {
 					}
 
 					// 处理登录
-					err, NodeID = Login(conn, clientKey, token, clientAddr, clientEncoding)
+					if !allowLogin(&loginAttempts, clientAddr) {
+						return
+					}
+					err, NodeID = Login(conn, clientKey, token, clientAddr, clientEncoding, certNames)
+					recordLogin(clientAddr, NodeID)
 					if err != nil {
 						log.Printf("登录失败: %v\n", err)
 						break
@@ -207,15 +328,18 @@ func NodeWS(w http.ResponseWriter, r *http.Request) {
 				case "report":
 					// 提取数据
 					data, exists := received["data"].(map[string]interface{})
-					if !exists {
-						log.Printf("report 数据缺失或格式错误: %v\n", received)
+					if !exists || NodeID == 0 {
+						log.Printf("report 数据缺失或未登录: %v\n", clientAddr)
 						err := SendWS(conn, []byte(`{"status":3,"message":"非法请求"}`), clientEncoding)
 						if err != nil {
 							return
 						}
+						continue
 					}
 
 					// 处理数据
+					reportsTotal.Add(1)
+					Forward(NodeID, data)
 					err = GetData(NodeID, data)
 					if err != nil {
 						log.Printf("处理 report 数据失败: %v\n", err)
@@ -223,6 +347,7 @@ func NodeWS(w http.ResponseWriter, r *http.Request) {
 						if err != nil {
 							return
 						}
+						continue
 					}
 
 					// 上报成功
@@ -231,6 +356,65 @@ func NodeWS(w http.ResponseWriter, r *http.Request) {
 						continue
 					}
 
+				// 处理离线数据补发
+				case "backfill":
+					data, exists := received["data"].(map[string]interface{})
+					if !exists || NodeID == 0 {
+						log.Printf("backfill 数据缺失或未登录: %v\n", clientAddr)
+						err := SendWS(conn, []byte(`{"status":3,"message":"非法请求"}`), clientEncoding)
+						if err != nil {
+							return
+						}
+						continue
+					}
+
+					Forward(NodeID, data)
+					err = SaveBackfill(NodeID, data)
+					if err != nil {
+						log.Printf("处理 backfill 数据失败: %v\n", err)
+						err := SendWS(conn, []byte(`{"status":3,"message":"服务器内部错误"}`), clientEncoding)
+						if err != nil {
+							return
+						}
+						continue
+					}
+
+					err = SendWS(conn, []byte(`{"status":1}`), clientEncoding)
+					if err != nil {
+						continue
+					}
+
+				// 处理进程上报
+				case "process":
+					data, exists := received["data"].(map[string]interface{})
+					if !exists || NodeID == 0 {
+						log.Printf("process 数据缺失或未登录: %v\n", clientAddr)
+						err := SendWS(conn, []byte(`{"status":3,"message":"非法请求"}`), clientEncoding)
+						if err != nil {
+							return
+						}
+						continue
+					}
+
+					err = SaveProcess(NodeID, data)
+					if err != nil {
+						log.Printf("处理 process 数据失败: %v\n", err)
+					}
+
+				// 处理远程命令的结果
+				case "command_result":
+					data, exists := received["data"].(map[string]interface{})
+					if !exists || NodeID == 0 {
+						log.Printf("command_result 数据缺失或未登录: %v\n", clientAddr)
+						err := SendWS(conn, []byte(`{"status":3,"message":"非法请求"}`), clientEncoding)
+						if err != nil {
+							return
+						}
+						continue
+					}
+
+					DeliverCommandResult(NodeID, data)
+
 				// 非法请求
 				default:
 					err := SendWS(conn, []byte(`{"status":3,"message":"非法请求"}`), clientEncoding)
@@ -248,8 +432,35 @@ func NodeWS(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// allowLogin 同一连接再次尝试登录时同样受频率限制，首次尝试已在建立连接时检查
+func allowLogin(attempts *int, ip string) bool {
+	*attempts++
+	if *attempts == 1 {
+		return true
+	}
+	if ok, _ := CheckLimit(ip, "节点登录"); !ok {
+		log.Printf("%s 登录尝试过于频繁，已断开\n", ip)
+		return false
+	}
+	return true
+}
+
+// recordLogin 记录节点登录结果
+func recordLogin(ip string, nodeID int) {
+	if nodeID == 0 {
+		RecordFailure(ip, "节点登录")
+	} else {
+		RecordSuccess(ip)
+	}
+}
+
 // SendWS 发送websocket消息，支持gzip压缩
+// 所有写入都经过该函数，使用连接的写锁避免回复、远程命令及广播同时写入同一连接
 func SendWS(conn *websocket.Conn, message []byte, clientEncoding string) error {
+	lock, _ := writeMutexes.LoadOrStore(conn, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
 	var err error
 	switch clientEncoding {
 	case "gzip":
@@ -288,6 +499,7 @@ func StartBroad() {
 			continue
 		}
 
+		cache := make(map[string][]byte) // 相同选择器的订阅只生成一次数据
 		for _, clientInfo := range WSConnections {
 			if clientInfo["Type"] == "广播" {
 				wsConn, ok := clientInfo["Conn"].(*websocket.Conn)
@@ -296,7 +508,11 @@ func StartBroad() {
 					continue
 				}
 
-				err := SendWS(wsConn, []byte(BroadData), "")
+				data := []byte(BroadData)
+				if selector, ok := clientInfo["Selector"].(Selector); ok && len(selector) > 0 {
+					data = SelectBroadData(selector, cache)
+				}
+				err := SendWS(wsConn, data, "")
 				if err != nil {
 					log.Printf("广播发送失败 %v", err)
 					continue
@@ -307,42 +523,78 @@ func StartBroad() {
 	}
 }
 
-// Login 用户登录函数
-func Login(conn *websocket.Conn, clientKey, token, NodeIP, clientEncoding string) (error, int) {
-	var nodeID int
-	var name, region, city string
-	var nameStr, regionStr, cityStr *string
-
-	rows, err := SQLRead("SELECT ID, Name, Region, City FROM Node WHERE Token = ?", token)
+// Login 旧版登录，客户端直接发送 Token
+func Login(conn *websocket.Conn, clientKey, token, NodeIP, clientEncoding string, certNames []string) (error, int) {
+	nodeID, old, err := FindNodeByToken(token)
 	if err != nil {
-		err := SendWS(conn, []byte(`{"status":3,"message":"服务器内部错误"}`), clientEncoding)
-		if err != nil {
-			return err, nodeID
-			rows.Close()
-			dbMutex.RUnlock()
+		log.Printf("查询节点 Token 失败: %v", err)
+		if err := SendWS(conn, []byte(`{"status":3,"message":"服务器内部错误"}`), clientEncoding); err != nil {
+			return err, 0
 		}
+		return fmt.Errorf("查询节点 Token 失败: %w", err), 0
+	}
+	if nodeID == 0 {
+		log.Printf("%s Token无效", NodeIP)
+		return SendWS(conn, []byte(`{"status":2,"message":"无效Token"}`), clientEncoding), 0
 	}
 
-	if rows.Next() {
-		err := rows.Scan(&nodeID, &nameStr, &regionStr, &cityStr)
-		if err != nil {
-			log.Printf("读取节点信息失败: %v", err)
-			err := SendWS(conn, []byte(`{"status":3,"message":"服务器内部错误"}`), clientEncoding)
-			if err != nil {
-				rows.Close()
-				dbMutex.RUnlock()
-				return err, nodeID
-			}
-			return fmt.Errorf("读取节点信息失败: %w", err), nodeID
+	// 升级前添加的节点没有 AuthKey，主密钥更换后也无法解密，旧版登录时重新保存
+	if !old {
+		if err := SaveAuthKey(nodeID, token); err != nil {
+			log.Printf("保存节点认证信息失败: %v", err)
 		}
-	} else {
-		log.Printf("%s Token无效", NodeIP)
-		rows.Close()
-		dbMutex.RUnlock()
-		return SendWS(conn, []byte(`{"status":2,"message":"无效Token"}`), clientEncoding), nodeID
 	}
-	rows.Close()
+
+	return completeLogin(conn, clientKey, nodeID, NodeIP, clientEncoding, certNames, "")
+}
+
+// AuthLogin 挑战应答登录，客户端使用 AuthKey 对服务端的 nonce 和自己的 cnonce 计算 MAC
+// 服务端在登录响应中返回对 cnonce 和 nonce 的 MAC，供客户端验证服务端
+func AuthLogin(conn *websocket.Conn, clientKey string, received map[string]interface{}, nonce, NodeIP, clientEncoding string, certNames []string) (error, int) {
+	// 旧版本服务端按客户端发送的 id 查找节点，现在直接以 MAC 校验各节点的 AuthKey
+	cnonce, _ := received["cnonce"].(string)
+	mac, _ := received["mac"].(string)
+	if len(cnonce) < 16 || mac == "" {
+		return SendWS(conn, []byte(`{"status":3,"message":"认证信息不完整"}`), clientEncoding), 0
+	}
+
+	nodeID, authKey, err := FindNodeByAuth(nonce, cnonce, mac)
+	if err != nil {
+		log.Printf("查询节点认证信息失败: %v", err)
+		if err := SendWS(conn, []byte(`{"status":3,"message":"服务器内部错误"}`), clientEncoding); err != nil {
+			return err, 0
+		}
+		return fmt.Errorf("查询节点认证信息失败: %w", err), 0
+	}
+	if nodeID == 0 {
+		// 升级前添加的节点尚未保存 AuthKey，提示轮换 Token；客户端不会因此改用旧版登录
+		if MissingAuthKey() {
+			return SendWS(conn, []byte(`{"status":5,"message":"节点尚未保存认证信息，请使用旧版客户端登录一次或在控制台轮换该节点的 Token"}`), clientEncoding), 0
+		}
+		log.Printf("%s 认证失败", NodeIP)
+		return SendWS(conn, []byte(`{"status":2,"message":"认证失败"}`), clientEncoding), 0
+	}
+
+	return completeLogin(conn, clientKey, nodeID, NodeIP, clientEncoding, certNames, authMAC(authKey, cnonce+":"+nonce))
+}
+
+// completeLogin 认证通过后校验客户端证书，记录节点信息并发送登录响应
+func completeLogin(conn *websocket.Conn, clientKey string, nodeID int, NodeIP, clientEncoding string, certNames []string, proof string) (error, int) {
+	var name, region, city string
+	var nameStr, regionStr, cityStr *string
+
+	var allowedIPs *string
+
+	dbMutex.RLock()
+	err := db.QueryRow("SELECT Name, Region, City, AllowedIPs FROM Node WHERE ID = ?", nodeID).Scan(&nameStr, &regionStr, &cityStr, &allowedIPs)
 	dbMutex.RUnlock()
+	if err != nil {
+		log.Printf("读取节点信息失败: %v", err)
+		if err := SendWS(conn, []byte(`{"status":3,"message":"服务器内部错误"}`), clientEncoding); err != nil {
+			return err, nodeID
+		}
+		return fmt.Errorf("读取节点信息失败: %w", err), nodeID
+	}
 
 	name = ""
 	region = ""
@@ -358,6 +610,17 @@ func Login(conn *websocket.Conn, clientKey, token, NodeIP, clientEncoding string
 		city = *cityStr
 	}
 
+	// Token 正确但来源地址不在允许范围内，可能是 Token 已泄露
+	if !IPAllowed(stringValue(allowedIPs), NodeIP) {
+		AddEvent("ip_denied", NodeIP, fmt.Sprintf("节点 %s 使用正确的 Token 从不允许的地址登录", name))
+		return SendWS(conn, []byte(`{"status":2,"message":"来源地址不在允许范围内"}`), clientEncoding), 0
+	}
+
+	if err := CheckNodeCert(certNames, name); err != nil {
+		log.Printf("%s 节点 %s 证书校验失败: %v\n", NodeIP, name, err)
+		return SendWS(conn, []byte(`{"status":2,"message":"客户端证书与节点不匹配"}`), clientEncoding), 0
+	}
+
 	err = SQLWrite("UPDATE Node SET IP = ? WHERE ID = ?", NodeIP, nodeID)
 	if err != nil {
 		log.Printf("%s 更新 Node IP 失败，UID: %s, 错误: %v\n", NodeIP, clientKey, err)
@@ -387,10 +650,15 @@ func Login(conn *websocket.Conn, clientKey, token, NodeIP, clientEncoding string
 			"city":   city,
 		},
 	}
+	if proof != "" {
+		response["data"].(map[string]string)["proof"] = proof
+	}
 
-	// 为WebSocket连接添加登录信息
+	// 为WebSocket连接添加登录信息，远程命令按 NodeID 查找节点当前的连接
 	activeMutex.Lock()
 	WSConnections[clientKey]["name"] = name
+	WSConnections[clientKey]["NodeID"] = nodeID
+	WSConnections[clientKey]["LoginAt"] = time.Now().UnixNano()
 	activeMutex.Unlock()
 
 	log.Printf("%s 登录成功！名称: %s, 地区: %s, 城市: %s\n", NodeIP, name, region, city)
@@ -437,8 +705,6 @@ func CheckBroad() {
 	rows, err := SQLRead(`SELECT UID FROM Client WHERE Type == '广播' LIMIT 1`)
 	if err != nil {
 		log.Printf("检查是否需要广播错误: %v", err)
-		rows.Close()
-		dbMutex.RUnlock()
 		return
 	}
 
@@ -462,6 +728,7 @@ func RemoveWSClient(clientKey string) {
 	if exists {
 		if conn, ok := connMap["Conn"].(*websocket.Conn); ok {
 			conn.Close()
+			writeMutexes.Delete(conn)
 		}
 		clientType = WSConnections[clientKey]["Type"]
 		delete(WSConnections, clientKey)
@@ -471,8 +738,6 @@ func RemoveWSClient(clientKey string) {
 		rows, err := SQLRead("SELECT IP, UA FROM Client WHERE UID = ?", clientKey)
 		if err != nil {
 			log.Printf("查询客户端信息失败: %v\n", err)
-			rows.Close()
-			dbMutex.RUnlock()
 			return
 		}
 
@@ -525,6 +790,25 @@ func SendToClient(clientKey, message string) error {
 	return fmt.Errorf("找不到客户端连接: %s", clientKey)
 }
 
+// NodeClientKey 查找节点当前的连接，节点不在线时返回空字符串
+// 节点重连时旧连接可能尚未断开，使用最后登录的连接
+func NodeClientKey(nodeID int) string {
+	activeMutex.Lock()
+	defer activeMutex.Unlock()
+
+	var clientKey string
+	var lastLogin int64
+	for key, clientInfo := range WSConnections {
+		if id, _ := clientInfo["NodeID"].(int); id != nodeID {
+			continue
+		}
+		if loginAt, _ := clientInfo["LoginAt"].(int64); clientKey == "" || loginAt > lastLogin {
+			clientKey, lastLogin = key, loginAt
+		}
+	}
+	return clientKey
+}
+
 // KickClient 删除节点时检查客户端并发送消息或断开连接
 func KickClient(ID int) {
 	rows, err := SQLRead("SELECT UID FROM Client WHERE ID = ?", ID)
@@ -533,13 +817,20 @@ func KickClient(ID int) {
 		return
 	}
 
+	// 先读取全部 UID 并释放读锁，RemoveWSClient 会获取 activeMutex 并再次读取数据库
+	var clientKeys []string
 	for rows.Next() {
 		var clientKey string
 		if err := rows.Scan(&clientKey); err != nil {
 			log.Printf("扫描客户端UID失败: %v", err)
 			continue
 		}
+		clientKeys = append(clientKeys, clientKey)
+	}
+	rows.Close()
+	dbMutex.RUnlock()
 
+	for _, clientKey := range clientKeys {
 		err := SendToClient(clientKey, `{"status":2, "message":"你已被删除"}`)
 		if err != nil {
 			log.Printf("向客户端 %s 发送消息失败: %v\n", clientKey, err)
@@ -547,15 +838,13 @@ func KickClient(ID int) {
 		RemoveWSClient(clientKey)
 		//log.Printf("客户端 %s 由于被删除已踢出\n", clientKey)
 	}
-	rows.Close()
-	dbMutex.RUnlock()
 }
 
 // Console 处理所有在 config.BroadURI 路径下的 HTTP POST 请求
 func Console(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "POST")
-	w.Header().Set("Access-Control-Allow-Headers", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "*, Authorization")
 	w.Header().Set("Access-Control-Allow-Credentials", "*")
 
 	_, ip, _, ua, _ := ClientInfo(r) // 获取客户端信息
@@ -575,20 +864,21 @@ func Console(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		Token, ok := requestData["Token"].(string)
-		if !ok {
-			logMessage := fmt.Sprintf("%s 未携带密钥 | %s", ip, ua)
-			log.Printf(logMessage)
-			http.Error(w, "未携带密钥", http.StatusUnauthorized)
+		if ok, wait := CheckLimit(ip, "控制台"); !ok {
+			LimitError(w, wait)
 			return
 		}
 
-		if Token != config.Token {
-			logMessage := fmt.Sprintf("%s 密钥不正确 | %s", ip, ua)
+		Token, _ := requestData["Token"].(string)
+		user, err := Authenticate(r, Token)
+		if err != nil {
+			logMessage := fmt.Sprintf("%s 认证失败: %v | %s", ip, err, ua)
 			log.Printf(logMessage)
-			http.Error(w, fmt.Sprintf("密钥不正确"), http.StatusUnauthorized)
+			RecordFailure(ip, "控制台")
+			http.Error(w, fmt.Sprintf("认证失败: %v", err), http.StatusUnauthorized)
 			return
 		}
+		RecordSuccess(ip)
 
 		action, ok := requestData["Action"].(string)
 		if !ok {
@@ -598,180 +888,330 @@ func Console(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		switch action {
-		case "Add":
-			name := requestData["Name"].(string)
-			token := requestData["NodeToken"].(string)
-			region := requestData["Region"].(string)
-			city := requestData["City"].(string)
+		if !user.Can(action) {
+			logMessage := fmt.Sprintf("%s 用户 %s（%s）无权执行 %s | %s", ip, user.Name, user.Role, action, ua)
+			log.Printf(logMessage)
+			http.Error(w, "权限不足", http.StatusForbidden)
+			return
+		}
 
-			var notAdd bool
-			notAdd = false
+		// 记录修改类操作的操作人、修改前后的值及结果
+		if auditActions[action] {
+			target, afterTarget := auditTarget(user, action, requestData)
+			var finish func()
+			w, finish = startAudit(w, user, ip, ua, action, target, afterTarget)
+			defer finish()
+		}
 
-			// 检查节点是否已存在
-			rows, err := SQLRead("SELECT ID FROM Node WHERE Name = ?", name)
+		switch action {
+		case "List":
+			text, _ := requestData["Selector"].(string)
+			selector, err := ParseSelector(text)
 			if err != nil {
-				logMessage := fmt.Sprintf("%s 节点 %s 更新失败，内部错误：数据库查询失败 | %s", ip, name, ua)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			nodes, err := ListNodes()
+			if err != nil {
+				logMessage := fmt.Sprintf("%s 获取节点列表失败: %v | %s", ip, err, ua)
 				log.Printf(logMessage)
-				http.Error(w, fmt.Sprintf("内部错误：数据库查询失败"), http.StatusInternalServerError)
-				rows.Close()
-				dbMutex.RUnlock()
+				http.Error(w, "内部错误：数据库查询失败", http.StatusInternalServerError)
 				return
 			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(FilterNodes(nodes, selector))
 
-			if rows.Next() {
-				var nodeID int
-				if err := rows.Scan(&nodeID); err != nil {
-					logMessage := fmt.Sprintf("%s 节点 %s 更新失败，内部错误：检查节点失败 | %s", ip, name, ua)
-					log.Printf(logMessage)
-					http.Error(w, fmt.Sprintf("内部错误：检查节点失败"), http.StatusInternalServerError)
-					notAdd = true
-					rows.Close()
-					dbMutex.RUnlock()
-					return
+		case "UserList", "UserAdd", "UserDelete", "UserPassword", "Password":
+			UserAction(w, user, action, requestData, ip, ua)
 
-				}
-				logMessage := fmt.Sprintf("%s 节点 %s 已存在，ID: %d，增加节点取消 | %s", ip, name, nodeID, ua)
-				log.Printf(logMessage)
-				http.Error(w, fmt.Sprintf("添加节点失败: 节点已存在，请不要使用相同的节点名称"), http.StatusInternalServerError)
-				notAdd = true
-				rows.Close()
-				dbMutex.RUnlock()
+		case "Events":
+			ListEvents(w, requestData)
+
+		case "Audit":
+			ListAudit(w, requestData)
+
+		case "Add":
+			// 兼容旧版控制台，转换为 CreateNode 的请求
+			allowedIPs, err := consoleList(requestData["AllowedIPs"])
+			if err != nil {
+				http.Error(w, fmt.Sprintf("添加节点失败: %v", err), http.StatusBadRequest)
 				return
 			}
-			rows.Close()
-			dbMutex.RUnlock()
-
-			// 检查Token是否已存在
-			rows, err = SQLRead("SELECT ID FROM Node WHERE Token = ?", token)
+			labels, err := consoleLabels(requestData["Labels"])
 			if err != nil {
-				logMessage := fmt.Sprintf("%s 节点 %s 更新失败，内部错误：数据库查询失败 | %s", ip, name, ua)
-				log.Printf(logMessage)
-				http.Error(w, fmt.Sprintf("内部错误：数据库查询失败"), http.StatusInternalServerError)
-				notAdd = true
-				rows.Close()
-				dbMutex.RUnlock()
+				http.Error(w, fmt.Sprintf("添加节点失败: %v", err), http.StatusBadRequest)
 				return
 			}
-
-			if rows.Next() {
-				var nodeID int
-				if err := rows.Scan(&nodeID); err != nil {
-					logMessage := fmt.Sprintf("%s 节点 %s 更新失败，内部错误：检查节点失败 | %s", ip, name, ua)
-					log.Printf(logMessage)
-					http.Error(w, fmt.Sprintf("内部错误：检查节点失败"), http.StatusInternalServerError)
-					notAdd = true
-					rows.Close()
-					dbMutex.RUnlock()
-					return
-
-				}
-				logMessage := fmt.Sprintf("%s Token %s 已存在，ID: %d，增加节点取消 | %s", ip, name, nodeID, ua)
-				log.Printf(logMessage)
-				http.Error(w, fmt.Sprintf("添加节点失败: Token已存在，请不要使用相同的Token"), http.StatusInternalServerError)
-				notAdd = true
-				rows.Close()
-				dbMutex.RUnlock()
+			groups, err := consoleList(requestData["Groups"])
+			if err != nil {
+				http.Error(w, fmt.Sprintf("添加节点失败: %v", err), http.StatusBadRequest)
 				return
 			}
-			rows.Close()
-			dbMutex.RUnlock()
+			req := NodeCreateRequest{AllowedIPs: allowedIPs, Labels: labels, Groups: groups}
+			req.Name, _ = requestData["Name"].(string)
+			req.Token, _ = requestData["NodeToken"].(string)
+			req.Region, _ = requestData["Region"].(string)
+			req.City, _ = requestData["City"].(string)
 
-			if notAdd == false {
-				err = AddNode(name, token, region, city)
-				if err != nil {
-					logMessage := fmt.Sprintf("%s 节点 %s 添加失败: %v | %s", ip, name, err, ua)
-					log.Printf(logMessage)
-					http.Error(w, fmt.Sprintf("添加节点失败: %v", err), http.StatusInternalServerError)
-					return
-				}
+			node, err := CreateNode(req)
+			if err != nil {
+				logMessage := fmt.Sprintf("%s 节点 %s 添加失败: %v | %s", ip, req.Name, err, ua)
+				log.Printf(logMessage)
+				consoleError(w, "添加节点失败", err)
+				return
 			}
 
-			logMessage := fmt.Sprintf("%s 节点添加成功，名称:%s，Token:%s，地区:%s，城市:%s | %s", ip, name, token, region, city, ua)
+			logMessage := fmt.Sprintf("%s %s 节点添加成功，名称:%s，地区:%s，城市:%s | %s", ip, user.Name, node.Name, node.Region, node.City, ua)
 			log.Printf(logMessage)
 			w.WriteHeader(http.StatusOK)
 			w.Write([]byte("添加成功"))
-			return
 
 		case "Delete":
-			name := requestData["Name"].(string)
+			name, _ := requestData["Name"].(string)
 			id, err := GetIDByName(name)
+			if err == nil {
+				err = RemoveNode(id)
+			}
 			if err != nil {
-				logMessage := fmt.Sprintf("%s 获取节点ID失败: %v | %s", ip, err, ua)
+				logMessage := fmt.Sprintf("%s 节点 %s 删除失败: %v | %s", ip, name, err, ua)
 				log.Printf(logMessage)
-				http.Error(w, fmt.Sprintf("获取节点ID失败: %v", err), http.StatusInternalServerError)
+				consoleError(w, "删除节点失败", err)
 				return
 			}
-			if id > 0 {
-				err := DeleteNode(id)
+
+			logMessage := fmt.Sprintf("%s %s 节点 %s 删除成功 | %s", ip, user.Name, name, ua)
+			log.Printf(logMessage)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("删除成功"))
+
+		case "Update":
+			// 兼容旧版控制台，空字符串表示不修改；传入 AllowedIPs、Labels、Groups 时整体替换，为空时清除
+			name, _ := requestData["OriginName"].(string)
+			var req NodeUpdateRequest
+			for field, value := range map[string]**string{"Name": &req.Name, "Region": &req.Region, "City": &req.City} {
+				if v, _ := requestData[field].(string); v != "" {
+					*value = &v
+				}
+			}
+			if value, ok := requestData["AllowedIPs"]; ok {
+				allowedIPs, err := consoleList(value)
 				if err != nil {
-					logMessage := fmt.Sprintf("%s 删除节点失败: %v | %s", ip, err, ua)
-					log.Printf(logMessage)
-					http.Error(w, fmt.Sprintf("删除节点失败: %v", err), http.StatusInternalServerError)
+					http.Error(w, fmt.Sprintf("更新节点失败: %v", err), http.StatusBadRequest)
 					return
 				}
-				KickClient(id)
+				req.AllowedIPs = &allowedIPs
+			}
+			if value, ok := requestData["Labels"]; ok {
+				labels, err := consoleLabels(value)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("更新节点失败: %v", err), http.StatusBadRequest)
+					return
+				}
+				req.Labels = &labels
+			}
+			if value, ok := requestData["Groups"]; ok {
+				groups, err := consoleList(value)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("更新节点失败: %v", err), http.StatusBadRequest)
+					return
+				}
+				req.Groups = &groups
+			}
 
-				logMessage := fmt.Sprintf("%s 节点 %s 删除成功 | %s", ip, name, ua)
+			id, err := GetIDByName(name)
+			if err == nil {
+				_, err = PatchNode(id, req)
+			}
+			if err != nil {
+				logMessage := fmt.Sprintf("%s 节点 %s 更新失败: %v | %s", ip, name, err, ua)
 				log.Printf(logMessage)
-				w.WriteHeader(http.StatusOK)
-				w.Write([]byte("删除成功"))
-			} else {
-				logMessage := fmt.Sprintf("%s 节点 %s 删除失败，未找到节点 | %s", ip, name, ua)
+				consoleError(w, "更新节点失败", err)
+				return
+			}
+
+			logMessage := fmt.Sprintf("%s %s 节点 %s 更新成功 | %s", ip, user.Name, name, ua)
+			log.Printf(logMessage)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("更新成功"))
+
+		case "Rotate":
+			name, _ := requestData["Name"].(string)
+			grace, _ := requestData["Grace"].(float64) // 旧 Token 的宽限期（秒）
+
+			id, err := GetIDByName(name)
+			if err != nil {
+				logMessage := fmt.Sprintf("%s 节点 %s 未找到 | %s", ip, name, ua)
 				log.Printf(logMessage)
 				http.Error(w, "未找到节点", http.StatusNotFound)
+				return
 			}
 
-		case "Update":
-			name := requestData["OriginName"].(string)
-			NewName := requestData["Name"].(string)
-			region := requestData["Region"].(string)
-			city := requestData["City"].(string)
+			token, err := randomHex(24)
+			if err != nil {
+				http.Error(w, "内部错误：生成 Token 失败", http.StatusInternalServerError)
+				return
+			}
+			oldExpire, err := SetNodeToken(id, token, int64(grace))
+			if err != nil {
+				logMessage := fmt.Sprintf("%s 节点 %s 轮换 Token 失败: %v | %s", ip, name, err, ua)
+				log.Printf(logMessage)
+				http.Error(w, fmt.Sprintf("轮换 Token 失败: %v", err), http.StatusInternalServerError)
+				return
+			}
+			// 没有宽限期时旧 Token 立即失效，断开当前连接
+			if grace <= 0 {
+				KickClient(id)
+			}
 
-			id, err := GetIDByName(name)
+			logMessage := fmt.Sprintf("%s %s 节点 %s 轮换 Token 成功，旧 Token 失效时间: %d | %s", ip, user.Name, name, oldExpire, ua)
+			log.Printf(logMessage)
+			// 新 Token 仅在此返回一次
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"Name":           name,
+				"Token":          token,
+				"OldTokenExpire": oldExpire,
+			})
+
+		case "Export":
+			format, _ := requestData["Format"].(string)
+			credentials, _ := requestData["Credentials"].(bool)
+			if credentials && !user.Can("ExportAuth") {
+				logMessage := fmt.Sprintf("%s 用户 %s（%s）无权执行 ExportAuth | %s", ip, user.Name, user.Role, ua)
+				log.Printf(logMessage)
+				http.Error(w, "权限不足", http.StatusForbidden)
+				return
+			}
+			records, err := ExportNodes(credentials)
 			if err != nil {
-				logMessage := fmt.Sprintf("%s 获取节点ID失败: %v | %s", ip, err, ua)
+				http.Error(w, fmt.Sprintf("导出节点失败: %v", err), http.StatusInternalServerError)
+				return
+			}
+			data, err := FormatNodeRecords(format, records)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("导出节点失败: %v", err), http.StatusBadRequest)
+				return
+			}
+			names := make([]string, 0, len(records))
+			for _, record := range records {
+				names = append(names, record.Name)
+			}
+			setAuditResult(w, map[string]interface{}{"Format": format, "Credentials": credentials, "Nodes": names})
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write(data)
+
+		case "Import":
+			format, _ := requestData["Format"].(string)
+			content, _ := requestData["Data"].(string)
+			options := ImportOptions{}
+			options.DryRun, _ = requestData["DryRun"].(bool)
+			options.OnConflict, _ = requestData["OnConflict"].(string)
+
+			records, err := ParseNodeRecords(format, []byte(content))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("导入节点失败: %v", err), http.StatusBadRequest)
+				return
+			}
+			result, err := ImportNodes(records, options)
+			if err != nil && !errors.Is(err, errImportConflict) {
+				logMessage := fmt.Sprintf("%s %s 导入节点失败: %v | %s", ip, user.Name, err, ua)
 				log.Printf(logMessage)
-				http.Error(w, fmt.Sprintf("获取节点ID失败: %v", err), http.StatusInternalServerError)
+				consoleError(w, "导入节点失败", err)
 				return
 			}
+			KickUpdatedNodes(records, result)
+			setAuditResult(w, map[string]interface{}{
+				"DryRun":    result.DryRun,
+				"Created":   result.Created,
+				"Updated":   result.Updated,
+				"Skipped":   result.Skipped,
+				"Conflicts": len(result.Conflicts),
+			})
+
+			status := http.StatusOK
+			if err != nil {
+				status = http.StatusConflict
+			}
+			logMessage := fmt.Sprintf("%s %s 导入节点，试运行:%t，添加:%d，更新:%d，跳过:%d，冲突:%d | %s", ip, user.Name, result.DryRun,
+				len(result.Created), len(result.Updated), len(result.Skipped), len(result.Conflicts), ua)
+			log.Printf(logMessage)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(result)
 
-			if id > 0 {
-				updateFields := make(map[string]interface{})
-				if NewName != "" {
-					updateFields["Name"] = NewName
-				}
-				if region != "" {
-					updateFields["Region"] = region
-				}
-				if city != "" {
-					updateFields["City"] = city
-				}
+		case "EnrollCreate":
+			labels, err := consoleLabels(requestData["Labels"])
+			if err != nil {
+				http.Error(w, fmt.Sprintf("生成注册码失败: %v", err), http.StatusBadRequest)
+				return
+			}
+			groups, err := consoleList(requestData["Groups"])
+			if err != nil {
+				http.Error(w, fmt.Sprintf("生成注册码失败: %v", err), http.StatusBadRequest)
+				return
+			}
+			ttl, _ := requestData["TTL"].(float64) // 有效期（秒）
+			region, _ := requestData["Region"].(string)
+			city, _ := requestData["City"].(string)
 
-				if len(updateFields) == 0 {
-					logMessage := fmt.Sprintf("%s 节点 %s 没有需要更新的部分 | %s", ip, name, ua)
-					log.Printf(logMessage)
-					http.Error(w, "没有需要更新的字段", http.StatusBadRequest)
-					return
-				}
+			code, expireAt, err := CreateEnrollCode(user.Name, int64(ttl), region, city, labels, groups)
+			if err != nil {
+				consoleError(w, "生成注册码失败", err)
+				return
+			}
 
-				err := UpdateNode(id, updateFields)
-				if err != nil {
-					logMessage := fmt.Sprintf("%s 节点 %s 更新失败: %v | %s", ip, name, err, ua)
-					log.Printf(logMessage)
-					http.Error(w, fmt.Sprintf("更新节点失败: %v", err), http.StatusInternalServerError)
-					return
-				}
+			logMessage := fmt.Sprintf("%s %s 生成注册码 %s，失效时间: %d | %s", ip, user.Name, code[:4], expireAt, ua)
+			log.Printf(logMessage)
+			// 注册码仅在此返回一次
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"Code":     code,
+				"ExpireAt": expireAt,
+			})
+
+		case "Command":
+			name, _ := requestData["Name"].(string)
+			command, _ := requestData["Command"].(string)
+			args, _ := requestData["Args"].(map[string]interface{})
+			timeout, _ := requestData["Timeout"].(float64) // 等待结果的时间（秒）
 
-				logMessage := fmt.Sprintf("%s 节点 %s 更新成功 | %s", ip, name, ua)
-				log.Printf(logMessage)
-				w.WriteHeader(http.StatusOK)
-				w.Write([]byte("更新成功"))
-			} else {
-				logMessage := fmt.Sprintf("%s 节点 %s 未找到 | %s", ip, name, ua)
+			id, err := GetIDByName(name)
+			if err != nil {
+				consoleError(w, "执行命令失败", err)
+				return
+			}
+			result, err := SendCommand(id, command, args, int(timeout))
+			if err != nil {
+				logMessage := fmt.Sprintf("%s %s 节点 %s 执行命令 %s 失败: %v | %s", ip, user.Name, name, command, err, ua)
 				log.Printf(logMessage)
-				http.Error(w, "未找到节点", http.StatusNotFound)
+				consoleError(w, "执行命令失败", err)
+				return
 			}
+
+			logMessage := fmt.Sprintf("%s %s 节点 %s 执行命令 %s，结果: %s | %s", ip, user.Name, name, commandSummary(command, args), result.Status, ua)
+			log.Printf(logMessage)
+			w.Header().Set("Content-Type", "application/json")
+			// 客户端不允许该命令时按无权限处理，记录为失败的操作
+			if result.Status == "denied" {
+				w.WriteHeader(http.StatusForbidden)
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"Status": result.Status,
+				"Output": result.Output,
+			})
+
+		case "EnrollList":
+			ListEnrollCodes(w)
+
+		case "EnrollDelete":
+			id, _ := requestData["ID"].(float64)
+			if err := DeleteEnrollCode(int(id)); err != nil {
+				consoleError(w, "删除注册码失败", err)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("删除成功"))
+
 		default:
 			logMessage := fmt.Sprintf("%s 操作无效 | %s", ip, ua)
 			log.Printf(logMessage)
@@ -786,43 +1226,94 @@ func DeleteNode(id int) error {
 	if err != nil {
 		return fmt.Errorf("删除节点失败: %w", err)
 	}
+	err = SQLWrite(`DELETE FROM History WHERE NodeID = ?`, id)
+	if err != nil {
+		return fmt.Errorf("删除节点历史数据失败: %w", err)
+	}
 	return nil
 }
 
+// GetNameByID 获取节点名称，查询失败时返回ID
+func GetNameByID(id int) string {
+	var name string
+	dbMutex.RLock()
+	err := db.QueryRow("SELECT Name FROM Node WHERE ID = ?", id).Scan(&name)
+	dbMutex.RUnlock()
+	if err != nil {
+		return strconv.Itoa(id)
+	}
+	return name
+}
+
 func GetIDByName(name string) (int, error) {
 	var id int
 	querySQL := "SELECT ID FROM Node WHERE Name = ?"
 	err := db.QueryRow(querySQL, name).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, errNodeNotFound
+	}
 	if err != nil {
 		return 0, fmt.Errorf("获取节点ID失败: %w", err)
 	}
 	return id, nil
 }
-func ClientInfo(r *http.Request) (string, string, string, string, string) {
-	var clientAddr, clientKey, clientUA, clientIPType, clientEncoding string
-	clientKey = strconv.Itoa(int(crc32.ChecksumIEEE([]byte(r.Header.Get("Sec-Websocket-Key")))))
 
-	xForwardedFor := r.Header.Get("X-Forwarded-For")
-	if xForwardedFor != "" {
-		clientAddr = xForwardedFor
-		clientIPType = "X-Forwarded-For"
-	} else {
-		xRealIP := r.Header.Get("X-Real-IP")
-		if xRealIP != "" {
-			clientAddr = xRealIP
-			clientIPType = "X-Real-IP"
-		} else {
-			clientAddr = r.RemoteAddr
-			host, _, err := net.SplitHostPort(clientAddr)
-			if err != nil {
-				log.Printf("解析真实地址失败: %v\n", err)
-				clientAddr = ""
-				clientIPType = ""
+// consoleList 控制台中的列表字段，可以是数组或以逗号分隔的字符串
+func consoleList(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return strings.Split(v, ","), nil
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			entry, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("列表中只能包含字符串: %v", item)
 			}
-			clientAddr = host
-			clientIPType = "RemoteIP"
+			list = append(list, entry)
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("格式错误: %v", value)
+}
+
+// consoleLabels 控制台中的标签字段，值为字符串的对象
+func consoleLabels(value interface{}) (map[string]string, error) {
+	labels := map[string]string{}
+	if value == nil {
+		return labels, nil
+	}
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("标签格式错误: %v", value)
+	}
+	for key, item := range object {
+		text, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("标签 %s 的值只能为字符串", key)
 		}
+		labels[key] = text
+	}
+	return labels, nil
+}
+
+// consoleError 以文本返回控制台的错误，状态码与 REST 接口一致
+func consoleError(w http.ResponseWriter, prefix string, err error) {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		http.Error(w, fmt.Sprintf("%s: %v", prefix, err), http.StatusInternalServerError)
+		return
 	}
+	http.Error(w, prefix+": "+apiErr.Message, apiErr.Status)
+}
+
+func ClientInfo(r *http.Request) (string, string, string, string, string) {
+	var clientAddr, clientKey, clientUA, clientIPType, clientEncoding string
+	clientKey = strconv.Itoa(int(crc32.ChecksumIEEE([]byte(r.Header.Get("Sec-Websocket-Key")))))
+
+	clientAddr, clientIPType = RealIP(r)
 
 	headers := make(map[string][]string)
 	for key, value := range r.Header {
@@ -843,4 +1334,8 @@ func initRoutes() {
 	http.HandleFunc(config.BroadURI, BroadWS)
 	http.HandleFunc(config.NodeURI, NodeWS)
 	http.HandleFunc(config.ConsoleURI, Console)
+	http.HandleFunc(config.LoginURI, ConsoleLogin)
+	http.HandleFunc(config.DetailURI, Detail)
+	http.HandleFunc(config.MetricsURI, Metrics)
+	http.HandleFunc(strings.TrimSuffix(config.APIURI, "/")+"/", API)
 }
@@ -0,0 +1,213 @@
+// Package lmclient 是 LightMonitor 管理接口（config.APIURI，默认 /api）的 Go 客户端
+// 接口定义见服务端的 openapi.json，也可通过 GET <APIURI>/openapi.json 获取
+//
+//	client := lmclient.New("https://monitor.example.com/api", token)
+//	nodes, err := client.ListNodes(ctx)
+package lmclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client 管理接口客户端
+type Client struct {
+	BaseURL    string       // 管理接口的地址，如 https://monitor.example.com/api
+	Token      string       // 控制台会话或服务端配置文件中的 token
+	HTTPClient *http.Client // 为空时使用 http.DefaultClient
+}
+
+// New 创建客户端
+func New(baseURL, token string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), Token: token}
+}
+
+// Node 节点的基本信息
+type Node struct {
+	ID         int
+	Name       string
+	Region     string
+	City       string
+	IP         string            // 最近一次登录的地址
+	AllowedIPs []string          // 允许登录的来源地址，为空时不限制
+	Labels     map[string]string // 自定义标签
+	Groups     []string          // 所属分组
+	TimeStamp  int64             // 最近一次上报的时间
+}
+
+// CreateNodeRequest 添加节点的请求，Name 和 Token 为必填
+type CreateNodeRequest struct {
+	Name       string
+	Token      string
+	Region     string            `json:",omitempty"`
+	City       string            `json:",omitempty"`
+	AllowedIPs []string          `json:",omitempty"`
+	Labels     map[string]string `json:",omitempty"`
+	Groups     []string          `json:",omitempty"`
+}
+
+// UpdateNodeRequest 修改节点的请求，为 nil 的字段不修改，AllowedIPs 指向空切片时清除限制
+// Labels 和 Groups 整体替换
+type UpdateNodeRequest struct {
+	Name       *string            `json:",omitempty"`
+	Region     *string            `json:",omitempty"`
+	City       *string            `json:",omitempty"`
+	AllowedIPs *[]string          `json:",omitempty"`
+	Labels     *map[string]string `json:",omitempty"`
+	Groups     *[]string          `json:",omitempty"`
+}
+
+// HistoryPoint 一条历史数据
+type HistoryPoint struct {
+	TimeStamp int64
+	State     map[string]interface{}
+}
+
+// Error 接口返回的错误
+type Error struct {
+	StatusCode int    `json:"-"`
+	Code       string // 错误类型，如 invalid、not_found、conflict
+	Message    string
+	Field      string // 校验失败的字段
+}
+
+func (e *Error) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("%d %s: %s (%s)", e.StatusCode, e.Code, e.Message, e.Field)
+	}
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// IsNotFound 判断错误是否为节点不存在
+func IsNotFound(err error) bool {
+	apiErr, ok := err.(*Error)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+// String 返回字符串的指针，便于构造 UpdateNodeRequest
+func String(s string) *string {
+	return &s
+}
+
+// ListNodes 获取所有节点
+func (c *Client) ListNodes(ctx context.Context) ([]Node, error) {
+	var nodes []Node
+	err := c.do(ctx, http.MethodGet, "/nodes", nil, &nodes)
+	return nodes, err
+}
+
+// SelectNodes 获取满足选择器的节点，如 group=web,env=prod
+func (c *Client) SelectNodes(ctx context.Context, selector string) ([]Node, error) {
+	var nodes []Node
+	err := c.do(ctx, http.MethodGet, "/nodes?selector="+url.QueryEscape(selector), nil, &nodes)
+	return nodes, err
+}
+
+// GetNode 获取节点信息
+func (c *Client) GetNode(ctx context.Context, id int) (*Node, error) {
+	var node Node
+	if err := c.do(ctx, http.MethodGet, "/nodes/"+strconv.Itoa(id), nil, &node); err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+// CreateNode 添加节点
+func (c *Client) CreateNode(ctx context.Context, req CreateNodeRequest) (*Node, error) {
+	var node Node
+	if err := c.do(ctx, http.MethodPost, "/nodes", req, &node); err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+// UpdateNode 修改节点
+func (c *Client) UpdateNode(ctx context.Context, id int, req UpdateNodeRequest) (*Node, error) {
+	var node Node
+	if err := c.do(ctx, http.MethodPatch, "/nodes/"+strconv.Itoa(id), req, &node); err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+// DeleteNode 删除节点及其历史数据
+func (c *Client) DeleteNode(ctx context.Context, id int) error {
+	return c.do(ctx, http.MethodDelete, "/nodes/"+strconv.Itoa(id), nil, nil)
+}
+
+// NodeHistory 获取节点在 [since, until] 内的历史数据，零值时使用服务端默认值（最近一小时），limit 为 0 时使用默认值
+func (c *Client) NodeHistory(ctx context.Context, id int, since, until time.Time, limit int) ([]HistoryPoint, error) {
+	query := url.Values{}
+	if !since.IsZero() {
+		query.Set("since", strconv.FormatInt(since.Unix(), 10))
+	}
+	if !until.IsZero() {
+		query.Set("until", strconv.FormatInt(until.Unix(), 10))
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	path := "/nodes/" + strconv.Itoa(id) + "/history"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	var points []HistoryPoint
+	err := c.do(ctx, http.MethodGet, path, nil, &points)
+	return points, err
+}
+
+// do 发送请求，body 不为 nil 时以 JSON 发送，out 不为 nil 时解析响应
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		apiErr := &Error{StatusCode: resp.StatusCode}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+		if json.Unmarshal(data, apiErr) != nil || apiErr.Code == "" {
+			apiErr.Code, apiErr.Message = "unknown", strings.TrimSpace(string(data))
+		}
+		return apiErr
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("解析响应失败: %w", err)
+	}
+	return nil
+}
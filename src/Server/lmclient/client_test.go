@@ -0,0 +1,199 @@
+package lmclient
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// recorded 测试服务端收到的请求
+type recorded struct {
+	method string
+	path   string
+	query  string
+	auth   string
+	body   map[string]interface{}
+}
+
+// newTestClient 启动返回固定响应的测试服务端，返回客户端及收到的请求
+func newTestClient(t *testing.T, status int, response string) (*Client, *recorded) {
+	t.Helper()
+	got := &recorded{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got.method, got.path, got.query = r.Method, r.URL.Path, r.URL.RawQuery
+		got.auth = r.Header.Get("Authorization")
+		if data, _ := io.ReadAll(r.Body); len(data) > 0 {
+			if err := json.Unmarshal(data, &got.body); err != nil {
+				t.Errorf("请求体不是 JSON: %s", data)
+			}
+		}
+		if response != "" {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.WriteHeader(status)
+		io.WriteString(w, response)
+	}))
+	t.Cleanup(server.Close)
+	return New(server.URL+"/api/", "secret"), got
+}
+
+func TestListNodes(t *testing.T) {
+	client, got := newTestClient(t, http.StatusOK,
+		`[{"ID":1,"Name":"web-1","Region":"cn","Labels":{"env":"prod"},"Groups":["web"],"TimeStamp":100}]`)
+
+	nodes, err := client.ListNodes(context.Background())
+	if err != nil {
+		t.Fatalf("ListNodes: %v", err)
+	}
+	if got.method != http.MethodGet || got.path != "/api/nodes" {
+		t.Errorf("请求 %s %s，应为 GET /api/nodes", got.method, got.path)
+	}
+	if got.auth != "Bearer secret" {
+		t.Errorf("Authorization 为 %q", got.auth)
+	}
+	want := []Node{{ID: 1, Name: "web-1", Region: "cn", Labels: map[string]string{"env": "prod"}, Groups: []string{"web"}, TimeStamp: 100}}
+	if !reflect.DeepEqual(nodes, want) {
+		t.Errorf("节点为 %+v，应为 %+v", nodes, want)
+	}
+}
+
+func TestSelectNodes(t *testing.T) {
+	client, got := newTestClient(t, http.StatusOK, `[]`)
+
+	if _, err := client.SelectNodes(context.Background(), "group=web,env=prod"); err != nil {
+		t.Fatalf("SelectNodes: %v", err)
+	}
+	if got.query != "selector=group%3Dweb%2Cenv%3Dprod" {
+		t.Errorf("查询参数为 %q", got.query)
+	}
+}
+
+func TestCreateNode(t *testing.T) {
+	client, got := newTestClient(t, http.StatusCreated, `{"ID":2,"Name":"db-1","Region":"us"}`)
+
+	node, err := client.CreateNode(context.Background(), CreateNodeRequest{Name: "db-1", Token: "tok", Region: "us"})
+	if err != nil {
+		t.Fatalf("CreateNode: %v", err)
+	}
+	if got.method != http.MethodPost || got.path != "/api/nodes" {
+		t.Errorf("请求 %s %s，应为 POST /api/nodes", got.method, got.path)
+	}
+	want := map[string]interface{}{"Name": "db-1", "Token": "tok", "Region": "us"}
+	if !reflect.DeepEqual(got.body, want) {
+		t.Errorf("请求体为 %v，应为 %v（空字段不发送）", got.body, want)
+	}
+	if node.ID != 2 || node.Name != "db-1" {
+		t.Errorf("节点为 %+v", node)
+	}
+}
+
+func TestUpdateNode(t *testing.T) {
+	client, got := newTestClient(t, http.StatusOK, `{"ID":3,"Name":"web-3","City":"Tokyo"}`)
+
+	allowed := []string{}
+	node, err := client.UpdateNode(context.Background(), 3, UpdateNodeRequest{City: String("Tokyo"), AllowedIPs: &allowed})
+	if err != nil {
+		t.Fatalf("UpdateNode: %v", err)
+	}
+	if got.method != http.MethodPatch || got.path != "/api/nodes/3" {
+		t.Errorf("请求 %s %s，应为 PATCH /api/nodes/3", got.method, got.path)
+	}
+	// 为 nil 的字段不发送，指向空切片的 AllowedIPs 发送空数组
+	want := map[string]interface{}{"City": "Tokyo", "AllowedIPs": []interface{}{}}
+	if !reflect.DeepEqual(got.body, want) {
+		t.Errorf("请求体为 %v，应为 %v", got.body, want)
+	}
+	if node.City != "Tokyo" {
+		t.Errorf("节点为 %+v", node)
+	}
+}
+
+func TestDeleteNode(t *testing.T) {
+	client, got := newTestClient(t, http.StatusNoContent, "")
+
+	if err := client.DeleteNode(context.Background(), 4); err != nil {
+		t.Fatalf("DeleteNode: %v", err)
+	}
+	if got.method != http.MethodDelete || got.path != "/api/nodes/4" {
+		t.Errorf("请求 %s %s，应为 DELETE /api/nodes/4", got.method, got.path)
+	}
+}
+
+func TestNodeHistory(t *testing.T) {
+	client, got := newTestClient(t, http.StatusOK, `[{"TimeStamp":1000,"State":{"CPU":12.5}},{"TimeStamp":1060,"State":{"CPU":3}}]`)
+
+	points, err := client.NodeHistory(context.Background(), 5, time.Unix(1000, 0), time.Unix(2000, 0), 10)
+	if err != nil {
+		t.Fatalf("NodeHistory: %v", err)
+	}
+	if got.path != "/api/nodes/5/history" || got.query != "limit=10&since=1000&until=2000" {
+		t.Errorf("请求 %s?%s", got.path, got.query)
+	}
+	if len(points) != 2 || points[0].TimeStamp != 1000 || points[0].State["CPU"] != 12.5 {
+		t.Errorf("历史数据为 %+v", points)
+	}
+
+	// 零值不发送，使用服务端默认值
+	if _, err := client.NodeHistory(context.Background(), 5, time.Time{}, time.Time{}, 0); err != nil {
+		t.Fatalf("NodeHistory: %v", err)
+	}
+	if got.query != "" {
+		t.Errorf("查询参数为 %q，应为空", got.query)
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		response string
+		want     Error
+	}{
+		{
+			name:     "校验失败",
+			status:   http.StatusBadRequest,
+			response: `{"Code":"invalid","Message":"Name 不能为空","Field":"Name"}`,
+			want:     Error{StatusCode: http.StatusBadRequest, Code: "invalid", Message: "Name 不能为空", Field: "Name"},
+		},
+		{
+			name:     "节点不存在",
+			status:   http.StatusNotFound,
+			response: `{"Code":"not_found","Message":"未找到节点"}`,
+			want:     Error{StatusCode: http.StatusNotFound, Code: "not_found", Message: "未找到节点"},
+		},
+		{
+			name:     "服务端错误",
+			status:   http.StatusInternalServerError,
+			response: `{"Code":"internal","Message":"数据库读取失败"}`,
+			want:     Error{StatusCode: http.StatusInternalServerError, Code: "internal", Message: "数据库读取失败"},
+		},
+		{
+			name:     "非 JSON 响应",
+			status:   http.StatusBadGateway,
+			response: "bad gateway\n",
+			want:     Error{StatusCode: http.StatusBadGateway, Code: "unknown", Message: "bad gateway"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := newTestClient(t, tt.status, tt.response)
+			_, err := client.GetNode(context.Background(), 1)
+			apiErr, ok := err.(*Error)
+			if !ok {
+				t.Fatalf("错误为 %T %v，应为 *Error", err, err)
+			}
+			if *apiErr != tt.want {
+				t.Errorf("错误为 %+v，应为 %+v", *apiErr, tt.want)
+			}
+			if IsNotFound(err) != (tt.status == http.StatusNotFound) {
+				t.Errorf("IsNotFound 为 %v", IsNotFound(err))
+			}
+		})
+	}
+}
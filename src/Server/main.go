@@ -1,8 +1,10 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 )
@@ -22,7 +24,19 @@ func main() {
 		log.Printf("    -node_uri   	指定Node API路径 (默认为 /Monitor/Node)\n")
 		log.Printf("    -broad_uri  	指定广播API路径 (默认为 /Monitor/Status)\n")
 		log.Printf("    -console_uri	指定控制台API路径 (默认为 /Monitor/Console)\n")
+		log.Printf("    -login_uri  	指定控制台登录API路径 (默认为 /Monitor/Login)\n")
+		log.Printf("    -api_uri    	指定REST管理接口路径 (默认为 /api)\n")
+		log.Printf("    -detail_uri 	指定节点详情API路径 (默认为 /Monitor/Detail)\n")
+		log.Printf("    -metrics_uri	指定Prometheus指标路径 (默认为 /metrics)\n")
 		log.Printf("    -token      	指定节点Token\n")
+		log.Printf("    -tls_cert   	指定TLS证书文件，与 -tls_key 同时指定时启用 HTTPS/WSS\n")
+		log.Printf("    -tls_key    	指定TLS私钥文件\n")
+		log.Printf("    -tls_client_ca	指定签发节点客户端证书的CA文件\n")
+		log.Printf("    -tls_cert_login	允许节点只使用客户端证书登录\n")
+		log.Printf("    -trusted_proxies	指定可信代理的IP或CIDR，多个以逗号分隔\n")
+		log.Printf("    -proxy_protocol	来自可信代理的连接使用PROXY协议\n")
+		log.Printf("    -legacy_login	允许旧版客户端直接发送Token登录 (默认为 false)\n")
+		log.Printf("    -auth_key_file	指定加密节点认证密钥的主密钥文件 (默认为 LightMonitor.key)\n")
 		log.Printf("    -type       	指定数据库类型 (默认为 sqlite)\n")
 		log.Printf("    -filepath   	指定数据库文件路径 (默认为 LightMonitor.db)\n")
 		log.Printf("    -host       	指定数据库主机 (默认为 127.0.0.1)\n")
@@ -31,16 +45,38 @@ func main() {
 		log.Printf("    -password   	指定数据库密码\n")
 		log.Printf("    -dbname     	指定数据库名称 (默认为 LightMonitor)\n")
 		log.Printf("\n")
+		log.Printf("子命令 (在参数之后指定，执行后退出)：\n")
+		log.Printf("    export [-format yaml|json|csv] [-credentials] [-o 文件]	导出所有节点，-credentials 包含认证信息用于迁移\n")
+		log.Printf("    import [-format yaml|json|csv] [-dry_run] [-on_conflict error|skip|update] 文件|-	导入节点\n")
+		log.Printf("\n")
 		log.Printf("    当 token 存在时，忽略配置文件\n")
 		os.Exit(1)
 	}
 
+	// 加载主密钥，迁移数据库时需要加密节点认证密钥
+	if err := LoadAuthSecret(config.AuthKeyFile); err != nil {
+		log.Fatalf("加载主密钥失败: %v", err)
+	}
+
 	// 初始化数据库
 	err = InitDatabase(config.Database)
 	if err != nil {
 		log.Fatalf("初始化数据库失败: %v", err)
 	}
 
+	// 子命令
+	if flag.NArg() > 0 {
+		if err := RunCommand(flag.Args()); err != nil {
+			log.Fatalf("%v", err)
+		}
+		return
+	}
+
+	err = ClearClients()
+	if err != nil {
+		log.Fatalf("初始化数据库失败: %v", err)
+	}
+
 	log.Printf("监听地址: %s\n", config.Listen)
 	log.Printf("数据库类型: %s", config.Database.Type)
 	if config.Database.Type == "sqlite" {
@@ -48,6 +84,13 @@ func main() {
 	}
 	log.Printf("节点 URI: %s\n", config.NodeURI)
 	log.Printf("广播 URI: %s\n", config.BroadURI)
+	log.Printf("登录 URI: %s\n", config.LoginURI)
+	log.Printf("管理接口 URI: %s\n", config.APIURI)
+	log.Printf("详情 URI: %s\n", config.DetailURI)
+	log.Printf("指标 URI: %s\n", config.MetricsURI)
+	if config.LegacyLogin {
+		log.Printf("已允许旧版登录，所有客户端升级后建议关闭 legacy_login\n")
+	}
 
 	// 初始化 WebSocket 路由
 	initRoutes()
@@ -55,9 +98,45 @@ func main() {
 	// 启动广播的 Goroutine
 	go FetchData()
 	go StartBroad()
+	go CleanHistory()
+	go TrackReportRate()
+	StartForward()
+
+	tlsConfig, err := LoadTLSConfig()
+	if err != nil {
+		log.Fatalf("TLS 配置错误: %v", err)
+	}
+
+	if err := InitTrustedProxies(); err != nil {
+		log.Fatalf("可信代理配置错误: %v", err)
+	}
+	if err := InitSecurity(); err != nil {
+		log.Fatalf("安全配置错误: %v", err)
+	}
+	if err := InitAlertRules(); err != nil {
+		log.Fatalf("告警规则配置错误: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		log.Fatalf("启动失败: %v", err)
+	}
+	if config.ProxyProtocol {
+		log.Printf("已启用 PROXY 协议，可信代理: %v\n", config.TrustedProxies)
+		listener = NewProxyListener(listener)
+	}
 
 	// 启动 HTTP 服务
-	err = http.ListenAndServe(config.Listen, nil)
+	server := &http.Server{TLSConfig: tlsConfig}
+	if tlsConfig != nil {
+		log.Printf("已启用 TLS，证书: %s\n", config.TLSCert)
+		if tlsConfig.ClientCAs != nil {
+			log.Printf("已启用节点客户端证书校验: %s\n", config.TLSClientAuth)
+		}
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		err = server.Serve(listener)
+	}
 	if err != nil {
 		log.Fatalf("启动失败: %v", err)
 	}